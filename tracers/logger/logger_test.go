@@ -77,6 +77,31 @@ func TestStoreCapture(t *testing.T) {
 	}
 }
 
+func TestFaultCapture(t *testing.T) {
+	var (
+		logger   = NewStructLogger(nil)
+		env      = vm.NewEVM(vm.BlockContext{}, vm.TxContext{}, &dummyStatedb{}, params.TestChainConfig, vm.Config{Tracer: logger})
+		contract = vm.NewContract(&dummyContractRef{}, &dummyContractRef{}, new(big.Int), 100000)
+	)
+	// revert(0, 0)
+	contract.Code = []byte{byte(vm.PUSH1), 0x0, byte(vm.PUSH1), 0x0, byte(vm.REVERT)}
+	logger.CaptureStart(env, common.Address{}, contract.Address(), false, nil, 0, nil)
+	_, err := env.Interpreter().Run(context.Background(), contract, []byte{}, false)
+	if err != vm.ErrExecutionReverted {
+		t.Fatalf("expected %v, got %v", vm.ErrExecutionReverted, err)
+	}
+	logs := logger.StructLogs()
+	if len(logs) != 3 {
+		t.Fatalf("expected 3 logs, got %d", len(logs))
+	}
+	if logs[1].Err != nil || logs[2].Err != vm.ErrExecutionReverted {
+		t.Fatalf("expected the error on the REVERT step only, got %v and %v", logs[1].Err, logs[2].Err)
+	}
+	if formatted := FormatLogs(logs); formatted[2].Error != vm.ErrExecutionReverted.Error() {
+		t.Fatalf("expected formatted error %q, got %q", vm.ErrExecutionReverted.Error(), formatted[2].Error)
+	}
+}
+
 // Tests that blank fields don't appear in logs when JSON marshalled, to reduce
 // logs bloat and confusion. See https://github.com/ethereum/go-ethereum/issues/24487
 func TestStructLogMarshalingOmitEmpty(t *testing.T) {
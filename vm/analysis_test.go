@@ -17,10 +17,19 @@
 package vm
 
 import (
+	"context"
+	"fmt"
+	"math/big"
 	"math/bits"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/holiman/uint256"
 )
 
 func TestJumpDestAnalysis(t *testing.T) {
@@ -108,3 +117,96 @@ func BenchmarkJumpdestOpAnalysis(bench *testing.B) {
 	op = STOP
 	bench.Run(op.String(), bencher)
 }
+
+// jumpingCode returns a contract of about 24KB jumping over its PUSH32 filled body
+func jumpingCode() []byte {
+	var body []byte
+	for len(body) < 24000 {
+		body = append(body, byte(PUSH32))
+		body = append(body, make([]byte, 32)...)
+	}
+	dest := 4 + len(body)
+	code := []byte{byte(PUSH2), byte(dest >> 8), byte(dest), byte(JUMP)}
+	code = append(code, body...)
+	return append(code, byte(JUMPDEST), byte(STOP))
+}
+
+// newJumpdestCacheEVM returns an EVM with the given jumpdest cache size and the jumping code
+// deployed at address
+func newJumpdestCacheEVM(size int, address common.Address) *EVM {
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.SetCode(address, jumpingCode())
+	statedb.Finalise(true)
+
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{JumpdestCacheSize: size})
+	evm.CloseAspectCall()
+	return evm
+}
+
+func TestJumpdestCache(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	codeHash := crypto.Keccak256Hash(jumpingCode())
+
+	if evm := newJumpdestCacheEVM(-1, address); evm.interpreter.jumpdestCache != nil {
+		t.Fatal("expected the jumpdest cache to be disabled")
+	}
+	// the cache is enabled by default
+	if evm := newJumpdestCacheEVM(0, address); evm.interpreter.jumpdestCache == nil {
+		t.Fatal("expected the jumpdest cache to be enabled")
+	}
+
+	evm := newJumpdestCacheEVM(1, address)
+	for i := 0; i < 2; i++ {
+		if _, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int)); err != nil {
+			t.Fatalf("call %d: unexpected error: %v", i, err)
+		}
+		cache := evm.interpreter.jumpdestCache
+		if cache.Len() != 1 || !cache.Contains(codeHash) {
+			t.Fatalf("call %d: expected the analysis of %x to be cached", i, codeHash)
+		}
+	}
+}
+
+func BenchmarkJumpdestCache(bench *testing.B) {
+	address := common.BytesToAddress([]byte("contract"))
+	for _, size := range []int{-1, DefaultJumpdestCacheSize} {
+		evm := newJumpdestCacheEVM(size, address)
+		bench.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				// keep the call tree from growing over the iterations
+				evm.tracer = NewTracer()
+				evm.interpreter.tracer = evm.tracer
+				evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int))
+			}
+		})
+	}
+}
+
+// BenchmarkValidJumpdest measures the validation of the first jump of a top level call,
+// which analyses the whole code unless a previous call has cached the analysis
+func BenchmarkValidJumpdest(bench *testing.B) {
+	var (
+		address  = common.BytesToAddress([]byte("contract"))
+		code     = jumpingCode()
+		codeHash = crypto.Keccak256Hash(code)
+		dest     = uint256.NewInt(uint64(len(code) - 2))
+	)
+	for _, size := range []int{-1, DefaultJumpdestCacheSize} {
+		cache := newJumpdestCacheEVM(size, address).interpreter.jumpdestCache
+		bench.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				contract := NewContract(AccountRef(common.Address{}), AccountRef(address), new(big.Int), 0)
+				contract.SetCallCode(&address, codeHash, code)
+				contract.jumpdestCache = cache
+				if !contract.validJumpdest(dest) {
+					b.Fatal("expected a valid jump destination")
+				}
+			}
+		})
+	}
+}
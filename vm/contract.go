@@ -20,6 +20,7 @@ import (
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/lru"
 	"github.com/holiman/uint256"
 )
 
@@ -50,8 +51,9 @@ type Contract struct {
 	caller        ContractRef
 	self          ContractRef
 
-	jumpdests map[common.Hash]bitvec // Aggregated result of JUMPDEST analysis.
-	analysis  bitvec                 // Locally cached result of JUMPDEST analysis
+	jumpdests     map[common.Hash]bitvec             // Aggregated result of JUMPDEST analysis.
+	analysis      bitvec                             // Locally cached result of JUMPDEST analysis
+	jumpdestCache *lru.BasicLRU[common.Hash, bitvec] // Analyses of the previous top level calls, set by the interpreter
 
 	Code     []byte
 	CodeHash common.Hash
@@ -110,9 +112,18 @@ func (c *Contract) isCode(udest uint64) bool {
 		// Does parent context have the analysis?
 		analysis, exist := c.jumpdests[c.CodeHash]
 		if !exist {
-			// Do the analysis and save in parent context
+			// Did a previous top level call do the analysis?
+			if c.jumpdestCache != nil {
+				analysis, exist = c.jumpdestCache.Get(c.CodeHash)
+			}
+			if !exist {
+				analysis = codeBitmap(c.Code)
+				if c.jumpdestCache != nil {
+					c.jumpdestCache.Add(c.CodeHash, analysis)
+				}
+			}
+			// Save in parent context
 			// We do not need to store it in c.analysis
-			analysis = codeBitmap(c.Code)
 			c.jumpdests[c.CodeHash] = analysis
 		}
 		// Also stash it in current contract for faster access
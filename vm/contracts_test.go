@@ -19,13 +19,19 @@ package vm
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"math/big"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
 )
 
 // precompiledTest defines the input/output pairs for precompiled contract tests.
@@ -392,3 +398,54 @@ func BenchmarkPrecompiledBLS12381G2MultiExpWorstCase(b *testing.B) {
 	}
 	benchmarkPrecompiled("0f", testcase, b)
 }
+
+// sha256Precompile is a custom precompiled contract returning the sha256 hash of its input
+type sha256Precompile struct{}
+
+func (sha256Precompile) RequiredGas(input []byte) uint64 {
+	return 100
+}
+
+func (sha256Precompile) Run(ctx context.Context, input []byte) ([]byte, error) {
+	h := sha256.Sum256(input)
+	return h[:], nil
+}
+
+func TestCustomPrecompiles(t *testing.T) {
+	var (
+		address    = common.BytesToAddress([]byte("contract"))
+		precompile = common.BytesToAddress([]byte{0xff})
+		vmctx      = BlockContext{
+			Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+			BlockNumber: big0,
+		}
+		// mstore(0, 42) pop(staticcall(gas(), 0xff, 0, 32, 0, 32)) return(0, 32)
+		code = common.Hex2Bytes("602a600052" + "6020600060206000" + "60ff5afa" + "50" + "60206000f3")
+	)
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.CreateAccount(address)
+	statedb.SetCode(address, code)
+	statedb.Finalise(true)
+
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{
+		CustomPrecompiles: map[common.Address]PrecompiledContract{precompile: sha256Precompile{}},
+	})
+	evm.CloseAspectCall()
+
+	ret, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want := sha256.Sum256(common.LeftPadBytes([]byte{42}, 32)); !bytes.Equal(ret, want[:]) {
+		t.Fatalf("have %x, want %x", ret, want)
+	}
+
+	// custom precompiles override the native ones
+	native := common.BytesToAddress([]byte{1})
+	evm.Config.CustomPrecompiles[native] = sha256Precompile{}
+	if p, ok := evm.precompile(native); !ok {
+		t.Fatal("precompile not found")
+	} else if _, isCustom := p.(sha256Precompile); !isCustom {
+		t.Fatalf("expected the custom precompile, got %T", p)
+	}
+}
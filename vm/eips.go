@@ -26,6 +26,9 @@ import (
 	"github.com/holiman/uint256"
 )
 
+// SloadBatchEIP is the custom EIP number enabling the SLOADBATCH opcode, it is not an official EIP
+const SloadBatchEIP = 10001
+
 var activators = map[int]func(*JumpTable){
 	3855: enable3855,
 	3860: enable3860,
@@ -37,6 +40,10 @@ var activators = map[int]func(*JumpTable){
 	1344: enable1344,
 	1153: enable1153,
 	5656: enable5656,
+	3074: enable3074,
+	7516: enable7516,
+
+	SloadBatchEIP: enableSloadBatch,
 }
 
 // EnableEIP enables the given EIP on the config.
@@ -214,13 +221,36 @@ func opTstore(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scop
 	return nil, nil
 }
 
-// opBaseFee implements BASEFEE opcode
+// opBaseFee implements BASEFEE opcode, a missing base fee is pushed as zero
 func opBaseFee(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	baseFee, _ := uint256.FromBig(interpreter.evm.Context.BaseFee)
+	baseFee := interpreter.intPool.get()
+	if interpreter.evm.Context.BaseFee != nil {
+		baseFee.SetFromBig(interpreter.evm.Context.BaseFee)
+	}
 	scope.Stack.push(baseFee)
 	return nil, nil
 }
 
+// enable7516 applies EIP-7516 (BLOBBASEFEE opcode)
+func enable7516(jt *JumpTable) {
+	jt[BLOBBASEFEE] = &operation{
+		execute:     opBlobBaseFee,
+		constantGas: GasQuickStep,
+		minStack:    minStack(0, 1),
+		maxStack:    maxStack(0, 1),
+	}
+}
+
+// opBlobBaseFee implements BLOBBASEFEE opcode, a missing blob base fee is pushed as zero
+func opBlobBaseFee(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
+	blobBaseFee := interpreter.intPool.get()
+	if interpreter.evm.Context.BlobBaseFee != nil {
+		blobBaseFee.SetFromBig(interpreter.evm.Context.BlobBaseFee)
+	}
+	scope.Stack.push(blobBaseFee)
+	return nil, nil
+}
+
 // enable3855 applies EIP-3855 (PUSH0 opcode)
 func enable3855(jt *JumpTable) {
 	// New opcode
@@ -234,7 +264,7 @@ func enable3855(jt *JumpTable) {
 
 // opPush0 implements the PUSH0 opcode
 func opPush0(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	scope.Stack.push(new(uint256.Int))
+	scope.Stack.push(interpreter.intPool.get())
 	return nil, nil
 }
 
@@ -270,3 +300,86 @@ func opMcopy(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope
 	scope.Memory.Copy(dst.Uint64(), src.Uint64(), length.Uint64())
 	return nil, nil
 }
+
+// authMagic is the EIP-3074 domain separator prepended to the AUTH signing message
+const authMagic = 0x03
+
+// enable3074 enables "EIP-3074: AUTH and AUTHCALL opcodes"
+// https://eips.ethereum.org/EIPS/eip-3074
+func enable3074(jt *JumpTable) {
+	jt[AUTH] = &operation{
+		execute:     opAuth,
+		constantGas: params.EcrecoverGas,
+		minStack:    minStack(4, 1),
+		maxStack:    maxStack(4, 1),
+	}
+
+	jt[AUTHCALL] = &operation{
+		execute:     opAuthcall,
+		constantGas: params.WarmStorageReadCostEIP2929,
+		dynamicGas:  gasCallEIP2929,
+		minStack:    minStack(7, 1),
+		maxStack:    maxStack(7, 1),
+		memorySize:  memoryCall,
+	}
+}
+
+// enableSloadBatch enables the custom SLOADBATCH opcode, which reads multiple storage
+// slots of the current contract with a single StateDB call
+func enableSloadBatch(jt *JumpTable) {
+	jt[SLOADBATCH] = &operation{
+		execute:     opSloadBatch,
+		constantGas: params.WarmStorageReadCostEIP2929,
+		dynamicGas:  gasSloadBatch,
+		minStack:    minStack(1, 0),
+		maxStack:    maxStack(1, 0),
+	}
+}
+
+// sloadBatchCount returns the number of slots read by SLOADBATCH from the count on top
+// of the stack, it is not ok if the stack holds fewer slot keys below the count. The
+// count itself is ensured by minStack.
+func sloadBatchCount(stack *Stack) (int, bool) {
+	count := stack.peek()
+	if !count.IsUint64() || count.Uint64() >= uint64(stack.len()) {
+		return 0, false
+	}
+	return int(count.Uint64()), true
+}
+
+// opSloadBatch implements the SLOADBATCH opcode. It pops a count N followed by N slot keys,
+// and pushes the N slot values, the value of each key takes the stack position of the key.
+func opSloadBatch(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
+	n, ok := sloadBatchCount(scope.Stack)
+	if !ok {
+		count := scope.Stack.peek()
+		required := int(params.StackLimit) + 1
+		if count.IsUint64() && count.Uint64() < params.StackLimit {
+			required = int(count.Uint64()) + 1
+		}
+		return nil, &ErrStackUnderflow{stackLen: scope.Stack.len(), required: required}
+	}
+	scope.Stack.pop()
+	if n == 0 {
+		return nil, nil
+	}
+
+	address := scope.Contract.Address()
+	slots := make([]common.Hash, n)
+	for i := range slots {
+		slots[i] = scope.Stack.Back(i).Bytes32()
+		// the slots are charged by gasSloadBatch, they are warm from now on
+		interpreter.tracer.SaveAccessedSlot(address, slots[i])
+		if _, slotPresent := interpreter.evm.StateDB.SlotInAccessList(address, slots[i]); !slotPresent {
+			interpreter.evm.StateDB.AddSlotToAccessList(address, slots[i])
+		}
+		if interpreter.evm.Config.TrackStorageReads {
+			interpreter.tracer.SaveStorageRead(scope.Contract.Address(), scope.Stack.Back(i))
+		}
+	}
+	vals := getStateBatch(interpreter.evm.StateDB, address, slots)
+	for i, val := range vals {
+		scope.Stack.Back(i).SetBytes(val.Bytes())
+	}
+	return nil, nil
+}
@@ -19,6 +19,7 @@ package vm
 import (
 	"errors"
 	"fmt"
+	"reflect"
 )
 
 // List evm execution errors
@@ -34,13 +35,31 @@ var (
 	ErrInvalidJump              = errors.New("invalid jump destination")
 	ErrWriteProtection          = errors.New("write protection")
 	ErrReturnDataOutOfBounds    = errors.New("return data out of bounds")
+	ErrMemoryOutOfBounds        = errors.New("memory out of bounds")
 	ErrGasUintOverflow          = errors.New("gas uint64 overflow")
 	ErrInvalidCode              = errors.New("invalid code: must not begin with 0xef")
 	ErrNonceUintOverflow        = errors.New("nonce uint64 overflow")
+	ErrAuthorizedNotSet         = errors.New("authorized account not set")
+	ErrStepLimitExceeded        = errors.New("instruction step limit exceeded")
+
+	// errors of the state journaling opcodes
+	ErrStorageEncoding    = errors.New("storage encoding error")
+	ErrStorageTooLarge    = errors.New("storage too large to load")
+	ErrOffsetOutOfRange   = errors.New("offset out of range")
+	ErrTypeSizeOutOfRange = errors.New("type size out of range")
+	ErrMemoryDataTooLong  = errors.New("mem data too long")
+
+	// errors of the execution recordings
+	ErrInvalidRecording = errors.New("invalid recording")
+	ErrReplayDiverged   = errors.New("replay diverged from the recording")
 
 	// errStopToken is an internal token indicating interpreter loop termination,
 	// never returned to outside callers.
 	errStopToken = errors.New("stop token")
+
+	// errContextCanceled is returned when the context of the execution is cancelled
+	// or its deadline is exceeded, the remaining gas of the frame is kept.
+	errContextCanceled = errors.New("execution context canceled")
 )
 
 // ErrStackUnderflow wraps an evm error when the items on the stack less
@@ -71,3 +90,111 @@ type ErrInvalidOpCode struct {
 }
 
 func (e *ErrInvalidOpCode) Error() string { return fmt.Sprintf("invalid opcode: %s", e.opcode) }
+
+// ErrForbiddenOpcode wraps an evm error when an opcode forbidden by the config is encountered.
+type ErrForbiddenOpcode struct {
+	opcode OpCode
+}
+
+func (e *ErrForbiddenOpcode) Error() string { return fmt.Sprintf("forbidden opcode: %s", e.opcode) }
+
+// EVMErrorCode classifies the errors of the execution
+type EVMErrorCode int
+
+const (
+	ErrorCodeUnknown EVMErrorCode = iota
+	ErrorCodeOutOfGas
+	ErrorCodeCodeStoreOutOfGas
+	ErrorCodeDepth
+	ErrorCodeInsufficientBalance
+	ErrorCodeContractAddressCollision
+	ErrorCodeExecutionReverted
+	ErrorCodeMaxInitCodeSizeExceeded
+	ErrorCodeMaxCodeSizeExceeded
+	ErrorCodeInvalidJump
+	ErrorCodeWriteProtection
+	ErrorCodeReturnDataOutOfBounds
+	ErrorCodeMemoryOutOfBounds
+	ErrorCodeGasUintOverflow
+	ErrorCodeInvalidCode
+	ErrorCodeNonceUintOverflow
+	ErrorCodeAuthorizedNotSet
+	ErrorCodeStepLimitExceeded
+	ErrorCodeStackUnderflow
+	ErrorCodeStackOverflow
+	ErrorCodeInvalidOpCode
+	ErrorCodeForbiddenOpcode
+	ErrorCodeContextCanceled
+	ErrorCodeJournal
+)
+
+// errorCodes maps the sentinel errors to their codes
+var errorCodes = map[error]EVMErrorCode{
+	ErrOutOfGas:                 ErrorCodeOutOfGas,
+	ErrCodeStoreOutOfGas:        ErrorCodeCodeStoreOutOfGas,
+	ErrDepth:                    ErrorCodeDepth,
+	ErrInsufficientBalance:      ErrorCodeInsufficientBalance,
+	ErrContractAddressCollision: ErrorCodeContractAddressCollision,
+	ErrExecutionReverted:        ErrorCodeExecutionReverted,
+	ErrMaxInitCodeSizeExceeded:  ErrorCodeMaxInitCodeSizeExceeded,
+	ErrMaxCodeSizeExceeded:      ErrorCodeMaxCodeSizeExceeded,
+	ErrInvalidJump:              ErrorCodeInvalidJump,
+	ErrWriteProtection:          ErrorCodeWriteProtection,
+	ErrReturnDataOutOfBounds:    ErrorCodeReturnDataOutOfBounds,
+	ErrMemoryOutOfBounds:        ErrorCodeMemoryOutOfBounds,
+	ErrGasUintOverflow:          ErrorCodeGasUintOverflow,
+	ErrInvalidCode:              ErrorCodeInvalidCode,
+	ErrNonceUintOverflow:        ErrorCodeNonceUintOverflow,
+	ErrAuthorizedNotSet:         ErrorCodeAuthorizedNotSet,
+	ErrStepLimitExceeded:        ErrorCodeStepLimitExceeded,
+	errContextCanceled:          ErrorCodeContextCanceled,
+	ErrStorageEncoding:          ErrorCodeJournal,
+	ErrStorageTooLarge:          ErrorCodeJournal,
+	ErrOffsetOutOfRange:         ErrorCodeJournal,
+	ErrTypeSizeOutOfRange:       ErrorCodeJournal,
+	ErrMemoryDataTooLong:        ErrorCodeJournal,
+}
+
+// EVMError is an error of the execution along with where it occurred, returned by Run only
+// if Config.StructuredErrors is enabled. It keeps the message of the wrapped error, which
+// remains reachable by errors.Is and errors.As.
+type EVMError struct {
+	Code      EVMErrorCode
+	Msg       string
+	PC        uint64
+	OpCode    OpCode
+	CallDepth int
+
+	err error
+}
+
+// newEVMError wraps an error of the execution of the given opcode, errors already wrapped
+// are returned as they are
+func newEVMError(err error, pc uint64, op OpCode, depth int) error {
+	if _, ok := err.(*EVMError); ok {
+		return err
+	}
+
+	var code EVMErrorCode
+	switch err.(type) {
+	case *ErrStackUnderflow:
+		code = ErrorCodeStackUnderflow
+	case *ErrStackOverflow:
+		code = ErrorCodeStackOverflow
+	case *ErrInvalidOpCode:
+		code = ErrorCodeInvalidOpCode
+	case *ErrForbiddenOpcode:
+		code = ErrorCodeForbiddenOpcode
+	default:
+		// errors of types which are not hashable would panic on the map lookup
+		if reflect.TypeOf(err).Comparable() {
+			code = errorCodes[err]
+		}
+	}
+	return &EVMError{Code: code, Msg: err.Error(), PC: pc, OpCode: op, CallDepth: depth, err: err}
+}
+
+func (e *EVMError) Error() string { return e.Msg }
+
+// Unwrap returns the wrapped error
+func (e *EVMError) Unwrap() error { return e.err }
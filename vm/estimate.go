@@ -0,0 +1,80 @@
+package vm
+
+import (
+	"context"
+	"errors"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core"
+)
+
+// estimateGasCap is the upper bound of the gas estimation if the block has no gas limit
+const estimateGasCap = 30_000_000
+
+// EstimateGas binary-searches the smallest gas limit of a transaction calling addr which
+// executes without failing, including the intrinsic gas of the transaction. The search is
+// bounded by the block gas limit, or estimateGasCap if the block has none. Since every
+// attempt runs the call, the gas retained by the 63/64 rule of sub-calls is accounted for.
+// A reverting call returns ErrExecutionReverted, any other failure with the maximum gas
+// returns ErrOutOfGas, and the error of ctx is returned once it is done. The state, the
+// Tracer, the EVMLogger and the metrics are left untouched.
+func (evm *EVM) EstimateGas(ctx context.Context, caller ContractRef, addr common.Address, input []byte, value *big.Int) (uint64, error) {
+	intrinsic, err := core.IntrinsicGas(input, nil, false, evm.chainRules.IsHomestead, evm.chainRules.IsIstanbul, evm.chainRules.IsShanghai)
+	if err != nil {
+		return 0, err
+	}
+
+	hi := evm.Context.GasLimit
+	if hi == 0 {
+		hi = estimateGasCap
+	}
+	if hi < intrinsic {
+		return 0, ErrOutOfGas
+	}
+	if err := evm.tryCall(ctx, caller, addr, input, hi-intrinsic, value); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return 0, ctxErr
+		}
+		if errors.Is(err, ErrExecutionReverted) {
+			return 0, err
+		}
+		return 0, ErrOutOfGas
+	}
+
+	// lo always fails and hi always succeeds
+	lo := intrinsic - 1
+	for lo+1 < hi {
+		mid := lo + (hi-lo)/2
+		err := evm.tryCall(ctx, caller, addr, input, mid-intrinsic, value)
+		// a cancelled attempt fails whatever the gas, it must not be taken for a lack of gas
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return 0, ctxErr
+		}
+		if err == nil {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi, nil
+}
+
+// tryCall runs a call with the given gas and reverts its state changes afterwards, the tracer
+// and the EVMLogger are detached and the metrics disabled during the call so that the attempt
+// is not recorded
+func (evm *EVM) tryCall(ctx context.Context, caller ContractRef, addr common.Address, input []byte, gas uint64, value *big.Int) error {
+	tracer, logger, noMetrics := evm.tracer, evm.Config.Tracer, evm.noMetrics
+	evm.tracer, evm.Config.Tracer, evm.noMetrics = NewTracer(), nil, true
+	evm.interpreter.tracer = evm.tracer
+	defer func() {
+		evm.tracer, evm.Config.Tracer, evm.noMetrics = tracer, logger, noMetrics
+		evm.interpreter.tracer = tracer
+	}()
+
+	snapshot := evm.StateDB.Snapshot()
+	defer evm.StateDB.RevertToSnapshot(snapshot)
+
+	_, _, err := evm.Call(ctx, caller, addr, input, gas, value)
+	return err
+}
@@ -0,0 +1,118 @@
+package vm
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+func TestEstimateGas(t *testing.T) {
+	var (
+		sender = common.Address{1}
+		store  = common.BytesToAddress([]byte("store"))
+		caller = common.BytesToAddress([]byte("caller"))
+		revert = common.BytesToAddress([]byte("revert"))
+		loop   = common.BytesToAddress([]byte("loop"))
+	)
+	// sstore(0, 1) stop
+	storeCode := []byte{byte(PUSH1), 1, byte(PUSH1), 0, byte(SSTORE), byte(STOP)}
+	// if iszero(call(gas(), store, 0, 0, 0, 0, 0)) { revert(0, 0) } stop
+	callerCode := []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH20)}
+	callerCode = append(callerCode, store.Bytes()...)
+	callerCode = append(callerCode, byte(GAS), byte(CALL))
+	callerCode = append(callerCode, byte(ISZERO), byte(PUSH1), byte(len(callerCode)+5), byte(JUMPI), byte(STOP),
+		byte(JUMPDEST), byte(PUSH1), 0, byte(PUSH1), 0, byte(REVERT))
+	// revert(0, 0)
+	revertCode := []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(REVERT)}
+	// jumpdest push1 0 jump
+	loopCode := []byte{byte(JUMPDEST), byte(PUSH1), 0, byte(JUMP)}
+
+	newEVM := func() *EVM {
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.SetCode(store, storeCode)
+		statedb.SetCode(caller, callerCode)
+		statedb.SetCode(revert, revertCode)
+		statedb.SetCode(loop, loopCode)
+		statedb.Finalise(true)
+
+		vmctx := BlockContext{
+			CanTransfer: func(StateDB, common.Address, *big.Int) bool { return true },
+			Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+			BlockNumber: big0,
+			GasLimit:    1_000_000,
+		}
+		evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+		evm.CloseAspectCall()
+		return evm
+	}
+
+	for i, to := range []common.Address{store, caller} {
+		evm := newEVM()
+		estimate, err := evm.EstimateGas(context.Background(), AccountRef(sender), to, nil, new(big.Int))
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %v", i, err)
+		}
+		if calls := len(evm.Tracer().CallTree().Flatten()); calls != 0 {
+			t.Fatalf("test %d: expected the estimation not to be traced, got %d calls", i, calls)
+		}
+		if i == 0 && estimate != params.TxGas+3+3+params.ColdSloadCostEIP2929+params.SstoreSetGasEIP2200 {
+			t.Fatalf("test %d: unexpected estimate %d", i, estimate)
+		}
+
+		// the estimate is the smallest gas succeeding
+		execGas := estimate - params.TxGas
+		if err := evm.tryCall(context.Background(), AccountRef(sender), to, nil, execGas-1, new(big.Int)); err == nil {
+			t.Fatalf("test %d: expected a failure with %d gas", i, estimate-1)
+		}
+		if _, _, err := evm.Call(context.Background(), AccountRef(sender), to, nil, execGas, new(big.Int)); err != nil {
+			t.Fatalf("test %d: unexpected error with the estimated gas: %v", i, err)
+		}
+
+		// the gas retained by the 63/64 rule keeps the estimate within 1% of the gas used
+		_, leftOverGas, err := newEVM().Call(context.Background(), AccountRef(sender), to, nil, 1_000_000, new(big.Int))
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %v", i, err)
+		}
+		used := params.TxGas + 1_000_000 - leftOverGas
+		if estimate < used || (estimate-used)*100 > used {
+			t.Fatalf("test %d: estimate %d not within 1%% of the gas used %d", i, estimate, used)
+		}
+	}
+
+	if _, err := newEVM().EstimateGas(context.Background(), AccountRef(sender), revert, nil, new(big.Int)); err != ErrExecutionReverted {
+		t.Fatalf("expected %v, got %v", ErrExecutionReverted, err)
+	}
+	if _, err := newEVM().EstimateGas(context.Background(), AccountRef(sender), loop, nil, new(big.Int)); err != ErrOutOfGas {
+		t.Fatalf("expected %v, got %v", ErrOutOfGas, err)
+	}
+
+	// the cancellation is returned rather than taken for a lack of gas
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := newEVM().EstimateGas(ctx, AccountRef(sender), store, nil, new(big.Int)); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	// including during the search
+	if _, err := newEVM().EstimateGas(&cancelAfterContext{Context: context.Background(), checks: 1}, AccountRef(sender), store, nil, new(big.Int)); err != context.Canceled {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+}
+
+// cancelAfterContext is a context which is cancelled once its error is checked a number of times
+type cancelAfterContext struct {
+	context.Context
+	checks int
+}
+
+func (ctx *cancelAfterContext) Err() error {
+	if ctx.checks--; ctx.checks < 0 {
+		return context.Canceled
+	}
+	return nil
+}
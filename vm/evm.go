@@ -18,6 +18,7 @@ package vm
 
 import (
 	"context"
+	"errors"
 	"math/big"
 	"sync/atomic"
 
@@ -47,6 +48,11 @@ type (
 )
 
 func (evm *EVM) precompile(addr common.Address) (PrecompiledContract, bool) {
+	// custom precompiles take priority over the native ones
+	if p, ok := evm.Config.CustomPrecompiles[addr]; ok {
+		return p, true
+	}
+
 	var precompiles map[common.Address]PrecompiledContract
 	switch {
 	case evm.chainRules.IsBerlin:
@@ -80,6 +86,7 @@ type BlockContext struct {
 	Time        uint64         // Provides information for TIME
 	Difficulty  *big.Int       // Provides information for DIFFICULTY
 	BaseFee     *big.Int       // Provides information for BASEFEE
+	BlobBaseFee *big.Int       // Provides information for BLOBBASEFEE
 	Random      *common.Hash   // Provides information for PREVRANDAO
 }
 
@@ -174,6 +181,8 @@ type EVM struct {
 	callGasTemp uint64
 	// state change & call stack tracer
 	tracer *Tracer
+	// noMetrics disables the metrics of the execution, such as during the attempts of EstimateGas
+	noMetrics bool
 
 	IsExecuteJP bool
 }
@@ -200,6 +209,10 @@ func NewEVM(blockCtx BlockContext, txCtx TxContext, statedb StateDB, chainConfig
 func (evm *EVM) Reset(txCtx TxContext, statedb StateDB) {
 	evm.TxContext = txCtx
 	evm.StateDB = statedb
+	evm.interpreter.referenceSlots.Purge()
+	if evm.interpreter.opcodeCounts != nil {
+		evm.interpreter.opcodeCounts = make(map[OpCode]uint64)
+	}
 }
 
 // Cancel cancels any running EVM operation. This may be called concurrently and
@@ -213,6 +226,15 @@ func (evm *EVM) Cancelled() bool {
 	return evm.abort.Load()
 }
 
+// maxCallDepth returns the call depth limit, Config.MaxCallDepth overrides
+// the default params.CallCreateDepth if set
+func (evm *EVM) maxCallDepth() int {
+	if evm.Config.MaxCallDepth > 0 {
+		return evm.Config.MaxCallDepth
+	}
+	return int(params.CallCreateDepth)
+}
+
 // Interpreter returns the current interpreter
 func (evm *EVM) Interpreter() *EVMInterpreter {
 	return evm.interpreter
@@ -238,10 +260,17 @@ func (evm *EVM) Tracer() *Tracer {
 func (evm *EVM) Call(ctx context.Context, caller ethvm.ContractRef, addr common.Address, input []byte, gas uint64, value *big.Int) (ret []byte, leftOverGas uint64, err error) {
 	tracer := evm.Tracer()
 	tracer.SaveCall(caller.Address(), &addr, input, uint256.MustFromBig(value), uint256.NewInt(gas))
+	if evm.depth == 0 {
+		// the nonce of the sender has been incremented by the state transition already
+		tracer.SaveSenderNonce(evm.StateDB.GetNonce(caller.Address()))
+	}
 
 	// exit from a call
 	defer func() {
 		tracer.ExitCall(leftOverGas, ret, err)
+		if m := evm.loadMetrics(); m != nil {
+			m.observeCall(evm.depth, gas, leftOverGas, err)
+		}
 	}()
 
 	blockNum := evm.Context.BlockNumber.Uint64()
@@ -254,9 +283,10 @@ func (evm *EVM) Call(ctx context.Context, caller ethvm.ContractRef, addr common.
 	}
 
 	// Fail if we're trying to execute above the call depth limit
-	if evm.depth > int(params.CallCreateDepth) {
+	if evm.depth > evm.maxCallDepth() {
 		return nil, gas, ErrDepth
 	}
+	evm.warmCoinbase()
 	// Fail if we're trying to transfer more than the available balance
 	if value.Sign() != 0 && !evm.Context.CanTransfer(evm.StateDB, caller.Address(), value) {
 		return nil, gas, ErrInsufficientBalance
@@ -289,6 +319,7 @@ func (evm *EVM) Call(ctx context.Context, caller ethvm.ContractRef, addr common.
 			return nil, gas, nil
 		}
 		evm.StateDB.CreateAccount(addr)
+		tracer.SaveCreation(addr)
 	}
 
 	// Transfer with balance tracer
@@ -385,7 +416,7 @@ func (evm *EVM) Call(ctx context.Context, caller ethvm.ContractRef, addr common.
 	// when we're in homestead this also counts for code storage gas errors.
 	if err != nil {
 		evm.StateDB.RevertToSnapshot(snapshot)
-		if err != ErrExecutionReverted {
+		if !errors.Is(err, ErrExecutionReverted) && !errors.Is(err, errContextCanceled) {
 			gas = 0
 		}
 		// TODO: consider clearing up unused snapshots:
@@ -405,7 +436,7 @@ func (evm *EVM) Call(ctx context.Context, caller ethvm.ContractRef, addr common.
 // code with the caller as context.
 func (evm *EVM) CallCode(ctx context.Context, caller ContractRef, addr common.Address, input []byte, gas uint64, value *big.Int) (ret []byte, leftOverGas uint64, err error) {
 	// Fail if we're trying to execute above the call depth limit
-	if evm.depth > int(params.CallCreateDepth) {
+	if evm.depth > evm.maxCallDepth() {
 		return nil, gas, ErrDepth
 	}
 	// Fail if we're trying to transfer more than the available balance
@@ -439,7 +470,7 @@ func (evm *EVM) CallCode(ctx context.Context, caller ContractRef, addr common.Ad
 	}
 	if err != nil {
 		evm.StateDB.RevertToSnapshot(snapshot)
-		if err != ErrExecutionReverted {
+		if !errors.Is(err, ErrExecutionReverted) && !errors.Is(err, errContextCanceled) {
 			gas = 0
 		}
 	}
@@ -453,7 +484,7 @@ func (evm *EVM) CallCode(ctx context.Context, caller ContractRef, addr common.Ad
 // code with the caller as context and the caller is set to the caller of the caller.
 func (evm *EVM) DelegateCall(ctx context.Context, caller ContractRef, addr common.Address, input []byte, gas uint64) (ret []byte, leftOverGas uint64, err error) {
 	// Fail if we're trying to execute above the call depth limit
-	if evm.depth > int(params.CallCreateDepth) {
+	if evm.depth > evm.maxCallDepth() {
 		return nil, gas, ErrDepth
 	}
 	snapshot := evm.StateDB.Snapshot()
@@ -483,7 +514,7 @@ func (evm *EVM) DelegateCall(ctx context.Context, caller ContractRef, addr commo
 	}
 	if err != nil {
 		evm.StateDB.RevertToSnapshot(snapshot)
-		if err != ErrExecutionReverted {
+		if !errors.Is(err, ErrExecutionReverted) && !errors.Is(err, errContextCanceled) {
 			gas = 0
 		}
 	}
@@ -496,7 +527,7 @@ func (evm *EVM) DelegateCall(ctx context.Context, caller ContractRef, addr commo
 // instead of performing the modifications.
 func (evm *EVM) StaticCall(ctx context.Context, caller ContractRef, addr common.Address, input []byte, gas uint64) (ret []byte, leftOverGas uint64, err error) {
 	// Fail if we're trying to execute above the call depth limit
-	if evm.depth > int(params.CallCreateDepth) {
+	if evm.depth > evm.maxCallDepth() {
 		return nil, gas, ErrDepth
 	}
 	// We take a snapshot here. This is a bit counter-intuitive, and could probably be skipped.
@@ -539,7 +570,7 @@ func (evm *EVM) StaticCall(ctx context.Context, caller ContractRef, addr common.
 	}
 	if err != nil {
 		evm.StateDB.RevertToSnapshot(snapshot)
-		if err != ErrExecutionReverted {
+		if !errors.Is(err, ErrExecutionReverted) && !errors.Is(err, errContextCanceled) {
 			gas = 0
 		}
 	}
@@ -558,6 +589,15 @@ func (c *codeAndHash) Hash() common.Hash {
 	return c.hash
 }
 
+// warmCoinbase adds the coinbase to the access list at the start of a transaction under
+// Shanghai rules (EIP-3651), the access list prepared by the host may leave it out.
+// It is added before any snapshot is taken, so that it stays warm if the transaction fails.
+func (evm *EVM) warmCoinbase() {
+	if evm.depth == 0 && evm.chainRules.IsShanghai {
+		evm.StateDB.AddAddressToAccessList(evm.Context.Coinbase)
+	}
+}
+
 // create creates a new contract using code as deployment code.
 func (evm *EVM) create(ctx context.Context, caller ContractRef, codeAndHash *codeAndHash, gas uint64, value *big.Int, address common.Address, typ OpCode) (ret []byte, addr common.Address, leftoverGas uint64, err error) {
 	tracer := evm.Tracer()
@@ -570,9 +610,15 @@ func (evm *EVM) create(ctx context.Context, caller ContractRef, codeAndHash *cod
 
 	// Depth check execution. Fail if we're trying to execute above the
 	// limit.
-	if evm.depth > int(params.CallCreateDepth) {
+	if evm.depth > evm.maxCallDepth() {
 		return nil, common.Address{}, gas, ErrDepth
 	}
+	// Oversized initcode of CREATE and CREATE2 fails in the gas calculation already,
+	// this only applies to the creation of the transaction (EIP-3860)
+	if evm.chainRules.IsShanghai && len(codeAndHash.code) > params.MaxInitCodeSize {
+		return nil, common.Address{}, gas, ErrMaxInitCodeSizeExceeded
+	}
+	evm.warmCoinbase()
 	if !evm.Context.CanTransfer(evm.StateDB, caller.Address(), value) {
 		return nil, common.Address{}, gas, ErrInsufficientBalance
 	}
@@ -581,6 +627,10 @@ func (evm *EVM) create(ctx context.Context, caller ContractRef, codeAndHash *cod
 		return nil, common.Address{}, gas, ErrNonceUintOverflow
 	}
 	evm.StateDB.SetNonce(caller.Address(), nonce+1)
+	if evm.depth == 0 {
+		// the nonce of the sender of a creation transaction is only incremented here
+		tracer.SaveSenderNonce(nonce + 1)
+	}
 	// We add this to the access list _before_ taking a snapshot. Even if the creation fails,
 	// the access-list change should not be rolled back
 	if evm.chainRules.IsBerlin {
@@ -597,6 +647,7 @@ func (evm *EVM) create(ctx context.Context, caller ContractRef, codeAndHash *cod
 	if evm.chainRules.IsEIP158 {
 		evm.StateDB.SetNonce(address, 1)
 	}
+	tracer.SaveCreation(address)
 	// Transfer with balance tracer
 	evm.Tracer().TransferWithRecord(evm.StateDB, caller.Address(), address, value, evm.Context.Transfer)
 
@@ -641,9 +692,9 @@ func (evm *EVM) create(ctx context.Context, caller ContractRef, codeAndHash *cod
 	// When an error was returned by the EVM or when setting the creation code
 	// above we revert to the snapshot and consume any gas remaining. Additionally
 	// when we're in homestead this also counts for code storage gas errors.
-	if err != nil && (evm.chainRules.IsHomestead || err != ErrCodeStoreOutOfGas) {
+	if err != nil && (evm.chainRules.IsHomestead || !errors.Is(err, ErrCodeStoreOutOfGas)) {
 		evm.StateDB.RevertToSnapshot(snapshot)
-		if err != ErrExecutionReverted {
+		if !errors.Is(err, ErrExecutionReverted) && !errors.Is(err, errContextCanceled) {
 			contract.UseGas(contract.Gas)
 		}
 	}
@@ -317,7 +317,7 @@ func gasCreateEip3860(evm *EVM, contract *Contract, stack *Stack, mem *Memory, m
 	}
 	size, overflow := stack.Back(2).Uint64WithOverflow()
 	if overflow || size > params.MaxInitCodeSize {
-		return 0, ErrGasUintOverflow
+		return 0, ErrMaxInitCodeSizeExceeded
 	}
 	// Since size <= params.MaxInitCodeSize, these multiplication cannot overflow
 	moreGas := params.InitCodeWordGas * ((size + 31) / 32)
@@ -334,7 +334,7 @@ func gasCreate2Eip3860(evm *EVM, contract *Contract, stack *Stack, mem *Memory,
 	}
 	size, overflow := stack.Back(2).Uint64WithOverflow()
 	if overflow || size > params.MaxInitCodeSize {
-		return 0, ErrGasUintOverflow
+		return 0, ErrMaxInitCodeSizeExceeded
 	}
 	// Since size <= params.MaxInitCodeSize, these multiplication cannot overflow
 	moreGas := (params.InitCodeWordGas + params.Keccak256WordGas) * ((size + 31) / 32)
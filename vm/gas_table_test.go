@@ -30,6 +30,7 @@ import (
 	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/holiman/uint256"
 )
 
 func TestMemoryGasCost(t *testing.T) {
@@ -179,3 +180,71 @@ func TestCreateGas(t *testing.T) {
 		}
 	}
 }
+
+func TestMaxInitCodeSize(t *testing.T) {
+	// gasFor returns the dynamic gas of a create with the given initcode size
+	gasFor := func(gasFn gasFunc, salted bool, size uint64) (uint64, error) {
+		stack := newstack()
+		if salted {
+			stack.push(new(uint256.Int)) // salt
+		}
+		stack.push(uint256.NewInt(size))
+		stack.push(new(uint256.Int)) // offset
+		stack.push(new(uint256.Int)) // value
+		return gasFn(nil, nil, stack, NewMemory(), 0)
+	}
+	for _, tt := range []struct {
+		gasFn    gasFunc
+		salted   bool
+		wordCost uint64
+	}{
+		{gasCreateEip3860, false, params.InitCodeWordGas},
+		{gasCreate2Eip3860, true, params.InitCodeWordGas + params.Keccak256WordGas},
+	} {
+		for _, size := range []uint64{1, 32, 33, params.MaxInitCodeSize} {
+			gas, err := gasFor(tt.gasFn, tt.salted, size)
+			if err != nil {
+				t.Fatalf("size %d: unexpected error: %v", size, err)
+			}
+			if want := tt.wordCost * ((size + 31) / 32); gas != want {
+				t.Errorf("size %d: have gas %d, want %d", size, gas, want)
+			}
+		}
+		if _, err := gasFor(tt.gasFn, tt.salted, params.MaxInitCodeSize+1); err != ErrMaxInitCodeSizeExceeded {
+			t.Errorf("expected %v, got %v", ErrMaxInitCodeSizeExceeded, err)
+		}
+	}
+
+	shanghaiConfig := *params.AllEthashProtocolChanges
+	shanghaiConfig.ShanghaiTime = new(uint64)
+	vmctx := BlockContext{
+		CanTransfer: func(StateDB, common.Address, *big.Int) bool { return true },
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big.NewInt(0),
+		Random:      &common.Hash{},
+	}
+	address := common.BytesToAddress([]byte("contract"))
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.CreateAccount(address)
+	// create(0, 0, 0xc001)
+	statedb.SetCode(address, hexutil.MustDecode("0x61C00160006000f0"))
+	statedb.Finalise(true)
+
+	vmenv := NewEVM(vmctx, TxContext{}, statedb, &shanghaiConfig, Config{})
+	vmenv.CloseAspectCall()
+	if _, _, err := vmenv.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100_000, new(big.Int)); err != ErrMaxInitCodeSizeExceeded {
+		t.Fatalf("CREATE: expected %v, got %v", ErrMaxInitCodeSizeExceeded, err)
+	}
+
+	// the initcode of a creation transaction is limited as well, without consuming gas
+	_, _, gas, err := vmenv.Create(context.Background(), AccountRef(common.Address{}), make([]byte, params.MaxInitCodeSize+1), 100_000, new(big.Int))
+	if err != ErrMaxInitCodeSizeExceeded {
+		t.Fatalf("creation: expected %v, got %v", ErrMaxInitCodeSizeExceeded, err)
+	}
+	if gas != 100_000 {
+		t.Fatalf("creation: expected no gas consumed, have %d left", gas)
+	}
+	if _, _, _, err := vmenv.Create(context.Background(), AccountRef(common.Address{}), make([]byte, params.MaxInitCodeSize), 100_000, new(big.Int)); err != nil {
+		t.Fatalf("creation at the limit: unexpected error: %v", err)
+	}
+}
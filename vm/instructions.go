@@ -17,6 +17,7 @@
 package vm
 
 import (
+	"bytes"
 	"context"
 	"errors"
 
@@ -251,6 +252,9 @@ func opKeccak256(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, s
 	evm := interpreter.evm
 	if evm.Config.EnablePreimageRecording {
 		evm.StateDB.AddPreimage(interpreter.hasherBuf, data)
+		if interpreter.tracer != nil {
+			interpreter.tracer.SavePreimage(interpreter.tracer.CurrentCallIndex(), interpreter.hasherBuf, data)
+		}
 	}
 
 	size.SetBytes(interpreter.hasherBuf[:])
@@ -258,7 +262,7 @@ func opKeccak256(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, s
 }
 
 func opAddress(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	scope.Stack.push(new(uint256.Int).SetBytes(scope.Contract.Address().Bytes()))
+	scope.Stack.push(interpreter.intPool.get().SetBytes(scope.Contract.Address().Bytes()))
 	return nil, nil
 }
 
@@ -270,17 +274,21 @@ func opBalance(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, sco
 }
 
 func opOrigin(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	scope.Stack.push(new(uint256.Int).SetBytes(interpreter.evm.Origin.Bytes()))
+	if interpreter.evm.Config.TraceOriginUse {
+		interpreter.tracer.SaveOriginUse()
+	}
+	scope.Stack.push(interpreter.intPool.get().SetBytes(interpreter.evm.Origin.Bytes()))
 	return nil, nil
 }
 
 func opCaller(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	scope.Stack.push(new(uint256.Int).SetBytes(scope.Contract.Caller().Bytes()))
+	scope.Stack.push(interpreter.intPool.get().SetBytes(scope.Contract.Caller().Bytes()))
 	return nil, nil
 }
 
 func opCallValue(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	v, _ := uint256.FromBig(scope.Contract.value)
+	v := interpreter.intPool.get()
+	v.SetFromBig(scope.Contract.value)
 	scope.Stack.push(v)
 	return nil, nil
 }
@@ -297,7 +305,7 @@ func opCallDataLoad(ctx context.Context, pc *uint64, interpreter *EVMInterpreter
 }
 
 func opCallDataSize(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	scope.Stack.push(new(uint256.Int).SetUint64(uint64(len(scope.Contract.Input))))
+	scope.Stack.push(interpreter.intPool.get().SetUint64(uint64(len(scope.Contract.Input))))
 	return nil, nil
 }
 
@@ -320,7 +328,7 @@ func opCallDataCopy(ctx context.Context, pc *uint64, interpreter *EVMInterpreter
 }
 
 func opReturnDataSize(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	scope.Stack.push(new(uint256.Int).SetUint64(uint64(len(interpreter.returnData))))
+	scope.Stack.push(interpreter.intPool.get().SetUint64(uint64(len(interpreter.returnData))))
 	return nil, nil
 }
 
@@ -432,7 +440,8 @@ func opExtCodeHash(ctx context.Context, pc *uint64, interpreter *EVMInterpreter,
 }
 
 func opGasprice(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	v, _ := uint256.FromBig(interpreter.evm.GasPrice)
+	v := interpreter.intPool.get()
+	v.SetFromBig(interpreter.evm.GasPrice)
 	scope.Stack.push(v)
 	return nil, nil
 }
@@ -460,35 +469,37 @@ func opBlockhash(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, s
 }
 
 func opCoinbase(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	scope.Stack.push(new(uint256.Int).SetBytes(interpreter.evm.Context.Coinbase.Bytes()))
+	scope.Stack.push(interpreter.intPool.get().SetBytes(interpreter.evm.Context.Coinbase.Bytes()))
 	return nil, nil
 }
 
 func opTimestamp(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	scope.Stack.push(new(uint256.Int).SetUint64(interpreter.evm.Context.Time))
+	scope.Stack.push(interpreter.intPool.get().SetUint64(interpreter.evm.Context.Time))
 	return nil, nil
 }
 
 func opNumber(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	v, _ := uint256.FromBig(interpreter.evm.Context.BlockNumber)
+	v := interpreter.intPool.get()
+	v.SetFromBig(interpreter.evm.Context.BlockNumber)
 	scope.Stack.push(v)
 	return nil, nil
 }
 
 func opDifficulty(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	v, _ := uint256.FromBig(interpreter.evm.Context.Difficulty)
+	v := interpreter.intPool.get()
+	v.SetFromBig(interpreter.evm.Context.Difficulty)
 	scope.Stack.push(v)
 	return nil, nil
 }
 
 func opRandom(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	v := new(uint256.Int).SetBytes(interpreter.evm.Context.Random.Bytes())
+	v := interpreter.intPool.get().SetBytes(interpreter.evm.Context.Random.Bytes())
 	scope.Stack.push(v)
 	return nil, nil
 }
 
 func opGasLimit(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	scope.Stack.push(new(uint256.Int).SetUint64(interpreter.evm.Context.GasLimit))
+	scope.Stack.push(interpreter.intPool.get().SetUint64(interpreter.evm.Context.GasLimit))
 	return nil, nil
 }
 
@@ -520,6 +531,9 @@ func opMstore8(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, sco
 func opSload(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
 	loc := scope.Stack.peek()
 	hash := common.Hash(loc.Bytes32())
+	if interpreter.evm.Config.TrackStorageReads {
+		interpreter.tracer.SaveStorageRead(scope.Contract.Address(), loc)
+	}
 	val := interpreter.evm.StateDB.GetState(scope.Contract.Address(), hash)
 	loc.SetBytes(val.Bytes())
 	return nil, nil
@@ -531,6 +545,9 @@ func opSstore(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scop
 	}
 	loc := scope.Stack.pop()
 	val := scope.Stack.pop()
+	if interpreter.evm.Config.TrackStorageReads {
+		interpreter.tracer.SaveStorageWrite(scope.Contract.Address(), &loc)
+	}
 	interpreter.evm.StateDB.SetState(scope.Contract.Address(), loc.Bytes32(), val.Bytes32())
 	return nil, nil
 }
@@ -566,17 +583,17 @@ func opJumpdest(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, sc
 }
 
 func opPc(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	scope.Stack.push(new(uint256.Int).SetUint64(*pc))
+	scope.Stack.push(interpreter.intPool.get().SetUint64(*pc))
 	return nil, nil
 }
 
 func opMsize(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	scope.Stack.push(new(uint256.Int).SetUint64(uint64(scope.Memory.Len())))
+	scope.Stack.push(interpreter.intPool.get().SetUint64(uint64(scope.Memory.Len())))
 	return nil, nil
 }
 
 func opGas(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	scope.Stack.push(new(uint256.Int).SetUint64(scope.Contract.Gas))
+	scope.Stack.push(interpreter.intPool.get().SetUint64(scope.Contract.Gas))
 	return nil, nil
 }
 
@@ -604,21 +621,28 @@ func opCreate(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scop
 	}
 
 	res, addr, returnGas, suberr := interpreter.evm.Create(ctx, scope.Contract, input, gas, bigVal)
+	if suberr == nil {
+		saveDeployment(interpreter, addr, nil)
+	}
 	// Push item on the stack based on the returned error. If the ruleset is
 	// homestead we must check for CodeStoreOutOfGasError (homestead only
 	// rule) and treat as an error, if the ruleset is frontier we must
 	// ignore this error and pretend the operation was successful.
-	if interpreter.evm.chainRules.IsHomestead && suberr == ErrCodeStoreOutOfGas {
+	if interpreter.evm.chainRules.IsHomestead && errors.Is(suberr, ErrCodeStoreOutOfGas) {
 		stackvalue.Clear()
-	} else if suberr != nil && suberr != ErrCodeStoreOutOfGas {
+	} else if suberr != nil && !errors.Is(suberr, ErrCodeStoreOutOfGas) {
 		stackvalue.Clear()
 	} else {
 		stackvalue.SetBytes(addr.Bytes())
 	}
 	scope.Stack.push(&stackvalue)
 	scope.Contract.Gas += returnGas
+	// the cancellation of the context aborts the calling frames as well
+	if errors.Is(suberr, errContextCanceled) {
+		return nil, suberr
+	}
 
-	if suberr == ErrExecutionReverted {
+	if errors.Is(suberr, ErrExecutionReverted) {
 		interpreter.returnData = res // set REVERT data to return data buffer
 		return res, nil
 	}
@@ -649,6 +673,9 @@ func opCreate2(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, sco
 	}
 	res, addr, returnGas, suberr := interpreter.evm.Create2(ctx, scope.Contract, input, gas,
 		bigEndowment, &salt)
+	if suberr == nil {
+		saveDeployment(interpreter, addr, &salt)
+	}
 	// Push item on the stack based on the returned error.
 	if suberr != nil {
 		stackvalue.Clear()
@@ -657,8 +684,12 @@ func opCreate2(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, sco
 	}
 	scope.Stack.push(&stackvalue)
 	scope.Contract.Gas += returnGas
+	// the cancellation of the context aborts the calling frames as well
+	if errors.Is(suberr, errContextCanceled) {
+		return nil, suberr
+	}
 
-	if suberr == ErrExecutionReverted {
+	if errors.Is(suberr, ErrExecutionReverted) {
 		interpreter.returnData = res // set REVERT data to return data buffer
 		return res, nil
 	}
@@ -666,6 +697,16 @@ func opCreate2(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, sco
 	return nil, nil
 }
 
+// saveDeployment saves a contract deployed by the latest creation call to the tracer
+func saveDeployment(interpreter *EVMInterpreter, addr common.Address, salt *uint256.Int) {
+	if interpreter.tracer == nil {
+		return
+	}
+	if callIdx, ok := interpreter.tracer.lastChildCallIndex(); ok {
+		interpreter.tracer.SaveDeployment(callIdx, addr, interpreter.evm.StateDB.GetCodeHash(addr), salt)
+	}
+}
+
 func opCall(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
 	stack := scope.Stack
 	// Pop gas. The actual gas in interpreter.evm.callGasTemp.
@@ -698,10 +739,14 @@ func opCall(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope
 		temp.SetOne()
 	}
 	stack.push(&temp)
-	if err == nil || err == ErrExecutionReverted {
+	if err == nil || errors.Is(err, ErrExecutionReverted) {
 		scope.Memory.Set(retOffset.Uint64(), retSize.Uint64(), ret)
 	}
 	scope.Contract.Gas += returnGas
+	// the cancellation of the context aborts the calling frames as well
+	if errors.Is(err, errContextCanceled) {
+		return nil, err
+	}
 
 	interpreter.returnData = ret
 	return ret, nil
@@ -733,10 +778,14 @@ func opCallCode(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, sc
 		temp.SetOne()
 	}
 	stack.push(&temp)
-	if err == nil || err == ErrExecutionReverted {
+	if err == nil || errors.Is(err, ErrExecutionReverted) {
 		scope.Memory.Set(retOffset.Uint64(), retSize.Uint64(), ret)
 	}
 	scope.Contract.Gas += returnGas
+	// the cancellation of the context aborts the calling frames as well
+	if errors.Is(err, errContextCanceled) {
+		return nil, err
+	}
 
 	interpreter.returnData = ret
 	return ret, nil
@@ -761,10 +810,14 @@ func opDelegateCall(ctx context.Context, pc *uint64, interpreter *EVMInterpreter
 		temp.SetOne()
 	}
 	stack.push(&temp)
-	if err == nil || err == ErrExecutionReverted {
+	if err == nil || errors.Is(err, ErrExecutionReverted) {
 		scope.Memory.Set(retOffset.Uint64(), retSize.Uint64(), ret)
 	}
 	scope.Contract.Gas += returnGas
+	// the cancellation of the context aborts the calling frames as well
+	if errors.Is(err, errContextCanceled) {
+		return nil, err
+	}
 
 	interpreter.returnData = ret
 	return ret, nil
@@ -789,25 +842,139 @@ func opStaticCall(ctx context.Context, pc *uint64, interpreter *EVMInterpreter,
 		temp.SetOne()
 	}
 	stack.push(&temp)
-	if err == nil || err == ErrExecutionReverted {
+	if err == nil || errors.Is(err, ErrExecutionReverted) {
 		scope.Memory.Set(retOffset.Uint64(), retSize.Uint64(), ret)
 	}
 	scope.Contract.Gas += returnGas
+	// the cancellation of the context aborts the calling frames as well
+	if errors.Is(err, errContextCanceled) {
+		return nil, err
+	}
 
 	interpreter.returnData = ret
 	return ret, nil
 }
 
-func opReturn(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
+// opAuth implements the AUTH opcode (EIP-3074). It recovers the signer of
+// keccak256(MAGIC || chainId || paddedInvokerAddress || commit) and sets it as the authorized
+// account of the current call frame. The signer is pushed onto the stack, or zero
+// if the signature is invalid, in which case the authorized account is unset.
+func opAuth(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
+	stack := scope.Stack
+	commit, yParity, r := stack.pop(), stack.pop(), stack.pop()
+	s := stack.peek()
+
+	scope.authorized = nil
+	if !yParity.IsUint64() || yParity.Uint64() > 1 ||
+		!crypto.ValidateSignatureValues(byte(yParity.Uint64()), r.ToBig(), s.ToBig(), true) {
+		s.Clear()
+		return nil, nil
+	}
+
+	// the chain id binds the signature to the chain, so that it cannot be replayed on others
+	msg := make([]byte, 97)
+	msg[0] = authMagic
+	if chainID := interpreter.evm.chainConfig.ChainID; chainID != nil {
+		chainID.FillBytes(msg[1:33])
+	}
+	invoker := scope.Contract.Address()
+	copy(msg[45:65], invoker[:])
+	commitBytes := commit.Bytes32()
+	copy(msg[65:], commitBytes[:])
+
+	sig := make([]byte, crypto.SignatureLength)
+	rBytes, sBytes := r.Bytes32(), s.Bytes32()
+	copy(sig[:32], rBytes[:])
+	copy(sig[32:64], sBytes[:])
+	sig[64] = byte(yParity.Uint64())
+
+	pub, err := crypto.SigToPub(crypto.Keccak256(msg), sig)
+	if err != nil {
+		s.Clear()
+		return nil, nil
+	}
+
+	authorized := crypto.PubkeyToAddress(*pub)
+	scope.authorized = &authorized
+	s.SetBytes(authorized.Bytes())
+	return nil, nil
+}
+
+// opAuthcall implements the AUTHCALL opcode (EIP-3074), which behaves like CALL
+// except that the caller of the sub-call is the account set by a preceding AUTH.
+func opAuthcall(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
+	if scope.authorized == nil {
+		return nil, ErrAuthorizedNotSet
+	}
+	stack := scope.Stack
+	// Pop gas. The actual gas in interpreter.evm.callGasTemp.
+	// We can use this as a temporary value
+	temp := stack.pop()
+	gas := interpreter.evm.callGasTemp
+	// Pop other call parameters.
+	addr, value, inOffset, inSize, retOffset, retSize := stack.pop(), stack.pop(), stack.pop(), stack.pop(), stack.pop(), stack.pop()
+	toAddr := common.Address(addr.Bytes20())
+	// Get the arguments from the memory.
+	args := scope.Memory.GetPtr(int64(inOffset.Uint64()), int64(inSize.Uint64()))
+
+	if interpreter.readOnly && !value.IsZero() {
+		return nil, ErrWriteProtection
+	}
+	bigVal := big0
+	if !value.IsZero() {
+		gas += params.CallStipend
+		bigVal = value.ToBig()
+	}
+
+	ret, returnGas, err := interpreter.evm.Call(ctx, AccountRef(*scope.authorized), toAddr, args, gas, bigVal)
+
+	if err != nil {
+		temp.Clear()
+	} else {
+		temp.SetOne()
+	}
+	stack.push(&temp)
+	if err == nil || errors.Is(err, ErrExecutionReverted) {
+		scope.Memory.Set(retOffset.Uint64(), retSize.Uint64(), ret)
+	}
+	scope.Contract.Gas += returnGas
+	// the cancellation of the context aborts the calling frames as well
+	if errors.Is(err, errContextCanceled) {
+		return nil, err
+	}
+
+	interpreter.returnData = ret
+	return ret, nil
+}
+
+// returnedMemory pops the offset and size of RETURN and REVERT and returns the memory range.
+// The range is normally covered by the memory expansion, which fails on oversized values
+// before the opcode runs, the values are checked again so that they never wrap around.
+func returnedMemory(scope *ScopeContext) ([]byte, error) {
 	offset, size := scope.Stack.pop(), scope.Stack.pop()
-	ret := scope.Memory.GetPtr(int64(offset.Uint64()), int64(size.Uint64()))
+	if size.IsZero() {
+		return nil, nil
+	}
+	if _, overflow := calcMemSize64(&offset, &size); overflow {
+		return nil, ErrGasUintOverflow
+	}
+	return scope.Memory.GetRange(int64(offset.Uint64()), int64(size.Uint64()))
+}
+
+func opReturn(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
+	ret, err := returnedMemory(scope)
+	if err != nil {
+		return nil, err
+	}
 
 	return ret, errStopToken
 }
 
 func opRevert(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
-	offset, size := scope.Stack.pop(), scope.Stack.pop()
-	ret := scope.Memory.GetPtr(int64(offset.Uint64()), int64(size.Uint64()))
+	ret, err := returnedMemory(scope)
+	if err != nil {
+		return nil, err
+	}
 
 	interpreter.returnData = ret
 	return ret, ErrExecutionReverted
@@ -829,6 +996,9 @@ func opSelfdestruct(ctx context.Context, pc *uint64, interpreter *EVMInterpreter
 	balance := interpreter.evm.StateDB.GetBalance(scope.Contract.Address())
 	interpreter.evm.StateDB.AddBalance(beneficiary.Bytes20(), balance)
 	interpreter.evm.StateDB.Suicide(scope.Contract.Address())
+	if interpreter.tracer != nil {
+		interpreter.tracer.SaveSelfDestruct(interpreter.evm.StateDB, scope.Contract.Address(), beneficiary.Bytes20(), balance)
+	}
 	if tracer := interpreter.evm.Config.Tracer; tracer != nil {
 		tracer.CaptureEnter(SELFDESTRUCT, scope.Contract.Address(), beneficiary.Bytes20(), []byte{}, 0, balance)
 		tracer.CaptureExit([]byte{}, 0, nil)
@@ -853,14 +1023,18 @@ func makeLog(size int) executionFunc {
 		}
 
 		d := scope.Memory.GetCopy(int64(mStart.Uint64()), int64(mSize.Uint64()))
-		interpreter.evm.StateDB.AddLog(&types.Log{
+		log := &types.Log{
 			Address: scope.Contract.Address(),
 			Topics:  topics,
 			Data:    d,
 			// This is a non-consensus field, but assigned here because
 			// core/state doesn't know the current block number.
 			BlockNumber: interpreter.evm.Context.BlockNumber.Uint64(),
-		})
+		}
+		interpreter.evm.StateDB.AddLog(log)
+		if interpreter.tracer != nil {
+			interpreter.tracer.saveLog(interpreter.tracer.CurrentCallIndex(), *pc, LOG0+OpCode(size), log)
+		}
 
 		return nil, nil
 	}
@@ -870,7 +1044,7 @@ func makeLog(size int) executionFunc {
 func opPush1(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
 	var (
 		codeLen = uint64(len(scope.Contract.Code))
-		integer = new(uint256.Int)
+		integer = interpreter.intPool.get()
 	)
 	*pc += 1
 	if *pc < codeLen {
@@ -896,7 +1070,7 @@ func makePush(size uint64, pushByteSize int) executionFunc {
 			endMin = startMin + pushByteSize
 		}
 
-		integer := new(uint256.Int)
+		integer := interpreter.intPool.get()
 		scope.Stack.push(integer.SetBytes(common.RightPadBytes(
 			scope.Contract.Code[startMin:endMin], pushByteSize)))
 
@@ -941,11 +1115,11 @@ func opReferenceChangeJournal(ctx context.Context, pc *uint64, interpreter *EVMI
 		}
 
 		if outOfPlaceEncoding.Eq(uint256.NewInt(isLess)) {
-			return 0, errors.New("storage encoding error")
+			return 0, ErrStorageEncoding
 		}
 
 		if !length.IsUint64() {
-			return 0, errors.New("storage too large to load")
+			return 0, ErrStorageTooLarge
 		}
 
 		return length.Uint64(), nil
@@ -986,20 +1160,39 @@ func opReferenceChangeJournal(ctx context.Context, pc *uint64, interpreter *EVMI
 		return nil, err
 	}
 
+	// unchanged tracks whether all the slots read keep their committed values,
+	// it is only needed to drop insignificant writes
+	significantOnly := interpreter.tracer.SignificantWritesOnly
+	unchanged := significantOnly && bytes.Equal(statedb.GetCommittedState(contract, storageSlot.Bytes32()).Bytes(), rawState)
+
 	var stateBytes []byte
 	if length < 32 {
 		stateBytes = unmask(rawState[:], length)
 		stateBytes = stateBytes[:length]
 	} else {
-		referenceSlot := new(uint256.Int).SetBytes(keccak(interpreter, storageSlot.Bytes()))
+		// the derived reference slot only depends on the slot, hot ones are served from the cache
+		slotKey := common.Hash(storageSlot.Bytes32())
+		referenceHash, ok := interpreter.referenceSlots.Get(slotKey)
+		if !ok {
+			referenceHash = common.BytesToHash(keccak(interpreter, storageSlot.Bytes()))
+			interpreter.referenceSlots.Add(slotKey, referenceHash)
+		}
+		interpreter.tracer.SaveSlotPreimage(contract, referenceHash, storageSlot.Bytes())
+		referenceSlot := new(uint256.Int).SetBytes(referenceHash[:])
 		for i := uint64(0); i < u64Ceiling(length, 32); i++ {
 			offset := referenceSlot.Add(referenceSlot, one).Bytes32()
 			currentRawState := interpreter.evm.StateDB.GetState(contract, offset)
 			stateBytes = append(stateBytes, currentRawState[:]...)
+			if unchanged {
+				unchanged = statedb.GetCommittedState(contract, offset) == currentRawState
+			}
 		}
 	}
 
-	err = interpreter.tracer.SaveStateChange(contract, &storageSlot, nil, typeId.Bytes32(), stateBytes)
+	if significantOnly && interpreter.tracer.dropsWrite(contract, &storageSlot, nil, typeId.Bytes32(), unchanged) {
+		return nil, nil
+	}
+	err = saveStateChange(interpreter, contract, &storageSlot, nil, typeId.Bytes32(), stateBytes)
 	return nil, err
 }
 
@@ -1012,21 +1205,36 @@ func opValueChangeJournal(ctx context.Context, pc *uint64, interpreter *EVMInter
 
 	offsetU64, overflow := offset.Uint64WithOverflow()
 	if overflow || offsetU64 > 31 {
-		return nil, errors.New("offset out of range")
+		return nil, ErrOffsetOutOfRange
 	}
 
 	typeSizeU64, overflow := typeSize.Uint64WithOverflow()
 	if overflow || typeSizeU64 > 32 {
-		return nil, errors.New("type size out of range")
+		return nil, ErrTypeSizeOutOfRange
 	}
 
 	contract := scope.Contract.Address()
 	newVal := interpreter.evm.StateDB.GetState(contract, storageSlot.Bytes32())
 	start, end := 32-offsetU64-typeSizeU64, 32-offsetU64
-	err := interpreter.tracer.SaveStateChange(contract, &storageSlot, &offset, typeId.Bytes32(), newVal[start:end])
+	if interpreter.tracer.SignificantWritesOnly {
+		committed := interpreter.evm.StateDB.GetCommittedState(contract, storageSlot.Bytes32())
+		if interpreter.tracer.dropsWrite(contract, &storageSlot, &offset, typeId.Bytes32(), bytes.Equal(committed[start:end], newVal[start:end])) {
+			return nil, nil
+		}
+	}
+	err := saveStateChange(interpreter, contract, &storageSlot, &offset, typeId.Bytes32(), newVal[start:end])
 	return nil, err
 }
 
+// saveStateChange passes a journaled state change to the configured sink, or saves it to the tracer
+func saveStateChange(interpreter *EVMInterpreter, account common.Address, slot, offset *uint256.Int, typeId common.Hash, newVal []byte) error {
+	if sink := interpreter.evm.Config.StateChangeSink; sink != nil {
+		sink.OnStateChange(account, slot, offset, typeId, interpreter.tracer.CurrentCallIndex(), newVal)
+		return nil
+	}
+	return interpreter.tracer.SaveStateChange(account, slot, offset, typeId, newVal)
+}
+
 // opReferenceIndexValueStorageJournal journals the relation between a value-typed storage slot and its reference-typed index key
 func opReferenceIndexValueStorageJournal(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, scope *ScopeContext) ([]byte, error) {
 	base := scope.Stack.pop()
@@ -1040,6 +1248,7 @@ func opReferenceIndexValueStorageJournal(ctx context.Context, pc *uint64, interp
 	if err != nil {
 		return nil, err
 	}
+	verifyMappingSlot(interpreter, scope, &base, &storageSlot, storageIndex)
 
 	err = interpreter.tracer.SaveStateKey(scope.Contract.Address(), &base, &storageSlot, &offset, typeId.Bytes32(), parentTypeId.Bytes32(), storageIndex)
 	return nil, err
@@ -1071,6 +1280,7 @@ func opReferenceIndexReferenceStorageJournal(ctx context.Context, pc *uint64, in
 	if err != nil {
 		return nil, err
 	}
+	verifyMappingSlot(interpreter, scope, &base, &storageSlot, storageIndex)
 
 	err = interpreter.tracer.SaveStateKey(scope.Contract.Address(), &base, &storageSlot, nil, typeId.Bytes32(), parentTypeId.Bytes32(), storageIndex)
 	return nil, err
@@ -1120,12 +1330,54 @@ func opValueStateVarJournal(ctx context.Context, pc *uint64, interpreter *EVMInt
 	return nil, err
 }
 
+// verifyMappingSlot checks whether a journaled slot equals keccak256(key . base),
+// a mismatch is recorded as an anomaly in the tracer. It is only enabled with Config.VerifyStorageKeys.
+func verifyMappingSlot(interpreter *EVMInterpreter, scope *ScopeContext, base, slot *uint256.Int, key []byte) {
+	if !interpreter.evm.Config.VerifyStorageKeys || interpreter.tracer == nil {
+		return
+	}
+
+	if interpreter.hasher == nil {
+		interpreter.hasher = crypto.NewKeccakState()
+	} else {
+		interpreter.hasher.Reset()
+	}
+	baseBytes := base.Bytes32()
+	// nolint
+	interpreter.hasher.Write(key)
+	// nolint
+	interpreter.hasher.Write(baseBytes[:])
+	// nolint
+	interpreter.hasher.Read(interpreter.hasherBuf[:])
+
+	expected := new(uint256.Int).SetBytes(interpreter.hasherBuf[:])
+	if !expected.Eq(slot) {
+		interpreter.tracer.SaveSlotAnomaly(scope.Contract.Address(), base.Clone(), expected, slot.Clone(), common.CopyBytes(key))
+	}
+}
+
+// loadDataFromMem loads the data prefixed by its 32 bytes length at memPtr, it fails with
+// ErrMemoryOutOfBounds if the length or the data exceed the memory
 func loadDataFromMem(memPtr *uint256.Int, mem *Memory) ([]byte, uint64, error) {
-	offset := int64(memPtr.Uint64())
-	dataLen := new(uint256.Int).SetBytes(mem.GetCopy(offset, 32))
 	if !memPtr.IsUint64() {
-		return nil, 0, errors.New("mem data too long")
+		return nil, 0, ErrMemoryDataTooLong
+	}
+	offset := int64(memPtr.Uint64())
+	lenWord, err := mem.GetRange(offset, 32)
+	if err != nil {
+		return nil, 0, err
+	}
+	dataLen := new(uint256.Int).SetBytes(lenWord)
+	if !dataLen.IsUint64() {
+		return nil, 0, ErrMemoryDataTooLong
+	}
+	if dataLen.IsZero() {
+		return nil, 0, nil
 	}
 
-	return mem.GetCopy(offset+32, int64(dataLen.Uint64())), dataLen.Uint64(), nil
+	data, err := mem.GetRange(offset+32, int64(dataLen.Uint64()))
+	if err != nil {
+		return nil, 0, err
+	}
+	return common.CopyBytes(data), dataLen.Uint64(), nil
 }
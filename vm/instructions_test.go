@@ -19,10 +19,13 @@ package vm
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
 	"os"
+	"reflect"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -119,7 +122,7 @@ func testTwoOperandOp(t *testing.T, tests []TwoOperandTestcase, opFn executionFu
 		stack.push(x)
 		stack.push(y)
 		// nolint
-		opFn(context.Background(), &pc, evmInterpreter, &ScopeContext{nil, stack, nil})
+		opFn(context.Background(), &pc, evmInterpreter, &ScopeContext{nil, stack, nil, nil})
 		if len(stack.data) != 1 {
 			t.Errorf("Expected one item on stack after %v, got %d: ", name, len(stack.data))
 		}
@@ -235,7 +238,7 @@ func TestAddMod(t *testing.T) {
 		stack.push(z)
 		stack.push(y)
 		stack.push(x)
-		_, err := opAddmod(context.Background(), &pc, evmInterpreter, &ScopeContext{nil, stack, nil})
+		_, err := opAddmod(context.Background(), &pc, evmInterpreter, &ScopeContext{nil, stack, nil, nil})
 		if err != nil {
 			return
 		}
@@ -265,7 +268,7 @@ func TestWriteExpectedValues(t *testing.T) {
 			y := new(uint256.Int).SetBytes(common.Hex2Bytes(param.y))
 			stack.push(x)
 			stack.push(y)
-			_, err := opFn(context.Background(), &pc, interpreter, &ScopeContext{nil, stack, nil})
+			_, err := opFn(context.Background(), &pc, interpreter, &ScopeContext{nil, stack, nil, nil})
 			if err != nil {
 				return nil
 			}
@@ -307,7 +310,7 @@ func opBenchmark(bench *testing.B, op executionFunc, args ...string) {
 	var (
 		env            = NewEVM(BlockContext{}, TxContext{}, nil, params.TestChainConfig, Config{})
 		stack          = newstack()
-		scope          = &ScopeContext{nil, stack, nil}
+		scope          = &ScopeContext{nil, stack, nil, nil}
 		evmInterpreter = NewEVMInterpreter(env)
 	)
 
@@ -565,14 +568,14 @@ func TestOpMstore(t *testing.T) {
 	stack.push(new(uint256.Int).SetBytes(common.Hex2Bytes(v)))
 	stack.push(new(uint256.Int))
 	// nolint
-	opMstore(context.Background(), &pc, evmInterpreter, &ScopeContext{mem, stack, nil})
+	opMstore(context.Background(), &pc, evmInterpreter, &ScopeContext{mem, stack, nil, nil})
 	if got := common.Bytes2Hex(mem.GetCopy(0, 32)); got != v {
 		t.Fatalf("Mstore fail, got %v, expected %v", got, v)
 	}
 	stack.push(new(uint256.Int).SetUint64(0x1))
 	stack.push(new(uint256.Int))
 	// nolint
-	opMstore(context.Background(), &pc, evmInterpreter, &ScopeContext{mem, stack, nil})
+	opMstore(context.Background(), &pc, evmInterpreter, &ScopeContext{mem, stack, nil, nil})
 	if common.Bytes2Hex(mem.GetCopy(0, 32)) != "0000000000000000000000000000000000000000000000000000000000000001" {
 		t.Fatalf("Mstore failed to overwrite previous value")
 	}
@@ -597,7 +600,7 @@ func BenchmarkOpMstore(bench *testing.B) {
 		stack.push(value)
 		stack.push(memStart)
 		// nolint
-		opMstore(context.Background(), &pc, evmInterpreter, &ScopeContext{mem, stack, nil})
+		opMstore(context.Background(), &pc, evmInterpreter, &ScopeContext{mem, stack, nil, nil})
 	}
 }
 
@@ -612,7 +615,7 @@ func TestOpTstore(t *testing.T) {
 		to             = common.Address{1}
 		contractRef    = contractRef{caller}
 		contract       = NewContract(contractRef, AccountRef(to), new(big.Int), 0)
-		scopeContext   = ScopeContext{mem, stack, contract}
+		scopeContext   = ScopeContext{mem, stack, contract, nil}
 		value          = common.Hex2Bytes("abcdef00000000000000abba000000000deaf000000c0de00100000000133700")
 	)
 
@@ -646,6 +649,98 @@ func TestOpTstore(t *testing.T) {
 	}
 }
 
+func TestTransientStorageVisibility(t *testing.T) {
+	var (
+		sender = common.Address{1}
+		self   = common.BytesToAddress([]byte("self"))
+		reader = common.BytesToAddress([]byte("reader"))
+	)
+	// called by itself: tstore(0, calldataload(0)) if eq(calldataload(0), 0xbad) { revert(0, 0) } stop
+	// otherwise: mstore(0, calldataload(0)) pop(call(gas(), address(), 0, 0, 32, 0, 0))
+	//            mstore(0, tload(0)) return(0, 32)
+	selfCode := []byte{byte(ADDRESS), byte(CALLER), byte(EQ), byte(PUSH1), 0, byte(JUMPI),
+		byte(PUSH1), 0, byte(CALLDATALOAD), byte(PUSH1), 0, byte(MSTORE),
+		byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 32, byte(PUSH1), 0, byte(PUSH1), 0,
+		byte(ADDRESS), byte(GAS), byte(CALL), byte(POP),
+		byte(PUSH1), 0, byte(TLOAD), byte(PUSH1), 0, byte(MSTORE),
+		byte(PUSH1), 32, byte(PUSH1), 0, byte(RETURN)}
+	selfCode[4] = byte(len(selfCode))
+	selfCode = append(selfCode, byte(JUMPDEST), byte(PUSH1), 0, byte(CALLDATALOAD), byte(DUP1), byte(PUSH1), 0, byte(TSTORE),
+		byte(PUSH2), 0x0b, 0xad, byte(EQ), byte(PUSH1), byte(len(selfCode)+16), byte(JUMPI), byte(STOP),
+		byte(JUMPDEST), byte(PUSH1), 0, byte(PUSH1), 0, byte(REVERT))
+	// mstore(0, tload(0)) return(0, 32)
+	readerCode := []byte{byte(PUSH1), 0, byte(TLOAD), byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), 32, byte(PUSH1), 0, byte(RETURN)}
+
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.SetCode(self, selfCode)
+	statedb.SetCode(reader, readerCode)
+	statedb.Finalise(true)
+
+	vmctx := BlockContext{
+		CanTransfer: func(StateDB, common.Address, *big.Int) bool { return true },
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{ExtraEips: []int{1153}})
+	evm.CloseAspectCall()
+	rules := params.AllEthashProtocolChanges.Rules(big0, false, 0)
+
+	call := func(to common.Address, input uint64) uint64 {
+		ret, _, err := evm.Call(context.Background(), AccountRef(sender), to, common.BigToHash(new(big.Int).SetUint64(input)).Bytes(), 100000, new(big.Int))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return new(big.Int).SetBytes(ret).Uint64()
+	}
+
+	statedb.Prepare(rules, sender, common.Address{}, &self, nil, nil)
+	// a value stored by a sub-call is visible to its caller after the sub-call returns
+	if val := call(self, 42); val != 42 {
+		t.Fatalf("expected the value stored by the sub-call, got %d", val)
+	}
+	// the value stored by a reverted sub-call is reverted as well
+	if val := call(self, 0xbad); val != 42 {
+		t.Fatalf("expected the value stored before the reverted sub-call, got %d", val)
+	}
+	// the transient storage is scoped to the address
+	if val := call(reader, 0); val != 0 {
+		t.Fatalf("expected the transient storage of another address to be empty, got %d", val)
+	}
+
+	// the transient storage is cleared at the start of the next transaction
+	statedb.Prepare(rules, sender, common.Address{}, &self, nil, nil)
+	if val := call(self, 0xbad); val != 0 {
+		t.Fatalf("expected the transient storage to be zero initialized, got %d", val)
+	}
+}
+
+func TestOpKeccak256PreimageWithoutTracer(t *testing.T) {
+	var (
+		statedb, _     = state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		env            = NewEVM(BlockContext{}, TxContext{}, statedb, params.TestChainConfig, Config{EnablePreimageRecording: true})
+		stack          = newstack()
+		mem            = NewMemory()
+		evmInterpreter = NewEVMInterpreter(env)
+	)
+	env.interpreter = evmInterpreter
+	// the pre-image is still recorded into the state database without a tracer
+	evmInterpreter.tracer = nil
+	mem.Resize(32)
+	pc := uint64(0)
+	stack.push(uint256.NewInt(32))
+	stack.push(new(uint256.Int))
+	if _, err := opKeccak256(context.Background(), &pc, evmInterpreter, &ScopeContext{mem, stack, nil, nil}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	hash := crypto.Keccak256Hash(make([]byte, 32))
+	if have := stack.pop(); have.Bytes32() != hash {
+		t.Fatalf("unexpected hash %x, want %x", have.Bytes32(), hash)
+	}
+	if preimage := statedb.Preimages()[hash]; !bytes.Equal(preimage, make([]byte, 32)) {
+		t.Fatalf("unexpected pre-image %x", preimage)
+	}
+}
+
 func BenchmarkOpKeccak256(bench *testing.B) {
 	var (
 		env            = NewEVM(BlockContext{}, TxContext{}, nil, params.TestChainConfig, Config{})
@@ -663,7 +758,7 @@ func BenchmarkOpKeccak256(bench *testing.B) {
 		stack.push(uint256.NewInt(32))
 		stack.push(start)
 		// nolint
-		opKeccak256(context.Background(), &pc, evmInterpreter, &ScopeContext{mem, stack, nil})
+		opKeccak256(context.Background(), &pc, evmInterpreter, &ScopeContext{mem, stack, nil, nil})
 	}
 }
 
@@ -759,7 +854,7 @@ func TestRandom(t *testing.T) {
 			evmInterpreter = env.interpreter
 		)
 		// nolint
-		opRandom(context.Background(), &pc, evmInterpreter, &ScopeContext{nil, stack, nil})
+		opRandom(context.Background(), &pc, evmInterpreter, &ScopeContext{nil, stack, nil, nil})
 		if len(stack.data) != 1 {
 			t.Errorf("Expected one item on stack after %v, got %d: ", tt.name, len(stack.data))
 		}
@@ -773,3 +868,786 @@ func TestRandom(t *testing.T) {
 		}
 	}
 }
+
+// signAuth signs the EIP-3074 AUTH message of the given chain, invoker and commit,
+// returns the signature in the order of yParity, r, s
+func signAuth(t *testing.T, chainID *big.Int, invoker common.Address, commit common.Hash) (common.Address, *uint256.Int, *uint256.Int, *uint256.Int) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := append([]byte{authMagic}, common.BigToHash(chainID).Bytes()...)
+	msg = append(msg, common.LeftPadBytes(invoker.Bytes(), 32)...)
+	msg = append(msg, commit.Bytes()...)
+	sig, err := crypto.Sign(crypto.Keccak256(msg), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crypto.PubkeyToAddress(key.PublicKey), uint256.NewInt(uint64(sig[64])),
+		new(uint256.Int).SetBytes(sig[:32]), new(uint256.Int).SetBytes(sig[32:64])
+}
+
+func TestOpAuth(t *testing.T) {
+	var (
+		env            = NewEVM(BlockContext{}, TxContext{}, nil, params.TestChainConfig, Config{})
+		stack          = newstack()
+		evmInterpreter = NewEVMInterpreter(env)
+		invoker        = common.Address{1}
+		contract       = NewContract(contractRef{common.Address{}}, AccountRef(invoker), new(big.Int), 0)
+		scope          = &ScopeContext{nil, stack, contract, nil}
+		commit         = common.HexToHash("0xc0ffee")
+		pc             = uint64(0)
+	)
+	signer, v, r, s := signAuth(t, params.TestChainConfig.ChainID, invoker, commit)
+
+	// valid signature
+	stack.push(s)
+	stack.push(r)
+	stack.push(v)
+	stack.push(new(uint256.Int).SetBytes(commit.Bytes()))
+	if _, err := opAuth(context.Background(), &pc, evmInterpreter, scope); err != nil {
+		t.Fatal(err)
+	}
+	if res := stack.pop(); common.Address(res.Bytes20()) != signer {
+		t.Fatalf("expected signer %x, got %x", signer, res.Bytes20())
+	}
+	if scope.authorized == nil || *scope.authorized != signer {
+		t.Fatalf("authorized not set to signer %x", signer)
+	}
+
+	// signature of a different commit recovers another account
+	stack.push(s)
+	stack.push(r)
+	stack.push(v)
+	stack.push(uint256.NewInt(1))
+	if _, err := opAuth(context.Background(), &pc, evmInterpreter, scope); err != nil {
+		t.Fatal(err)
+	}
+	if res := stack.pop(); common.Address(res.Bytes20()) == signer {
+		t.Fatal("signature over a different commit should not recover the signer")
+	}
+
+	// signature for a different chain recovers another account
+	otherSigner, otherV, otherR, otherS := signAuth(t, big.NewInt(2), invoker, commit)
+	stack.push(otherS)
+	stack.push(otherR)
+	stack.push(otherV)
+	stack.push(new(uint256.Int).SetBytes(commit.Bytes()))
+	if _, err := opAuth(context.Background(), &pc, evmInterpreter, scope); err != nil {
+		t.Fatal(err)
+	}
+	if res := stack.pop(); common.Address(res.Bytes20()) == otherSigner {
+		t.Fatal("signature for a different chain should not recover the signer")
+	}
+	if scope.authorized != nil && *scope.authorized == otherSigner {
+		t.Fatal("signature for a different chain should not authorize the signer")
+	}
+
+	// invalid signature values are rejected and unset the authorized account
+	for _, tc := range []struct{ v, r, s *uint256.Int }{
+		{uint256.NewInt(2), r, s},
+		{v, new(uint256.Int), s},
+		{v, r, new(uint256.Int).SetAllOne()},
+	} {
+		scope.authorized = &signer
+		stack.push(tc.s)
+		stack.push(tc.r)
+		stack.push(tc.v)
+		stack.push(new(uint256.Int).SetBytes(commit.Bytes()))
+		if _, err := opAuth(context.Background(), &pc, evmInterpreter, scope); err != nil {
+			t.Fatal(err)
+		}
+		if res := stack.pop(); !res.IsZero() {
+			t.Fatalf("expected zero result for invalid signature, got %x", res.Bytes())
+		}
+		if scope.authorized != nil {
+			t.Fatal("authorized should be unset after invalid signature")
+		}
+	}
+}
+
+func TestOpAuthcall(t *testing.T) {
+	var (
+		statedb, _ = state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		blockCtx   = BlockContext{
+			CanTransfer: func(StateDB, common.Address, *big.Int) bool { return true },
+			Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+			BlockNumber: big.NewInt(0),
+		}
+		env            = NewEVM(blockCtx, TxContext{}, statedb, params.TestChainConfig, Config{})
+		stack          = newstack()
+		evmInterpreter = NewEVMInterpreter(env)
+		invoker        = common.Address{1}
+		target         = common.Address{2}
+		contract       = NewContract(contractRef{common.Address{}}, AccountRef(invoker), new(big.Int), 0)
+		scope          = &ScopeContext{NewMemory(), stack, contract, nil}
+		pc             = uint64(0)
+	)
+	env.CloseAspectCall()
+	env.interpreter = evmInterpreter
+	// CALLER PUSH1 0 SSTORE
+	statedb.SetCode(target, common.Hex2Bytes("33600055"))
+	statedb.AddAddressToAccessList(target)
+
+	pushCall := func() {
+		for i := 0; i < 4; i++ {
+			stack.push(new(uint256.Int)) // retSize, retOffset, inSize, inOffset
+		}
+		stack.push(new(uint256.Int))                          // value
+		stack.push(new(uint256.Int).SetBytes(target.Bytes())) // addr
+		stack.push(uint256.NewInt(100000))                    // gas
+		env.callGasTemp = 100000
+	}
+
+	pushCall()
+	if _, err := opAuthcall(context.Background(), &pc, evmInterpreter, scope); err != ErrAuthorizedNotSet {
+		t.Fatalf("expected %v, got %v", ErrAuthorizedNotSet, err)
+	}
+
+	stack = newstack()
+	scope.Stack = stack
+	authorized := common.Address{0xaa}
+	scope.authorized = &authorized
+	pushCall()
+	if _, err := opAuthcall(context.Background(), &pc, evmInterpreter, scope); err != nil {
+		t.Fatal(err)
+	}
+	if res := stack.pop(); !res.Eq(one) {
+		t.Fatal("authcall should succeed")
+	}
+	if caller := statedb.GetState(target, common.Hash{}); common.BytesToAddress(caller.Bytes()) != authorized {
+		t.Fatalf("expected caller %x, got %x", authorized, caller)
+	}
+}
+
+func TestAuthGasCost(t *testing.T) {
+	var (
+		env     = NewEVM(BlockContext{}, TxContext{}, nil, params.TestChainConfig, Config{ExtraEips: []int{3074}})
+		invoker = common.Address{1}
+		commit  = common.HexToHash("0xc0ffee")
+	)
+	_, v, r, s := signAuth(t, params.TestChainConfig.ChainID, invoker, commit)
+
+	// PUSH32 s PUSH32 r PUSH1 v PUSH32 commit AUTH STOP
+	code := append([]byte{byte(PUSH32)}, s.PaddedBytes(32)...)
+	code = append(code, byte(PUSH32))
+	code = append(code, r.PaddedBytes(32)...)
+	code = append(code, byte(PUSH1), byte(v.Uint64()), byte(PUSH32))
+	code = append(code, commit.Bytes()...)
+	code = append(code, byte(AUTH), byte(STOP))
+
+	contract := NewContract(contractRef{common.Address{}}, AccountRef(invoker), new(big.Int), 10000)
+	contract.Code = code
+	if _, err := env.interpreter.Run(context.Background(), contract, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	if used, expected := 10000-contract.Gas, 4*GasFastestStep+params.EcrecoverGas; used != expected {
+		t.Fatalf("expected gas used %d, got %d", expected, used)
+	}
+}
+
+func TestVerifyMappingSlot(t *testing.T) {
+	var (
+		env            = NewEVM(BlockContext{}, TxContext{}, nil, params.TestChainConfig, Config{VerifyStorageKeys: true})
+		stack          = newstack()
+		mem            = NewMemory()
+		evmInterpreter = NewEVMInterpreter(env)
+		account        = common.Address{1}
+		contract       = NewContract(contractRef{common.Address{}}, AccountRef(account), new(big.Int), 0)
+		scope          = &ScopeContext{mem, stack, contract, nil}
+		key            = []byte("alice")
+		base           = uint256.NewInt(3)
+		typeId         = uint256.NewInt(1)
+		parentTypeId   = uint256.NewInt(2)
+		pc             = uint64(0)
+	)
+	baseBytes := base.Bytes32()
+	expected := new(uint256.Int).SetBytes(crypto.Keccak256(key, baseBytes[:]))
+
+	if err := evmInterpreter.tracer.SaveStateKey(account, nil, base, nil, parentTypeId.Bytes32(), common.Hash{}, []byte("balances")); err != nil {
+		t.Fatal(err)
+	}
+
+	// length prefixed key at memory offset 0
+	mem.Resize(64)
+	mem.Set32(0, uint256.NewInt(uint64(len(key))))
+	mem.Set(32, uint64(len(key)), key)
+
+	journal := func(slot *uint256.Int) {
+		stack.push(parentTypeId)
+		stack.push(typeId)
+		stack.push(new(uint256.Int))
+		stack.push(new(uint256.Int)) // key pointer
+		stack.push(slot)
+		stack.push(base)
+		if _, err := opReferenceIndexValueStorageJournal(context.Background(), &pc, evmInterpreter, scope); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	journal(expected)
+	if anomalies := evmInterpreter.tracer.SlotAnomalies(); len(anomalies) != 0 {
+		t.Fatalf("expected no anomaly, got %d", len(anomalies))
+	}
+
+	wrongSlot := new(uint256.Int).AddUint64(expected, 1)
+	journal(wrongSlot)
+	anomalies := evmInterpreter.tracer.SlotAnomalies()
+	if len(anomalies) != 1 {
+		t.Fatalf("expected 1 anomaly, got %d", len(anomalies))
+	}
+	if !anomalies[0].Expected.Eq(expected) || !anomalies[0].Actual.Eq(wrongSlot) || !bytes.Equal(anomalies[0].Key, key) {
+		t.Fatalf("unexpected anomaly %+v", anomalies[0])
+	}
+}
+
+func TestLoadDataFromMem(t *testing.T) {
+	mem := NewMemory()
+	mem.Resize(96)
+	mem.Set32(0, uint256.NewInt(3))
+	mem.Set(32, 3, []byte("abc"))
+	mem.Set32(64, uint256.NewInt(1))
+
+	data, size, err := loadDataFromMem(uint256.NewInt(0), mem)
+	if err != nil || size != 3 || string(data) != "abc" {
+		t.Fatalf("unexpected data %q of size %d, error %v", data, size, err)
+	}
+	// the data following the length at 64 is past the memory
+	if _, _, err := loadDataFromMem(uint256.NewInt(64), mem); err != ErrMemoryOutOfBounds {
+		t.Fatalf("expected %v, got %v", ErrMemoryOutOfBounds, err)
+	}
+	// the length word is partially out of the memory
+	if _, _, err := loadDataFromMem(uint256.NewInt(80), mem); err != ErrMemoryOutOfBounds {
+		t.Fatalf("expected %v, got %v", ErrMemoryOutOfBounds, err)
+	}
+}
+
+func TestIntPoolNoAliasing(t *testing.T) {
+	var (
+		env            = NewEVM(BlockContext{BlockNumber: big.NewInt(7)}, TxContext{}, nil, params.TestChainConfig, Config{})
+		stack          = newstack()
+		evmInterpreter = NewEVMInterpreter(env)
+		contract       = NewContract(contractRef{common.Address{}}, AccountRef(common.Address{1}), new(big.Int), 0)
+		scope          = &ScopeContext{nil, stack, contract, nil}
+		pc             = uint64(0)
+	)
+	// push more values than the pool holds, the pooled storage wraps around
+	for i := 0; i < 2*intPoolSize; i++ {
+		opAddress(context.Background(), &pc, evmInterpreter, scope)
+		opNumber(context.Background(), &pc, evmInterpreter, scope)
+	}
+
+	address := new(uint256.Int).SetBytes(common.Address{1}.Bytes())
+	for i := 0; i < 2*intPoolSize; i++ {
+		if v := stack.pop(); !v.Eq(uint256.NewInt(7)) {
+			t.Fatalf("item %d: expected block number, got %v", i, v)
+		}
+		if v := stack.pop(); !v.Eq(address) {
+			t.Fatalf("item %d: expected address, got %v", i, v)
+		}
+	}
+}
+
+// BenchmarkIntPool compares pushing freshly allocated integers with pushing
+// pooled ones in a tight ADDRESS NUMBER ADD POP loop.
+func BenchmarkIntPool(b *testing.B) {
+	var (
+		env            = NewEVM(BlockContext{BlockNumber: big.NewInt(7)}, TxContext{}, nil, params.TestChainConfig, Config{})
+		stack          = newstack()
+		evmInterpreter = NewEVMInterpreter(env)
+		contract       = NewContract(contractRef{common.Address{}}, AccountRef(common.Address{1}), new(big.Int), 0)
+		scope          = &ScopeContext{nil, stack, contract, nil}
+		pc             = uint64(0)
+		ctx            = context.Background()
+	)
+
+	b.Run("alloc", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			stack.push(new(uint256.Int).SetBytes(contract.Address().Bytes()))
+			v, _ := uint256.FromBig(env.Context.BlockNumber)
+			stack.push(v)
+			// nolint
+			opAdd(ctx, &pc, evmInterpreter, scope)
+			stack.pop()
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			// nolint
+			opAddress(ctx, &pc, evmInterpreter, scope)
+			// nolint
+			opNumber(ctx, &pc, evmInterpreter, scope)
+			// nolint
+			opAdd(ctx, &pc, evmInterpreter, scope)
+			stack.pop()
+		}
+	})
+}
+
+func BenchmarkOpReferenceChangeJournal(b *testing.B) {
+	var (
+		statedb, _     = state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		env            = NewEVM(BlockContext{}, TxContext{}, statedb, params.TestChainConfig, Config{})
+		stack          = newstack()
+		evmInterpreter = NewEVMInterpreter(env)
+		account        = common.Address{1}
+		contract       = NewContract(contractRef{common.Address{}}, AccountRef(account), new(big.Int), 0)
+		scope          = &ScopeContext{nil, stack, contract, nil}
+		slot           = new(uint256.Int).SetBytes(common.Hex2Bytes("ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"))
+		typeId         = uint256.NewInt(1)
+		pc             = uint64(0)
+	)
+	env.interpreter = evmInterpreter
+	// a 64 bytes long string, stored out of place
+	statedb.SetState(account, slot.Bytes32(), common.BigToHash(big.NewInt(64*2+1)))
+	if err := evmInterpreter.tracer.SaveStateKey(account, nil, slot, nil, typeId.Bytes32(), common.Hash{}, []byte("name")); err != nil {
+		b.Fatal(err)
+	}
+
+	bench := func(cached bool) func(b *testing.B) {
+		return func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if !cached {
+					evmInterpreter.referenceSlots.Purge()
+				}
+				stack.push(typeId)
+				stack.push(slot)
+				if _, err := opReferenceChangeJournal(context.Background(), &pc, evmInterpreter, scope); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	}
+	b.Run("uncached", bench(false))
+	b.Run("cached", bench(true))
+}
+
+// batchStateDB counts the storage reads of a StateDB supporting batch reads
+type batchStateDB struct {
+	*state.StateDB
+	reads int
+}
+
+func (db *batchStateDB) GetState(addr common.Address, slot common.Hash) common.Hash {
+	db.reads++
+	return db.StateDB.GetState(addr, slot)
+}
+
+func (db *batchStateDB) GetStateBatch(addr common.Address, slots []common.Hash) []common.Hash {
+	db.reads++
+	vals := make([]common.Hash, len(slots))
+	for i, slot := range slots {
+		vals[i] = db.StateDB.GetState(addr, slot)
+	}
+	return vals
+}
+
+// plainStateDB counts the storage reads of a StateDB without batch reads
+type plainStateDB struct {
+	*state.StateDB
+	reads int
+}
+
+func (db *plainStateDB) GetState(addr common.Address, slot common.Hash) common.Hash {
+	db.reads++
+	return db.StateDB.GetState(addr, slot)
+}
+
+func TestOpSloadBatch(t *testing.T) {
+	var (
+		contract = common.Address{1}
+		vals     = []common.Hash{{0xaa}, {0xbb}}
+		// PUSH1 2, PUSH1 1, PUSH1 2, SLOADBATCH, PUSH1 0, MSTORE, PUSH1 32, MSTORE, PUSH1 64, PUSH1 0, RETURN
+		code = []byte{
+			byte(PUSH1), 2, byte(PUSH1), 1, byte(PUSH1), 2, byte(SLOADBATCH),
+			byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), 32, byte(MSTORE),
+			byte(PUSH1), 64, byte(PUSH1), 0, byte(RETURN),
+		}
+	)
+	newStateDB := func() *state.StateDB {
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.SetCode(contract, code)
+		statedb.SetState(contract, common.Hash{31: 1}, vals[0])
+		statedb.SetState(contract, common.Hash{31: 2}, vals[1])
+		return statedb
+	}
+	vmctx := BlockContext{
+		CanTransfer: func(StateDB, common.Address, *big.Int) bool { return true },
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+
+	for _, tt := range []struct {
+		name string
+		db   StateDB
+	}{
+		{name: "batch", db: &batchStateDB{StateDB: newStateDB()}},
+		{name: "fallback", db: &plainStateDB{StateDB: newStateDB()}},
+	} {
+		evm := NewEVM(vmctx, TxContext{}, tt.db, params.TestChainConfig, Config{ExtraEips: []int{SloadBatchEIP}})
+		evm.CloseAspectCall()
+		ret, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), contract, nil, 100000, new(big.Int))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", tt.name, err)
+		}
+		if want := append(vals[0].Bytes(), vals[1].Bytes()...); !bytes.Equal(ret, want) {
+			t.Fatalf("%s: have %x, want %x", tt.name, ret, want)
+		}
+		var reads int
+		switch db := tt.db.(type) {
+		case *batchStateDB:
+			reads = db.reads
+		case *plainStateDB:
+			reads = db.reads
+		}
+		if want := map[string]int{"batch": 1, "fallback": 2}[tt.name]; reads != want {
+			t.Fatalf("%s: have %d storage reads, want %d", tt.name, reads, want)
+		}
+	}
+
+	// the count must not exceed the slot keys on the stack
+	evm := NewEVM(vmctx, TxContext{}, newStateDB(), params.TestChainConfig, Config{ExtraEips: []int{SloadBatchEIP}})
+	evm.CloseAspectCall()
+	evm.StateDB.SetCode(contract, []byte{byte(PUSH1), 1, byte(PUSH1), 2, byte(SLOADBATCH)})
+	_, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), contract, nil, 100000, new(big.Int))
+	if _, ok := err.(*ErrStackUnderflow); !ok {
+		t.Fatalf("expected stack underflow, got %v", err)
+	}
+
+	// a slot repeated in the batch is warm after its first read, the slots are accessed
+	// once executed: PUSH1 1, PUSH1 1, PUSH1 2, SLOADBATCH, STOP
+	evm = NewEVM(vmctx, TxContext{}, newStateDB(), params.TestChainConfig, Config{ExtraEips: []int{SloadBatchEIP}})
+	evm.CloseAspectCall()
+	evm.StateDB.SetCode(contract, []byte{byte(PUSH1), 1, byte(PUSH1), 1, byte(PUSH1), 2, byte(SLOADBATCH), byte(STOP)})
+	_, gas, err := evm.Call(context.Background(), AccountRef(common.Address{}), contract, nil, 100000, new(big.Int))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if used, want := 100000-gas, uint64(3*GasFastestStep+2*params.WarmStorageReadCostEIP2929+params.ColdSloadCostEIP2929); used != want {
+		t.Fatalf("have %d gas used, want %d", used, want)
+	}
+	if _, slotPresent := evm.StateDB.SlotInAccessList(contract, common.Hash{31: 1}); !slotPresent {
+		t.Fatal("expected the slot in the access list")
+	}
+}
+
+func BenchmarkOpSloadBatch(b *testing.B) {
+	const slots = 8
+	var (
+		statedb, _ = state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		db         = &batchStateDB{StateDB: statedb}
+		env        = NewEVM(BlockContext{}, TxContext{}, db, params.TestChainConfig, Config{})
+		stack      = newstack()
+		account    = common.Address{1}
+		contract   = NewContract(contractRef{common.Address{}}, AccountRef(account), new(big.Int), 0)
+		scope      = &ScopeContext{nil, stack, contract, nil}
+		pc         = uint64(0)
+	)
+	evmInterpreter := NewEVMInterpreter(env)
+	env.interpreter = evmInterpreter
+	for i := 0; i < slots; i++ {
+		statedb.SetState(account, common.BigToHash(big.NewInt(int64(i))), common.Hash{byte(i + 1)})
+	}
+
+	bench := func(batch bool) func(b *testing.B) {
+		return func(b *testing.B) {
+			db.reads = 0
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if batch {
+					for j := 0; j < slots; j++ {
+						stack.push(uint256.NewInt(uint64(j)))
+					}
+					stack.push(uint256.NewInt(slots))
+					opSloadBatch(context.Background(), &pc, evmInterpreter, scope)
+				} else {
+					for j := 0; j < slots; j++ {
+						stack.push(uint256.NewInt(uint64(j)))
+						opSload(context.Background(), &pc, evmInterpreter, scope)
+					}
+				}
+				stack.data = stack.data[:0]
+			}
+			b.ReportMetric(float64(db.reads)/float64(b.N), "reads/op")
+		}
+	}
+	b.Run("sload", bench(false))
+	b.Run("batch", bench(true))
+}
+
+func TestSignificantWritesOnly(t *testing.T) {
+	var (
+		account = common.Address{1}
+		slot    = uint256.NewInt(0)
+		typeId  = uint256.NewInt(1)
+	)
+	// run journals slot 0 with VVJNAL after storing each value, returning the recorded changes
+	run := func(significantOnly bool, vals ...uint64) map[uint64][][]byte {
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.CreateAccount(account)
+		statedb.SetState(account, slot.Bytes32(), common.BigToHash(big.NewInt(5)))
+		statedb.Finalise(true)
+
+		var (
+			env            = NewEVM(BlockContext{}, TxContext{}, statedb, params.TestChainConfig, Config{})
+			stack          = newstack()
+			evmInterpreter = NewEVMInterpreter(env)
+			contract       = NewContract(contractRef{common.Address{}}, AccountRef(account), new(big.Int), 0)
+			scope          = &ScopeContext{nil, stack, contract, nil}
+			pc             = uint64(0)
+		)
+		env.interpreter = evmInterpreter
+		evmInterpreter.tracer.SignificantWritesOnly = significantOnly
+		if err := evmInterpreter.tracer.SaveStateKey(account, nil, slot, nil, typeId.Bytes32(), common.Hash{}, []byte("counter")); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, val := range vals {
+			statedb.SetState(account, slot.Bytes32(), common.BigToHash(new(big.Int).SetUint64(val)))
+			stack.push(typeId)
+			stack.push(uint256.NewInt(32))
+			stack.push(uint256.NewInt(0))
+			stack.push(slot)
+			if _, err := opValueChangeJournal(context.Background(), &pc, evmInterpreter, scope); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return evmInterpreter.tracer.StateChanges().Variable(account, "counter").Changes()
+	}
+
+	// a no-op write is recorded by default
+	if changes := run(false, 5); len(changes[0]) != 1 {
+		t.Fatalf("expected the no-op write to be recorded, got %v", changes)
+	}
+	if changes := run(true, 5); len(changes) != 0 {
+		t.Fatalf("expected the no-op write to be dropped, got %v", changes)
+	}
+	// writing back the committed value after a change is significant
+	if changes := run(true, 5, 6, 5); len(changes[0]) != 2 {
+		t.Fatalf("expected 2 recorded writes, got %v", changes)
+	}
+}
+
+// stateChangeRecorder is a StateChangeSink recording the changes passed to it
+type stateChangeRecorder struct {
+	changes [][]byte
+	calls   []uint64
+}
+
+func (r *stateChangeRecorder) OnStateChange(account common.Address, slot *uint256.Int, offset *uint256.Int, typeId common.Hash, callIdx uint64, newVal []byte) {
+	r.changes = append(r.changes, common.CopyBytes(newVal))
+	r.calls = append(r.calls, callIdx)
+}
+
+func TestStateChangeSink(t *testing.T) {
+	var (
+		account  = common.Address{1}
+		slot     = uint256.NewInt(0)
+		typeId   = uint256.NewInt(1)
+		recorder = new(stateChangeRecorder)
+	)
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.CreateAccount(account)
+
+	var (
+		env            = NewEVM(BlockContext{}, TxContext{}, statedb, params.TestChainConfig, Config{StateChangeSink: recorder})
+		stack          = newstack()
+		evmInterpreter = NewEVMInterpreter(env)
+		contract       = NewContract(contractRef{common.Address{}}, AccountRef(account), new(big.Int), 0)
+		scope          = &ScopeContext{nil, stack, contract, nil}
+		pc             = uint64(0)
+	)
+	env.interpreter = evmInterpreter
+	if err := evmInterpreter.tracer.SaveStateKey(account, nil, slot, nil, typeId.Bytes32(), common.Hash{}, []byte("counter")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, val := range []byte{1, 2} {
+		statedb.SetState(account, slot.Bytes32(), common.BytesToHash([]byte{val}))
+		stack.push(typeId)
+		stack.push(uint256.NewInt(1))
+		stack.push(uint256.NewInt(0))
+		stack.push(slot)
+		if _, err := opValueChangeJournal(context.Background(), &pc, evmInterpreter, scope); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := [][]byte{{1}, {2}}; !reflect.DeepEqual(recorder.changes, want) {
+		t.Fatalf("expected sink changes %v, got %v", want, recorder.changes)
+	}
+	if want := []uint64{0, 0}; !reflect.DeepEqual(recorder.calls, want) {
+		t.Fatalf("expected sink call indices %v, got %v", want, recorder.calls)
+	}
+	if changes := evmInterpreter.tracer.StateChanges().Variable(account, "counter"); changes != nil {
+		t.Fatalf("expected no changes kept by the tracer, got %v", changes.Changes())
+	}
+}
+
+func TestSlotPreimages(t *testing.T) {
+	var (
+		account = common.Address{1}
+		slot    = new(uint256.Int).SetBytes(common.Hex2Bytes("ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"))
+		typeId  = uint256.NewInt(1)
+	)
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.CreateAccount(account)
+	// a 64 bytes long string, stored out of place
+	statedb.SetState(account, slot.Bytes32(), common.BigToHash(big.NewInt(64*2+1)))
+
+	var (
+		env            = NewEVM(BlockContext{}, TxContext{}, statedb, params.TestChainConfig, Config{})
+		stack          = newstack()
+		evmInterpreter = NewEVMInterpreter(env)
+		contract       = NewContract(contractRef{common.Address{}}, AccountRef(account), new(big.Int), 0)
+		scope          = &ScopeContext{nil, stack, contract, nil}
+		pc             = uint64(0)
+	)
+	env.interpreter = evmInterpreter
+	if err := evmInterpreter.tracer.SaveStateKey(account, nil, slot, nil, typeId.Bytes32(), common.Hash{}, []byte("name")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the pre-image is recorded whether the reference slot is cached or not
+	for i := 0; i < 2; i++ {
+		stack.push(typeId)
+		stack.push(slot)
+		if _, err := opReferenceChangeJournal(context.Background(), &pc, evmInterpreter, scope); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	preimages := evmInterpreter.tracer.StateChanges().SlotPreimages(account)
+	if len(preimages) != 1 {
+		t.Fatalf("expected 1 pre-image, got %d", len(preimages))
+	}
+	referenceSlot := crypto.Keccak256Hash(slot.Bytes())
+	preimage, ok := preimages[referenceSlot]
+	if !ok {
+		t.Fatalf("expected a pre-image of reference slot %x, got %v", referenceSlot, preimages)
+	}
+	if hash := crypto.Keccak256Hash(preimage); hash != referenceSlot {
+		t.Fatalf("expected pre-image hashing to %x, got %x", referenceSlot, hash)
+	}
+	if preimages := evmInterpreter.tracer.StateChanges().SlotPreimages(common.Address{2}); preimages != nil {
+		t.Fatalf("expected no pre-images of an untouched account, got %v", preimages)
+	}
+}
+
+func TestOpReturnOverflow(t *testing.T) {
+	var (
+		maxU64  = uint64(1<<64 - 1)
+		address = common.BytesToAddress([]byte("contract"))
+		vmctx   = BlockContext{
+			Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+			BlockNumber: big0,
+		}
+	)
+	tests := []struct {
+		offset, size uint64
+		opErr        error // error of the opcode run on its own, nil if it succeeds
+		err          error // error of the execution, nil if it succeeds
+	}{
+		{maxU64, maxU64, ErrGasUintOverflow, ErrGasUintOverflow},
+		{maxU64, 1, ErrGasUintOverflow, ErrGasUintOverflow},
+		{0, maxU64, ErrMemoryOutOfBounds, ErrGasUintOverflow},
+		{maxU64, 0, nil, nil},
+	}
+	for i, tt := range tests {
+		for _, op := range []OpCode{RETURN, REVERT} {
+			execute, stopErr := opReturn, errStopToken
+			if op == REVERT {
+				execute, stopErr = opRevert, ErrExecutionReverted
+			}
+
+			// the opcode on its own never reads beyond the memory
+			var (
+				env            = NewEVM(BlockContext{}, TxContext{}, nil, params.TestChainConfig, Config{})
+				stack          = newstack()
+				evmInterpreter = NewEVMInterpreter(env)
+				pc             = uint64(0)
+			)
+			env.interpreter = evmInterpreter
+			stack.push(new(uint256.Int).SetUint64(tt.size))
+			stack.push(new(uint256.Int).SetUint64(tt.offset))
+			want := tt.opErr
+			if want == nil {
+				want = stopErr
+			}
+			if ret, err := execute(context.Background(), &pc, evmInterpreter, &ScopeContext{NewMemory(), stack, nil, nil}); err != want || ret != nil {
+				t.Fatalf("test %d, %v: expected error %v, got %x, %v", i, op, want, ret, err)
+			}
+
+			// executed, oversized values fail on the memory expansion
+			var size, offset [8]byte
+			binary.BigEndian.PutUint64(size[:], tt.size)
+			binary.BigEndian.PutUint64(offset[:], tt.offset)
+			code := append([]byte{byte(PUSH8)}, size[:]...)
+			code = append(code, byte(PUSH8))
+			code = append(code, offset[:]...)
+			code = append(code, byte(op))
+
+			statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+			statedb.CreateAccount(address)
+			statedb.SetCode(address, code)
+			statedb.Finalise(true)
+
+			evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+			evm.CloseAspectCall()
+			_, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int))
+			want = tt.err
+			if want == nil && op == REVERT {
+				want = ErrExecutionReverted
+			}
+			if !errors.Is(err, want) {
+				t.Fatalf("test %d, %v: expected execution error %v, got %v", i, op, want, err)
+			}
+		}
+	}
+}
+
+func TestOpExtCodeHashPrecompile(t *testing.T) {
+	var (
+		funded   = common.BytesToAddress([]byte{1})
+		unfunded = common.BytesToAddress([]byte{2})
+		withCode = common.BytesToAddress([]byte{3})
+		code     = []byte{byte(STOP)}
+	)
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.AddBalance(funded, big.NewInt(1))
+	// the code stored at a precompile address is never run, but it is still hashed
+	statedb.SetCode(withCode, code)
+
+	var (
+		env            = NewEVM(BlockContext{BlockNumber: big0}, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+		stack          = newstack()
+		evmInterpreter = NewEVMInterpreter(env)
+		pc             = uint64(0)
+	)
+	env.interpreter = evmInterpreter
+
+	tests := []struct {
+		address common.Address
+		want    common.Hash
+	}{
+		{funded, emptyCodeHash},
+		{unfunded, common.Hash{}},
+		{withCode, crypto.Keccak256Hash(code)},
+	}
+	for i, tt := range tests {
+		if _, ok := env.precompile(tt.address); !ok {
+			t.Fatalf("test %d: expected a precompile at %x", i, tt.address)
+		}
+		stack.push(new(uint256.Int).SetBytes(tt.address.Bytes()))
+		if _, err := opExtCodeHash(context.Background(), &pc, evmInterpreter, &ScopeContext{nil, stack, nil, nil}); err != nil {
+			t.Fatalf("test %d: unexpected error: %v", i, err)
+		}
+		result := stack.pop()
+		if have := common.Hash(result.Bytes32()); have != tt.want {
+			t.Fatalf("test %d: expected code hash %x, got %x", i, tt.want, have)
+		}
+	}
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/holiman/uint256"
 )
 
 // StateDB is an EVM database for full state querying.
@@ -78,6 +79,37 @@ type StateDB interface {
 	AddPreimage(common.Hash, []byte)
 }
 
+// BatchStateDB is implemented by the StateDBs which can read multiple storage slots in
+// a single round-trip. StateDBs not implementing it are read slot by slot.
+type BatchStateDB interface {
+	// GetStateBatch returns the values of the given storage slots, in order of the slots
+	GetStateBatch(addr common.Address, slots []common.Hash) []common.Hash
+}
+
+// getStateBatch reads the given storage slots with GetStateBatch if the StateDB supports it,
+// otherwise falls back to individual GetState calls
+func getStateBatch(db StateDB, addr common.Address, slots []common.Hash) []common.Hash {
+	if batchDB, ok := db.(BatchStateDB); ok {
+		return batchDB.GetStateBatch(addr, slots)
+	}
+
+	vals := make([]common.Hash, len(slots))
+	for i, slot := range slots {
+		vals[i] = db.GetState(addr, slot)
+	}
+	return vals
+}
+
+// StateChangeSink receives the state changes journaled by the execution as they are made,
+// so that they can be persisted incrementally instead of being kept by the Tracer.
+// The changes of reverted calls are passed as well, the sink can tell them by the
+// errors of the calls in the call tree.
+type StateChangeSink interface {
+	// OnStateChange is called with the new value of a state variable, the offset is nil
+	// for reference typed variables
+	OnStateChange(account common.Address, slot *uint256.Int, offset *uint256.Int, typeId common.Hash, callIdx uint64, newVal []byte)
+}
+
 // CallContext provides a basic interface for the EVM calling conventions. The EVM
 // depends on this context being implemented for doing subcalls and initialising new EVM contracts.
 type CallContext interface {
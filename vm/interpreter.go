@@ -18,19 +18,46 @@ package vm
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/lru"
 	"github.com/ethereum/go-ethereum/common/math"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
 )
 
+// referenceSlotCacheSize is the number of derived reference slots cached by the interpreter
+const referenceSlotCacheSize = 128
+
+// DefaultJumpdestCacheSize is the number of JUMPDEST analyses cached if Config.JumpdestCacheSize is 0
+const DefaultJumpdestCacheSize = 1024
+
 // Config are the configuration options for the Interpreter
 type Config struct {
 	Tracer                  EVMLogger // Opcode logger
 	NoBaseFee               bool      // Forces the EIP-1559 baseFee to 0 (needed for 0 price calls)
 	EnablePreimageRecording bool      // Enables recording of SHA3/keccak preimages
 	ExtraEips               []int     // Additional EIPS that are to be enabled
+	VerifyStorageKeys       bool      // Verifies the keccak-derived slots reported by the journaling opcodes
+	MaxCallDepth            int       // Overrides the call depth limit of 1024 if positive
+	EnableCoverage          bool      // Enables recording of the executed bytecode positions
+	CaptureRevertStack      bool      // Enables capturing the stack of calls failed by an opcode into Call.RevertStack
+	EnableOpcodeCounting    bool      // Enables counting the executed instructions by opcode
+	ForbiddenOpcodes        []OpCode  // Opcodes failing the execution with ErrForbiddenOpcode
+	MaxInstructionSteps     uint64    // Fails the execution with ErrStepLimitExceeded after executing as many instructions if non-zero
+	StepLimitIsGlobal       bool      // Counts the instruction steps of all calls of a top level call against MaxInstructionSteps, instead of each call
+	TraceOriginUse          bool      // Enables flagging the calls executing ORIGIN with Call.UsesOrigin
+	JumpdestCacheSize       int       // Number of JUMPDEST analyses kept by code hash across the top level calls, DefaultJumpdestCacheSize if 0, a negative size disables the cache
+	StructuredErrors        bool      // Wraps the errors returned by Run into an EVMError, which callers must match with errors.Is/As
+	TrackStorageReads       bool      // Enables recording the storage reads used by StateChanges.DeadWrites and DependencyGraph
+
+	OpcodeAliases      map[OpCode]OpCode  // Remaps opcodes to the operation of other opcodes, remapping STOP, RETURN or REVERT panics
+	CustomGasFunctions map[OpCode]GasFunc // Overrides the dynamic gas of opcodes, including the one inherited by aliased opcodes
+
+	CustomPrecompiles map[common.Address]PrecompiledContract // Additional precompiled contracts, overriding the native ones at the same address
+	StateChangeSink   StateChangeSink                        // Receives the journaled state changes instead of the tracer if set
 }
 
 // ScopeContext contains the things that are per-call, such as stack and memory,
@@ -39,6 +66,8 @@ type ScopeContext struct {
 	Memory   *Memory
 	Stack    *Stack
 	Contract *Contract
+
+	authorized *common.Address // Signer set by AUTH (EIP-3074), nil if unset
 }
 
 // EVMInterpreter represents an EVM interpreter
@@ -48,14 +77,24 @@ type EVMInterpreter struct {
 
 	hasher    crypto.KeccakState // Keccak256 hasher instance shared across opcodes
 	hasherBuf common.Hash        // Keccak256 hasher result array shared aross opcodes
+	intPool   intPool            // Transient integers pushed onto the stack by opcodes
+
+	referenceSlots lru.BasicLRU[common.Hash, common.Hash] // Keccak256 derived reference slots of the journaled slots
+	jumpdestCache  *lru.BasicLRU[common.Hash, bitvec]     // JUMPDEST analyses kept across the top level calls, nil if disabled
 
 	readOnly   bool   // Whether to throw on stateful modifications
 	returnData []byte // Last CALL's return data for subsequent reuse
+	coverage   []byte // Bitmap of the executed positions of the latest top level call's contract bytecode
+
+	opcodeCounts map[OpCode]uint64 // Executed instructions by opcode, nil if counting is disabled
+	forbidden    [256]bool         // Lookup table of the forbidden opcodes
+	steps        uint64            // Instructions executed since the top level call started, only counted with a global step limit
 
 	tracer *Tracer // Execution tracer
 }
 
-// NewEVMInterpreter returns a new instance of the Interpreter.
+// NewEVMInterpreter returns a new instance of the Interpreter. It panics if
+// Config.OpcodeAliases remaps an opcode which cannot be aliased.
 func NewEVMInterpreter(evm *EVM) *EVMInterpreter {
 	// If jump table was not initialised we set the default one.
 	var table *JumpTable
@@ -86,7 +125,7 @@ func NewEVMInterpreter(evm *EVM) *EVMInterpreter {
 		table = &frontierInstructionSet
 	}
 	var extraEips []int
-	if len(evm.Config.ExtraEips) > 0 {
+	if len(evm.Config.ExtraEips) > 0 || len(evm.Config.OpcodeAliases) > 0 || len(evm.Config.CustomGasFunctions) > 0 {
 		// Deep-copy jumptable to prevent modification of opcodes in other tables
 		table = copyJumpTable(table)
 	}
@@ -99,8 +138,52 @@ func NewEVMInterpreter(evm *EVM) *EVMInterpreter {
 		}
 	}
 	evm.Config.ExtraEips = extraEips
+	// aliases are resolved against the table before any of them is applied
+	base := *table
+	for alias, target := range evm.Config.OpcodeAliases {
+		if err := aliasOpcode(table, &base, alias, target); err != nil {
+			// an invalid alias is a programming error, like an invalid jump table
+			panic(err)
+		}
+	}
+	for op, gas := range evm.Config.CustomGasFunctions {
+		table[op].dynamicGas = gas
+	}
+
+	in := &EVMInterpreter{
+		evm:            evm,
+		table:          table,
+		tracer:         evm.tracer,
+		referenceSlots: lru.NewBasicLRU[common.Hash, common.Hash](referenceSlotCacheSize),
+	}
+	if evm.Config.EnableOpcodeCounting {
+		in.opcodeCounts = make(map[OpCode]uint64)
+	}
+	if size := evm.Config.JumpdestCacheSize; size >= 0 {
+		if size == 0 {
+			size = DefaultJumpdestCacheSize
+		}
+		cache := lru.NewBasicLRU[common.Hash, bitvec](size)
+		in.jumpdestCache = &cache
+	}
+	for _, op := range evm.Config.ForbiddenOpcodes {
+		in.forbidden[op] = true
+	}
+	return in
+}
 
-	return &EVMInterpreter{evm: evm, table: table, tracer: evm.tracer}
+// RunWithTimeout runs the contract like Run, with a context cancelled after the given timeout.
+// As with any cancelled context, the execution stops before the next instruction once the
+// timeout fires, in which case context.DeadlineExceeded is returned.
+func (in *EVMInterpreter) RunWithTimeout(timeout time.Duration, contract *Contract, input []byte, readOnly bool) (ret []byte, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	ret, err = in.Run(ctx, contract, input, readOnly)
+	if errors.Is(err, errContextCanceled) && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return ret, context.DeadlineExceeded
+	}
+	return ret, err
 }
 
 // Run loops and evaluates the contract's code with the given input data and returns
@@ -108,12 +191,32 @@ func NewEVMInterpreter(evm *EVM) *EVMInterpreter {
 //
 // It's important to note that any errors returned by the interpreter should be
 // considered a revert-and-consume-all-gas operation except for
-// ErrExecutionReverted which means revert-and-keep-gas-left.
+// ErrExecutionReverted which means revert-and-keep-gas-left, and errContextCanceled
+// which aborts the execution once ctx is done and also keeps the gas left.
 func (in *EVMInterpreter) Run(ctx context.Context, contract *Contract, input []byte, readOnly bool) (ret []byte, err error) {
 	// Increment the call depth which is restricted to 1024
 	in.evm.depth++
 	defer func() { in.evm.depth-- }()
 
+	// Count the instruction steps of this call, or of all calls since the top level one
+	// if the step limit is global
+	var steps *uint64
+	if in.evm.Config.MaxInstructionSteps != 0 {
+		steps = new(uint64)
+		if in.evm.Config.StepLimitIsGlobal {
+			if in.evm.depth == 1 {
+				in.steps = 0
+			}
+			steps = &in.steps
+		}
+	}
+
+	// The coverage is recorded for the contract of the top level call only, starting anew
+	// once its first instruction is executed
+	if in.evm.depth == 1 {
+		in.coverage = nil
+	}
+
 	// Make sure the readOnly is only set if we aren't in readOnly yet.
 	// This also makes sure that the readOnly flag isn't removed for child calls.
 	if readOnly && !in.readOnly {
@@ -129,6 +232,39 @@ func (in *EVMInterpreter) Run(ctx context.Context, contract *Contract, input []b
 	if len(contract.Code) == 0 {
 		return nil, nil
 	}
+	contract.jumpdestCache = in.jumpdestCache
+
+	// Without the recorded reads the tracer cannot tell the dead writes
+	if in.tracer != nil && in.evm.Config.TrackStorageReads {
+		in.tracer.states.readsTracked = true
+	}
+
+	// The traced changes of a failed frame are dropped as its state is reverted, including
+	// the frames without a call of their own such as the ones of DELEGATECALL and CALLCODE
+	if in.tracer != nil {
+		checkpoint := in.tracer.checkpoint()
+		defer func() {
+			if err != nil {
+				in.tracer.revertToCheckpoint(checkpoint)
+			}
+		}()
+	}
+
+	// Count the executed instructions only if metrics are registered
+	var counts *[256]uint64
+	if m := in.evm.loadMetrics(); m != nil {
+		counts = new([256]uint64)
+		m.startExecution()
+		defer m.endExecution(counts)
+	}
+	// The instructions of this call are counted by the tracer along with the interpreter's
+	var callCounts map[OpCode]uint64
+	if in.opcodeCounts != nil {
+		callCounts = in.tracer.currentOpCounts()
+	}
+	// Only the frames of calls and creations have a node of the call tree, the revert stack of
+	// the other frames, e.g. of DELEGATECALL, would be captured into the node of their caller
+	captureRevertStack := in.evm.Config.CaptureRevertStack && in.tracer != nil && in.tracer.enterFrame()
 
 	var (
 		op          OpCode        // current opcode
@@ -157,6 +293,15 @@ func (in *EVMInterpreter) Run(ctx context.Context, contract *Contract, input []b
 	defer func() {
 		returnStack(stack)
 	}()
+	// Errors are wrapped into an EVMError with the opcode and position they occur at if
+	// enabled. This runs after the deferred EVMLogger, which captures the original error.
+	if in.evm.Config.StructuredErrors {
+		defer func() {
+			if err != nil {
+				err = newEVMError(err, pc, op, in.evm.depth)
+			}
+		}()
+	}
 	contract.Input = input
 
 	if debug {
@@ -170,6 +315,9 @@ func (in *EVMInterpreter) Run(ctx context.Context, contract *Contract, input []b
 			}
 		}()
 	}
+	// The cancellation of the context is polled before each instruction, a context which
+	// is never cancelled is not polled at all
+	done := ctx.Done()
 	// The Interpreter main run loop (contextual). This loop runs until either an
 	// explicit STOP, RETURN or SELFDESTRUCT is executed, an error occurred during
 	// the execution of one of the operations or until the done flag is set by the
@@ -179,9 +327,35 @@ func (in *EVMInterpreter) Run(ctx context.Context, contract *Contract, input []b
 			// Capture pre-execution values for tracing.
 			logged, pcCopy, gasCopy = false, pc, contract.Gas
 		}
+		if done != nil {
+			select {
+			case <-done:
+				return nil, errContextCanceled
+			default:
+			}
+		}
+		if in.evm.Config.EnableCoverage && in.evm.depth == 1 {
+			in.markCovered(pc, len(contract.Code))
+		}
 		// Get the operation from the jump table and validate the stack to ensure there are
 		// enough stack items available to perform the operation.
 		op = contract.GetOp(pc)
+		if counts != nil {
+			counts[op]++
+		}
+		if in.opcodeCounts != nil {
+			in.opcodeCounts[op]++
+			callCounts[op]++
+		}
+		if in.forbidden[op] {
+			return nil, &ErrForbiddenOpcode{opcode: op}
+		}
+		if steps != nil {
+			if *steps >= in.evm.Config.MaxInstructionSteps {
+				return nil, ErrStepLimitExceeded
+			}
+			*steps++
+		}
 		operation := in.table[op]
 		cost = operation.constantGas // For tracing
 		// Validate stack
@@ -216,6 +390,10 @@ func (in *EVMInterpreter) Run(ctx context.Context, contract *Contract, input []b
 			var dynamicCost uint64
 			dynamicCost, err = operation.dynamicGas(in.evm, contract, stack, mem, memorySize)
 			cost += dynamicCost // for tracing
+			if err == ErrMaxInitCodeSizeExceeded {
+				// fails the frame like running out of gas, but keeps the reason
+				return nil, err
+			}
 			if err != nil || !contract.UseGas(dynamicCost) {
 				return nil, ErrOutOfGas
 			}
@@ -234,6 +412,9 @@ func (in *EVMInterpreter) Run(ctx context.Context, contract *Contract, input []b
 		// execute the operation
 		res, err = operation.execute(ctx, &pc, in, callContext)
 		if err != nil {
+			if err != errStopToken && captureRevertStack {
+				in.tracer.SaveRevertStack(stack.Data())
+			}
 			break
 		}
 		pc++
@@ -245,3 +426,27 @@ func (in *EVMInterpreter) Run(ctx context.Context, contract *Contract, input []b
 
 	return res, err
 }
+
+// markCovered sets the coverage bit of the given bytecode position, allocating
+// the bitmap with one bit per position of the code on first use
+func (in *EVMInterpreter) markCovered(pc uint64, codeLen int) {
+	if in.coverage == nil {
+		in.coverage = make([]byte, (codeLen+7)/8)
+	}
+	if pc/8 < uint64(len(in.coverage)) {
+		in.coverage[pc/8] |= 1 << (pc % 8)
+	}
+}
+
+// Coverage returns the bitmap of the executed positions of the latest top level call's
+// contract bytecode, the bit pc%8 of byte pc/8 is set if the position pc is executed.
+// It is only recorded with Config.EnableCoverage.
+func (in *EVMInterpreter) Coverage() []byte {
+	return in.coverage
+}
+
+// OpcodeCounts returns the number of executed instructions by opcode since the
+// interpreter is created or the EVM is reset, nil unless Config.EnableOpcodeCounting is set
+func (in *EVMInterpreter) OpcodeCounts() map[OpCode]uint64 {
+	return in.opcodeCounts
+}
@@ -17,7 +17,9 @@
 package vm
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"math/big"
 	"testing"
 	"time"
@@ -76,3 +78,918 @@ func TestLoopInterrupt(t *testing.T) {
 		}
 	}
 }
+
+func TestLoopContextCancel(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+
+	for i, tt := range loopInterruptTests {
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.CreateAccount(address)
+		statedb.SetCode(address, common.Hex2Bytes(tt))
+		statedb.Finalise(true)
+
+		evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+		evm.CloseAspectCall()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		type result struct {
+			gas uint64
+			err error
+		}
+		resChannel := make(chan result)
+
+		go func(evm *EVM) {
+			_, gas, err := evm.Call(ctx, AccountRef(common.Address{}), address, nil, math.MaxUint64, new(big.Int))
+			resChannel <- result{gas, err}
+		}(evm)
+
+		select {
+		case <-time.After(time.Second):
+			t.Errorf("test %d timed out", i)
+		case res := <-resChannel:
+			if res.err != errContextCanceled {
+				t.Errorf("test %d: expected %v, got %v", i, errContextCanceled, res.err)
+			}
+			if res.gas == 0 {
+				t.Errorf("test %d: remaining gas should be kept", i)
+			}
+		}
+		cancel()
+	}
+}
+
+func TestNestedContextCancel(t *testing.T) {
+	var (
+		caller = common.BytesToAddress([]byte("caller"))
+		callee = common.BytesToAddress([]byte("callee"))
+		vmctx  = BlockContext{
+			Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+			BlockNumber: big0,
+		}
+	)
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	// pop(call(gas, callee, 0, 0, 0, 0, 0)) stop
+	statedb.SetCode(caller, common.Hex2Bytes("60006000600060006000"+"73"+common.Bytes2Hex(callee.Bytes())+"5af150"+"00"))
+	// jumpdest push1 0 jump
+	statedb.SetCode(callee, common.Hex2Bytes("5b600056"))
+	statedb.Finalise(true)
+
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+	evm.CloseAspectCall()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	// the cancellation of the callee aborts the caller instead of failing the call only
+	_, _, err := evm.Call(ctx, AccountRef(common.Address{}), caller, nil, math.MaxUint64, new(big.Int))
+	if err != errContextCanceled {
+		t.Fatalf("expected %v, got %v", errContextCanceled, err)
+	}
+}
+
+// BenchmarkContextCheck measures the cost of polling the cancellation of a context
+// which can be cancelled, against one which cannot and is never polled
+func BenchmarkContextCheck(b *testing.B) {
+	address := common.BytesToAddress([]byte("contract"))
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+	// push2 0xffff jumpdest push1 1 swap1 sub dup1 push1 3 jumpi stop
+	code := common.Hex2Bytes("61ffff" + "5b" + "6001" + "90" + "03" + "80" + "6003" + "57" + "00")
+
+	cancellable, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, bench := range []struct {
+		name string
+		ctx  context.Context
+	}{{"background", context.Background()}, {"cancellable", cancellable}} {
+		b.Run(bench.name, func(b *testing.B) {
+			statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+			statedb.CreateAccount(address)
+			statedb.SetCode(address, code)
+			statedb.Finalise(true)
+
+			evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+			evm.CloseAspectCall()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := evm.Call(bench.ctx, AccountRef(common.Address{}), address, nil, 10000000, new(big.Int)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestRunWithTimeout(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+
+	for i, tt := range loopInterruptTests {
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.CreateAccount(address)
+		statedb.SetCode(address, common.Hex2Bytes(tt))
+		statedb.Finalise(true)
+
+		evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{MaxCallDepth: 1})
+		evm.CloseAspectCall()
+
+		contract := NewContract(AccountRef(common.Address{}), AccountRef(address), new(big.Int), math.MaxUint64)
+		contract.SetCallCode(&address, statedb.GetCodeHash(address), statedb.GetCode(address))
+
+		errChannel := make(chan error)
+		go func() {
+			_, err := evm.interpreter.RunWithTimeout(10*time.Millisecond, contract, nil, false)
+			errChannel <- err
+		}()
+
+		select {
+		case <-time.After(time.Second):
+			t.Fatalf("test %d timed out", i)
+		case err := <-errChannel:
+			if err != context.DeadlineExceeded {
+				t.Errorf("test %d: expected %v, got %v", i, context.DeadlineExceeded, err)
+			}
+		}
+		if contract.Gas == 0 {
+			t.Errorf("test %d: remaining gas should be kept", i)
+		}
+	}
+}
+
+func TestMaxCallDepth(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+	// calls itself with all the gas left: push(0) x5 address gas call stop
+	code := common.Hex2Bytes("60006000600060006000305af100")
+
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.CreateAccount(address)
+	statedb.SetCode(address, code)
+	statedb.Finalise(true)
+
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{MaxCallDepth: 3})
+	evm.CloseAspectCall()
+
+	_, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 10000000, new(big.Int))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the original call is followed by 3 successful recursive calls, the fourth one fails
+	callTree := evm.Tracer().CallTree()
+	for i := uint64(0); i < 4; i++ {
+		if call := callTree.FindCall(i); call == nil || call.Err != nil {
+			t.Fatalf("call %d: expected success, got %+v", i, call)
+		}
+	}
+	if call := callTree.FindCall(4); call == nil || call.Err != ErrDepth {
+		t.Fatalf("expected the fourth recursive call to fail with ErrDepth, got %+v", call)
+	}
+	if call := callTree.FindCall(5); call != nil {
+		t.Fatalf("expected no more calls, got %+v", call)
+	}
+}
+
+// memoryLogger keeps the memory of the last captured execution step
+type memoryLogger struct {
+	memory *Memory
+}
+
+func (l *memoryLogger) CaptureTxStart(gasLimit uint64) {}
+func (l *memoryLogger) CaptureTxEnd(restGas uint64)    {}
+func (l *memoryLogger) CaptureStart(env *EVM, from common.Address, to common.Address, create bool, input []byte, gas uint64, value *big.Int) {
+}
+func (l *memoryLogger) CaptureEnd(output []byte, gasUsed uint64, err error) {}
+func (l *memoryLogger) CaptureEnter(typ OpCode, from common.Address, to common.Address, input []byte, gas uint64, value *big.Int) {
+}
+func (l *memoryLogger) CaptureExit(output []byte, gasUsed uint64, err error) {}
+func (l *memoryLogger) CaptureState(pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+	l.memory = scope.Memory
+}
+func (l *memoryLogger) CaptureFault(pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, depth int, err error) {
+}
+
+func TestMemoryHighWaterMark(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+	// mstore(0x40, 1) mstore(0x20, 1) mstore(0, 1) stop
+	code := common.Hex2Bytes("600160405260016020526001600052" + "00")
+
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.CreateAccount(address)
+	statedb.SetCode(address, code)
+	statedb.Finalise(true)
+
+	logger := new(memoryLogger)
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{Tracer: logger})
+	evm.CloseAspectCall()
+
+	if _, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if logger.memory == nil {
+		t.Fatal("no execution step captured")
+	}
+	if mark := logger.memory.HighWaterMark(); mark != 0x60 {
+		t.Fatalf("expected high water mark %d, got %d", 0x60, mark)
+	}
+}
+
+func TestPush0Shanghai(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	// push0 push0 add stop
+	code := common.Hex2Bytes("5f5f0100")
+
+	shanghaiConfig := *params.AllEthashProtocolChanges
+	shanghaiConfig.ShanghaiTime = new(uint64)
+
+	for i, tt := range []struct {
+		config  *params.ChainConfig
+		eips    []int
+		invalid bool
+	}{
+		{config: &shanghaiConfig},
+		{config: params.AllEthashProtocolChanges, invalid: true},
+		{config: params.AllEthashProtocolChanges, eips: []int{3855}},
+	} {
+		vmctx := BlockContext{
+			Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+			BlockNumber: big0,
+			Random:      &common.Hash{},
+		}
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.CreateAccount(address)
+		statedb.SetCode(address, code)
+		statedb.Finalise(true)
+
+		evm := NewEVM(vmctx, TxContext{}, statedb, tt.config, Config{ExtraEips: tt.eips})
+		evm.CloseAspectCall()
+
+		_, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int))
+		if _, isInvalid := err.(*ErrInvalidOpCode); isInvalid != tt.invalid {
+			t.Errorf("test %d: expected invalid opcode %v, got %v", i, tt.invalid, err)
+		}
+	}
+}
+
+func TestBaseFee(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	// basefee push1 0 mstore push1 32 push1 0 return
+	code := common.Hex2Bytes("4860005260206000f3")
+
+	berlinConfig := *params.AllEthashProtocolChanges
+	berlinConfig.LondonBlock = nil
+	berlinConfig.ArrowGlacierBlock = nil
+	berlinConfig.GrayGlacierBlock = nil
+
+	for i, tt := range []struct {
+		config  *params.ChainConfig
+		eips    []int
+		baseFee *big.Int
+		want    uint64
+		invalid bool
+	}{
+		{config: params.AllEthashProtocolChanges, baseFee: big.NewInt(7), want: 7},
+		{config: params.AllEthashProtocolChanges},
+		{config: &berlinConfig, baseFee: big.NewInt(7), invalid: true},
+		{config: &berlinConfig, eips: []int{3198}},
+	} {
+		vmctx := BlockContext{
+			Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+			BlockNumber: big0,
+			BaseFee:     tt.baseFee,
+		}
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.CreateAccount(address)
+		statedb.SetCode(address, code)
+		statedb.Finalise(true)
+
+		evm := NewEVM(vmctx, TxContext{}, statedb, tt.config, Config{ExtraEips: tt.eips})
+		evm.CloseAspectCall()
+
+		ret, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int))
+		if _, isInvalid := err.(*ErrInvalidOpCode); isInvalid != tt.invalid {
+			t.Fatalf("test %d: expected invalid opcode %v, got %v", i, tt.invalid, err)
+		}
+		if tt.invalid {
+			continue
+		}
+		if have := new(big.Int).SetBytes(ret); have.Uint64() != tt.want {
+			t.Errorf("test %d: have base fee %v, want %d", i, have, tt.want)
+		}
+	}
+}
+
+func TestBlobBaseFee(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	// blobbasefee push1 0 mstore push1 32 push1 0 return
+	code := common.Hex2Bytes("4a60005260206000f3")
+
+	for i, tt := range []struct {
+		eips        []int
+		blobBaseFee *big.Int
+		want        uint64
+		invalid     bool
+	}{
+		{eips: []int{7516}, blobBaseFee: big.NewInt(params.GWei), want: params.GWei},
+		{eips: []int{7516}},
+		{blobBaseFee: big.NewInt(params.GWei), invalid: true},
+	} {
+		vmctx := BlockContext{
+			Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+			BlockNumber: big0,
+			BlobBaseFee: tt.blobBaseFee,
+		}
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.CreateAccount(address)
+		statedb.SetCode(address, code)
+		statedb.Finalise(true)
+
+		evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{ExtraEips: tt.eips})
+		evm.CloseAspectCall()
+
+		ret, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int))
+		if _, isInvalid := err.(*ErrInvalidOpCode); isInvalid != tt.invalid {
+			t.Fatalf("test %d: expected invalid opcode %v, got %v", i, tt.invalid, err)
+		}
+		if tt.invalid {
+			continue
+		}
+		if have := new(big.Int).SetBytes(ret); have.Uint64() != tt.want {
+			t.Errorf("test %d: have blob base fee %v, want %d", i, have, tt.want)
+		}
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+	// push1 6 jump invalid invalid invalid jumpdest stop
+	code := common.Hex2Bytes("600656fefefe5b00")
+
+	for _, enabled := range []bool{false, true} {
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.CreateAccount(address)
+		statedb.SetCode(address, code)
+		statedb.Finalise(true)
+
+		evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{EnableCoverage: enabled})
+		evm.CloseAspectCall()
+
+		if _, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		coverage := evm.Interpreter().Coverage()
+		if !enabled {
+			if coverage != nil {
+				t.Fatalf("expected no coverage, got %x", coverage)
+			}
+			continue
+		}
+		// positions 0, 2, 6 and 7 are executed
+		if len(coverage) != 1 || coverage[0] != 0xc5 {
+			t.Fatalf("unexpected coverage %x", coverage)
+		}
+	}
+}
+
+func TestCoverageTopLevelCalls(t *testing.T) {
+	var (
+		first  = common.BytesToAddress([]byte("first"))
+		second = common.BytesToAddress([]byte("second"))
+	)
+	vmctx := BlockContext{
+		CanTransfer: func(StateDB, common.Address, *big.Int) bool { return true },
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	// push1 6 jump invalid invalid invalid jumpdest stop
+	statedb.SetCode(first, common.Hex2Bytes("600656fefefe5b00"))
+	// push1 0 push1 0 push1 0 push1 0 push1 0 pop pop pop pop pop stop
+	statedb.SetCode(second, common.Hex2Bytes("600060006000600060005050505050"+"00"))
+	statedb.Finalise(true)
+
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{EnableCoverage: true})
+	evm.CloseAspectCall()
+
+	if _, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), first, nil, 100000, new(big.Int)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if coverage := evm.Interpreter().Coverage(); len(coverage) != 1 || coverage[0] != 0xc5 {
+		t.Fatalf("unexpected coverage of the first call %x", coverage)
+	}
+
+	// the second call covers its own 16 positions, the even ones up to 10 and all after
+	if _, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), second, nil, 100000, new(big.Int)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if coverage := evm.Interpreter().Coverage(); !bytes.Equal(coverage, []byte{0x55, 0xfd}) {
+		t.Fatalf("unexpected coverage of the second call %x", coverage)
+	}
+
+	// a creation without init code executes nothing, the previous coverage is dropped
+	if _, _, _, err := evm.Create(context.Background(), AccountRef(common.Address{}), nil, 100000, new(big.Int)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if coverage := evm.Interpreter().Coverage(); coverage != nil {
+		t.Fatalf("unexpected coverage of the creation without code %x", coverage)
+	}
+}
+
+func TestCaptureRevertStack(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+	// push1 1 push1 2 push1 3 revert(0, 0)
+	code := common.Hex2Bytes("600160026003" + "60006000fd")
+
+	for _, enabled := range []bool{false, true} {
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.CreateAccount(address)
+		statedb.SetCode(address, code)
+		statedb.Finalise(true)
+
+		evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{CaptureRevertStack: enabled})
+		evm.CloseAspectCall()
+
+		if _, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int)); err != ErrExecutionReverted {
+			t.Fatalf("expected revert, got %v", err)
+		}
+
+		stack := evm.Tracer().CallTree().Root().RevertStack
+		if !enabled {
+			if stack != nil {
+				t.Fatalf("expected no revert stack, got %v", stack)
+			}
+			continue
+		}
+		if len(stack) != 3 {
+			t.Fatalf("expected revert stack depth 3, got %d", len(stack))
+		}
+		for i, want := range []uint64{1, 2, 3} {
+			if stack[i].Uint64() != want {
+				t.Fatalf("stack item %d: have %d, want %d", i, stack[i].Uint64(), want)
+			}
+		}
+	}
+}
+
+func TestCaptureRevertStackDelegateCall(t *testing.T) {
+	var (
+		caller = common.BytesToAddress([]byte("caller"))
+		callee = common.BytesToAddress([]byte("callee"))
+		vmctx  = BlockContext{
+			Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+			BlockNumber: big0,
+		}
+	)
+	// delegatecall(gas, callee, 0, 0, 0, 0) stop
+	callerCode := common.Hex2Bytes("6000600060006000" + "73" + common.Bytes2Hex(callee.Bytes()) + "5af400")
+	// push1 7 revert(0, 0)
+	calleeCode := common.Hex2Bytes("6007" + "60006000fd")
+
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.SetCode(caller, callerCode)
+	statedb.SetCode(callee, calleeCode)
+	statedb.Finalise(true)
+
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{CaptureRevertStack: true})
+	evm.CloseAspectCall()
+
+	if _, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), caller, nil, 100000, new(big.Int)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// the reverting delegated frame has no call of its own and leaves the caller's untouched
+	root := evm.Tracer().CallTree().Root()
+	if len(root.Children) != 0 {
+		t.Fatalf("expected no child calls, got %d", len(root.Children))
+	}
+	if root.RevertStack != nil {
+		t.Fatalf("expected no revert stack, got %v", root.RevertStack)
+	}
+}
+
+func TestTraceOriginUse(t *testing.T) {
+	var (
+		caller = common.BytesToAddress([]byte("caller"))
+		callee = common.BytesToAddress([]byte("callee"))
+		vmctx  = BlockContext{
+			Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+			BlockNumber: big0,
+		}
+	)
+	// call(gas, callee, 0, 0, 0, 0, 0) stop
+	callerCode := common.Hex2Bytes("60006000600060006000" + "73" + common.Bytes2Hex(callee.Bytes()) + "5af100")
+	// origin pop stop
+	calleeCode := common.Hex2Bytes("325000")
+
+	for _, enabled := range []bool{false, true} {
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.SetCode(caller, callerCode)
+		statedb.SetCode(callee, calleeCode)
+		statedb.Finalise(true)
+
+		evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{TraceOriginUse: enabled})
+		evm.CloseAspectCall()
+
+		if _, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), caller, nil, 100000, new(big.Int)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		callTree := evm.Tracer().CallTree()
+		if callTree.Root().UsesOrigin {
+			t.Fatalf("enabled %v: expected the caller not to be flagged", enabled)
+		}
+		if call := callTree.FindCall(1); call == nil || call.UsesOrigin != enabled {
+			t.Fatalf("enabled %v: expected the callee flagged %v, got %+v", enabled, enabled, call)
+		}
+	}
+}
+
+func TestOpcodeCounting(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+	// sum := 0; for i := 3; i != 0; i-- { sum += i }
+	code := common.Hex2Bytes("60006003" + "5b80156015579081019060019003600456" + "5b00")
+
+	for _, enabled := range []bool{false, true} {
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.CreateAccount(address)
+		statedb.SetCode(address, code)
+		statedb.Finalise(true)
+
+		evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{EnableOpcodeCounting: enabled})
+		evm.CloseAspectCall()
+
+		if _, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int)); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+
+		counts := evm.Interpreter().OpcodeCounts()
+		if !enabled {
+			if counts != nil {
+				t.Fatalf("expected no opcode counts, got %v", counts)
+			}
+			continue
+		}
+		for op, want := range map[OpCode]uint64{ADD: 3, JUMP: 3, JUMPI: 4, JUMPDEST: 5, STOP: 1} {
+			if counts[op] != want {
+				t.Errorf("%v: have %d, want %d", op, counts[op], want)
+			}
+		}
+
+		evm.Reset(TxContext{}, statedb)
+		if counts := evm.Interpreter().OpcodeCounts(); len(counts) != 0 {
+			t.Fatalf("expected opcode counts to be reset, got %v", counts)
+		}
+	}
+}
+
+func TestForbiddenOpcodes(t *testing.T) {
+	vmctx := BlockContext{
+		CanTransfer: func(StateDB, common.Address, *big.Int) bool { return true },
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+	// selfdestruct(address())
+	initCode := common.Hex2Bytes("30ff")
+
+	for _, forbidden := range [][]OpCode{nil, {SELFDESTRUCT}} {
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{ForbiddenOpcodes: forbidden})
+		evm.CloseAspectCall()
+
+		_, _, _, err := evm.Create(context.Background(), AccountRef(common.Address{}), initCode, 100000, new(big.Int))
+		if forbidden == nil {
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			continue
+		}
+		if forbiddenErr, ok := err.(*ErrForbiddenOpcode); !ok || forbiddenErr.opcode != SELFDESTRUCT {
+			t.Fatalf("expected forbidden SELFDESTRUCT, got %v", err)
+		}
+	}
+}
+
+func TestWarmCoinbase(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	coinbase := common.Address{0xc0}
+	// balance(coinbase) pop stop
+	code := []byte{byte(COINBASE), byte(BALANCE), byte(POP), byte(STOP)}
+
+	shanghaiConfig := *params.AllEthashProtocolChanges
+	shanghaiConfig.ShanghaiTime = new(uint64)
+
+	for i, tt := range []struct {
+		config *params.ChainConfig
+		gas    uint64
+	}{
+		{config: &shanghaiConfig, gas: 2 + params.WarmStorageReadCostEIP2929 + 2},
+		{config: params.AllEthashProtocolChanges, gas: 2 + params.ColdAccountAccessCostEIP2929 + 2},
+	} {
+		vmctx := BlockContext{
+			Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+			Coinbase:    coinbase,
+			BlockNumber: big0,
+			Random:      &common.Hash{},
+		}
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.CreateAccount(address)
+		statedb.SetCode(address, code)
+		statedb.Finalise(true)
+
+		evm := NewEVM(vmctx, TxContext{}, statedb, tt.config, Config{})
+		evm.CloseAspectCall()
+		_, leftOverGas, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int))
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %v", i, err)
+		}
+		if used := 100000 - leftOverGas; used != tt.gas {
+			t.Fatalf("test %d: expected gas used %d, got %d", i, tt.gas, used)
+		}
+	}
+}
+
+func TestMaxInstructionSteps(t *testing.T) {
+	var (
+		loop   = common.BytesToAddress([]byte("loop"))
+		caller = common.BytesToAddress([]byte("caller"))
+		callee = common.BytesToAddress([]byte("callee"))
+	)
+	vmctx := BlockContext{
+		CanTransfer: func(StateDB, common.Address, *big.Int) bool { return true },
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+	// jumpdest push1 0 jump
+	loopCode := []byte{byte(JUMPDEST), byte(PUSH1), 0, byte(JUMP)}
+	// call(0xffff, callee, 0, 0, 0, 0, 0) pop stop, 10 steps
+	callerCode := []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH20)}
+	callerCode = append(callerCode, callee.Bytes()...)
+	callerCode = append(callerCode, byte(PUSH2), 0xff, 0xff, byte(CALL), byte(POP), byte(STOP))
+	// 4 x (push1 0 pop) stop, 9 steps
+	calleeCode := []byte{byte(PUSH1), 0, byte(POP), byte(PUSH1), 0, byte(POP), byte(PUSH1), 0, byte(POP), byte(PUSH1), 0, byte(POP), byte(STOP)}
+
+	for i, tt := range []struct {
+		to     common.Address
+		limit  uint64
+		global bool
+		err    error
+	}{
+		{to: loop, limit: 100, err: ErrStepLimitExceeded},
+		{to: caller, limit: 15},
+		{to: caller, limit: 15, global: true, err: ErrStepLimitExceeded},
+		{to: caller, limit: 19, global: true},
+	} {
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.SetCode(loop, loopCode)
+		statedb.SetCode(caller, callerCode)
+		statedb.SetCode(callee, calleeCode)
+		statedb.Finalise(true)
+
+		evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{MaxInstructionSteps: tt.limit, StepLimitIsGlobal: tt.global})
+		evm.CloseAspectCall()
+
+		// the global step counter restarts with every top level call
+		for j := 0; j < 2; j++ {
+			_, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), tt.to, nil, 1000000, new(big.Int))
+			if err != tt.err {
+				t.Fatalf("test %d, call %d: expected error %v, got %v", i, j, tt.err, err)
+			}
+		}
+	}
+}
+
+func TestEVMError(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+	// push1 1 push1 2 push1 3 revert(0, 0)
+	code := common.Hex2Bytes("600160026003" + "60006000fd")
+
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.CreateAccount(address)
+	statedb.SetCode(address, code)
+	statedb.Finalise(true)
+
+	// the errors are returned as they are by default
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+	evm.CloseAspectCall()
+	if _, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int)); err != ErrExecutionReverted {
+		t.Fatalf("expected %v, got %v", ErrExecutionReverted, err)
+	}
+
+	evm = NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{StructuredErrors: true})
+	evm.CloseAspectCall()
+
+	_, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int))
+	if !errors.Is(err, ErrExecutionReverted) {
+		t.Fatalf("expected %v, got %v", ErrExecutionReverted, err)
+	}
+	var evmErr *EVMError
+	if !errors.As(err, &evmErr) {
+		t.Fatalf("expected an EVMError, got %T", err)
+	}
+	if evmErr.Code != ErrorCodeExecutionReverted {
+		t.Fatalf("expected code %d, got %d", ErrorCodeExecutionReverted, evmErr.Code)
+	}
+	if evmErr.PC != 10 || evmErr.OpCode != REVERT || evmErr.CallDepth != 1 {
+		t.Fatalf("unexpected position: pc %d, opcode %v, depth %d", evmErr.PC, evmErr.OpCode, evmErr.CallDepth)
+	}
+	if evmErr.Error() != ErrExecutionReverted.Error() {
+		t.Fatalf("expected message %q, got %q", ErrExecutionReverted.Error(), evmErr.Error())
+	}
+}
+
+// unhashableError is an error of a type which cannot be used as a map key
+type unhashableError []string
+
+func (e unhashableError) Error() string { return "unhashable" }
+
+func TestEVMErrorUnhashable(t *testing.T) {
+	err := newEVMError(unhashableError{"a"}, 1, ADD, 1)
+	var evmErr *EVMError
+	if !errors.As(err, &evmErr) || evmErr.Code != ErrorCodeUnknown {
+		t.Fatalf("expected an EVMError of unknown code, got %v", err)
+	}
+	if err := newEVMError(&ErrStackUnderflow{stackLen: 0, required: 2}, 1, ADD, 1); err.(*EVMError).Code != ErrorCodeStackUnderflow {
+		t.Fatalf("expected code %d, got %d", ErrorCodeStackUnderflow, err.(*EVMError).Code)
+	}
+}
+
+func TestOpcodeAliases(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+	const alias = OpCode(0x0c)
+	// mstore(0, <alias>(3, 2)) return(0, 32)
+	code := []byte{byte(PUSH1), 2, byte(PUSH1), 3, byte(alias), byte(PUSH1), 0, byte(MSTORE), byte(PUSH1), 32, byte(PUSH1), 0, byte(RETURN)}
+	customGas := func(*EVM, *Contract, *Stack, *Memory, uint64) (uint64, error) { return 100, nil }
+
+	tests := []struct {
+		aliases  map[OpCode]OpCode
+		gasFuncs map[OpCode]GasFunc
+		want     uint64 // result, zero if the execution fails
+		extraGas uint64 // gas used on top of the aliased ADD
+	}{
+		{nil, nil, 0, 0},
+		{map[OpCode]OpCode{alias: ADD}, nil, 5, 0},
+		{map[OpCode]OpCode{alias: SUB}, nil, 1, 0},
+		{map[OpCode]OpCode{alias: ADD}, map[OpCode]GasFunc{alias: customGas}, 5, 100},
+	}
+	var addGas uint64
+	for i, tt := range tests {
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.CreateAccount(address)
+		statedb.SetCode(address, code)
+		statedb.Finalise(true)
+
+		evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{OpcodeAliases: tt.aliases, CustomGasFunctions: tt.gasFuncs})
+		evm.CloseAspectCall()
+
+		ret, leftOverGas, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int))
+		if tt.want == 0 {
+			if !errors.As(err, new(*ErrInvalidOpCode)) {
+				t.Fatalf("test %d: expected invalid opcode, got %v", i, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("test %d: unexpected error: %v", i, err)
+		}
+		if have := new(big.Int).SetBytes(ret); have.Uint64() != tt.want {
+			t.Fatalf("test %d: expected %d, got %d", i, tt.want, have)
+		}
+		used := 100000 - leftOverGas
+		if addGas == 0 {
+			addGas = used
+		}
+		if used != addGas+tt.extraGas {
+			t.Fatalf("test %d: expected %d gas used, got %d", i, addGas+tt.extraGas, used)
+		}
+	}
+
+	// terminating opcodes cannot be remapped
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic on the alias of RETURN")
+		}
+	}()
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{OpcodeAliases: map[OpCode]OpCode{alias: ADD, RETURN: STOP}})
+}
+
+func TestJournalOpcodesStackUnderflow(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+
+	for _, tt := range []struct {
+		op       OpCode
+		required int
+	}{
+		{RSVJNAL, 3}, {VSVJNAL, 4}, {IRVVJNAL, 6}, {IRVRJNAL, 5},
+		{IVVVJNAL, 6}, {IVVRJNAL, 5}, {VVJNAL, 4}, {VRJNAL, 2},
+	} {
+		// one stack item short of the requirement
+		var code []byte
+		for i := 0; i < tt.required-1; i++ {
+			code = append(code, byte(PUSH1), 0)
+		}
+		code = append(code, byte(tt.op))
+
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.SetCode(address, code)
+		statedb.Finalise(true)
+
+		evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+		evm.CloseAspectCall()
+		_, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int))
+
+		var underflow *ErrStackUnderflow
+		if !errors.As(err, &underflow) {
+			t.Fatalf("%v: expected a stack underflow, got %v", tt.op, err)
+		}
+		if underflow.stackLen != tt.required-1 || underflow.required != tt.required {
+			t.Fatalf("%v: unexpected underflow %v", tt.op, underflow)
+		}
+	}
+}
+
+// opcodeLogger records the executed steps, its other hooks are no-ops
+type opcodeLogger struct {
+	memoryLogger
+	ops    []OpCode
+	pcs    []uint64
+	depths []int
+}
+
+func (l *opcodeLogger) CaptureState(pc uint64, op OpCode, gas, cost uint64, scope *ScopeContext, rData []byte, depth int, err error) {
+	l.ops = append(l.ops, op)
+	l.pcs = append(l.pcs, pc)
+	l.depths = append(l.depths, depth)
+}
+
+func TestCaptureStateSteps(t *testing.T) {
+	address := common.BytesToAddress([]byte("contract"))
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+	// pop(add(1, 2)) stop
+	code := []byte{byte(PUSH1), 1, byte(PUSH1), 2, byte(ADD), byte(POP), byte(STOP)}
+
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.SetCode(address, code)
+	statedb.Finalise(true)
+
+	logger := new(opcodeLogger)
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{Tracer: logger})
+	evm.CloseAspectCall()
+	if _, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedOps := []OpCode{PUSH1, PUSH1, ADD, POP, STOP}
+	expectedPcs := []uint64{0, 2, 4, 5, 6}
+	if len(logger.ops) != len(expectedOps) {
+		t.Fatalf("expected %d steps, got %v", len(expectedOps), logger.ops)
+	}
+	for i, op := range expectedOps {
+		if logger.ops[i] != op || logger.pcs[i] != expectedPcs[i] || logger.depths[i] != 1 {
+			t.Fatalf("step %d: expected %v at pc %d depth 1, got %v at pc %d depth %d", i, op, expectedPcs[i], logger.ops[i], logger.pcs[i], logger.depths[i])
+		}
+	}
+}
@@ -23,9 +23,13 @@ import (
 	"github.com/ethereum/go-ethereum/params"
 )
 
+// GasFunc calculates the dynamic gas of an operation, such as the ones overriding it
+// with Config.CustomGasFunctions. The last parameter is the requested memory size.
+type GasFunc func(*EVM, *Contract, *Stack, *Memory, uint64) (uint64, error)
+
 type (
 	executionFunc func(ctx context.Context, pc *uint64, interpreter *EVMInterpreter, callContext *ScopeContext) ([]byte, error)
-	gasFunc       func(*EVM, *Contract, *Stack, *Memory, uint64) (uint64, error) // last parameter is the requested memory size as a uint64
+	gasFunc       = GasFunc // last parameter is the requested memory size as a uint64
 	// memorySizeFunc returns the required size, and whether the operation overflowed a uint64
 	memorySizeFunc func(*Stack) (size uint64, overflow bool)
 )
@@ -1115,6 +1119,18 @@ func newFrontierInstructionSet() JumpTable {
 	return validate(tbl)
 }
 
+// aliasOpcode remaps alias to a copy of the operation of target in base. STOP, RETURN
+// and REVERT cannot be remapped, as the execution could not terminate as expected.
+func aliasOpcode(table, base *JumpTable, alias, target OpCode) error {
+	switch alias {
+	case STOP, RETURN, REVERT:
+		return fmt.Errorf("opcode %v cannot be aliased", alias)
+	}
+	op := *base[target]
+	table[alias] = &op
+	return nil
+}
+
 func copyJumpTable(source *JumpTable) *JumpTable {
 	dest := *source
 	for i, op := range source {
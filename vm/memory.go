@@ -22,8 +22,9 @@ import (
 
 // Memory implements a simple memory model for the ethereum virtual machine.
 type Memory struct {
-	store       []byte
-	lastGasCost uint64
+	store         []byte
+	lastGasCost   uint64
+	highWaterMark int
 }
 
 // NewMemory returns a new memory model.
@@ -63,35 +64,50 @@ func (m *Memory) Resize(size uint64) {
 	if uint64(m.Len()) < size {
 		m.store = append(m.store, make([]byte, size-uint64(m.Len()))...)
 	}
+	if m.Len() > m.highWaterMark {
+		m.highWaterMark = m.Len()
+	}
 }
 
-// GetCopy returns offset + size as a new slice
-func (m *Memory) GetCopy(offset, size int64) (cpy []byte) {
-	if size == 0 {
-		return nil
-	}
+// HighWaterMark returns the peak size the memory has been resized to
+func (m *Memory) HighWaterMark() int {
+	return m.highWaterMark
+}
 
-	if len(m.store) > int(offset) {
-		cpy = make([]byte, size)
-		copy(cpy, m.store[offset:offset+size])
+// GetRange returns the offset + size, or ErrMemoryOutOfBounds if the range is
+// negative or exceeds the memory
+func (m *Memory) GetRange(offset, size int64) ([]byte, error) {
+	if offset < 0 || size < 0 || offset > int64(len(m.store))-size {
+		return nil, ErrMemoryOutOfBounds
+	}
+	return m.store[offset : offset+size], nil
+}
 
-		return
+// GetCopy returns offset + size as a new slice, like GetPtr
+func (m *Memory) GetCopy(offset, size int64) (cpy []byte) {
+	ptr := m.GetPtr(offset, size)
+	if ptr == nil {
+		return nil
 	}
 
+	cpy = make([]byte, size)
+	copy(cpy, ptr)
 	return
 }
 
-// GetPtr returns the offset + size
+// GetPtr returns the offset + size, nil if size is 0 or the range starts past the memory.
+// It panics with ErrMemoryOutOfBounds if the range is otherwise out of the memory, which
+// must have been expanded to cover it.
 func (m *Memory) GetPtr(offset, size int64) []byte {
-	if size == 0 {
+	if size == 0 || int64(len(m.store)) <= offset {
 		return nil
 	}
 
-	if len(m.store) > int(offset) {
-		return m.store[offset : offset+size]
+	ptr, err := m.GetRange(offset, size)
+	if err != nil {
+		panic(err)
 	}
-
-	return nil
+	return ptr
 }
 
 // Len returns the length of the backing slice
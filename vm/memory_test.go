@@ -0,0 +1,67 @@
+package vm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMemoryGetRange(t *testing.T) {
+	mem := NewMemory()
+	mem.Resize(64)
+	mem.Set(30, 4, []byte{1, 2, 3, 4})
+
+	for i, test := range []struct {
+		offset, size int64
+		want         []byte
+		err          error
+	}{
+		{30, 4, []byte{1, 2, 3, 4}, nil},
+		{64, 0, []byte{}, nil},
+		{60, 4, []byte{0, 0, 0, 0}, nil},
+		{61, 4, nil, ErrMemoryOutOfBounds},
+		{64, 1, nil, ErrMemoryOutOfBounds},
+		{-1, 2, nil, ErrMemoryOutOfBounds},
+		{0, -1, nil, ErrMemoryOutOfBounds},
+		{1, 1<<63 - 1, nil, ErrMemoryOutOfBounds},
+	} {
+		got, err := mem.GetRange(test.offset, test.size)
+		if err != test.err {
+			t.Fatalf("test %d: expected error %v, got %v", i, test.err, err)
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Fatalf("test %d: expected %x, got %x", i, test.want, got)
+		}
+	}
+
+	if got := mem.GetCopy(30, 4); !bytes.Equal(got, []byte{1, 2, 3, 4}) {
+		t.Fatalf("expected 01020304, got %x", got)
+	}
+}
+
+func TestMemoryGetOutOfRange(t *testing.T) {
+	mem := NewMemory()
+	mem.Resize(64)
+
+	// a range starting past the memory is empty
+	if got := mem.GetPtr(64, 4); got != nil {
+		t.Fatalf("expected nil for a pointer past the memory, got %x", got)
+	}
+	if got := mem.GetCopy(64, 4); got != nil {
+		t.Fatalf("expected nil for a copy past the memory, got %x", got)
+	}
+
+	// a range partially out of the memory panics, it must have been expanded before
+	for name, get := range map[string]func(){
+		"GetPtr":  func() { mem.GetPtr(61, 4) },
+		"GetCopy": func() { mem.GetCopy(61, 4) },
+	} {
+		func() {
+			defer func() {
+				if err := recover(); err != ErrMemoryOutOfBounds {
+					t.Fatalf("%s: expected a panic with %v, got %v", name, ErrMemoryOutOfBounds, err)
+				}
+			}()
+			get()
+		}()
+	}
+}
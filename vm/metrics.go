@@ -0,0 +1,88 @@
+package vm
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// evmMetrics holds the registered metrics, nil if metrics are not registered
+var evmMetrics atomic.Pointer[metrics]
+
+// metrics are the prometheus collectors of the EVM execution
+type metrics struct {
+	instructions     *prometheus.CounterVec
+	gasUsedPerTx     prometheus.Histogram
+	reverts          prometheus.Counter
+	activeExecutions prometheus.Gauge
+}
+
+// RegisterMetrics registers the EVM execution metrics to the given registry. Metrics
+// are not collected until registered, a nil registry leaves them disabled.
+func RegisterMetrics(reg prometheus.Registerer) error {
+	if reg == nil {
+		return nil
+	}
+
+	m := &metrics{
+		instructions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "evm_instructions_total",
+			Help: "Number of instructions executed by the EVM interpreter",
+		}, []string{"opcode"}),
+		gasUsedPerTx: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "evm_gas_used_per_tx",
+			Help:    "Gas used by the top level calls",
+			Buckets: prometheus.ExponentialBuckets(21000, 2, 12),
+		}),
+		reverts: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "evm_reverts_total",
+			Help: "Number of calls reverted",
+		}),
+		activeExecutions: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "evm_active_executions",
+			Help: "Number of contract executions in progress",
+		}),
+	}
+	for _, collector := range []prometheus.Collector{m.instructions, m.gasUsedPerTx, m.reverts, m.activeExecutions} {
+		if err := reg.Register(collector); err != nil {
+			return err
+		}
+	}
+
+	evmMetrics.Store(m)
+	return nil
+}
+
+// loadMetrics returns the registered metrics, nil if metrics are not registered or disabled for the EVM
+func (evm *EVM) loadMetrics() *metrics {
+	if evm.noMetrics {
+		return nil
+	}
+	return evmMetrics.Load()
+}
+
+// startExecution marks a contract execution in progress
+func (m *metrics) startExecution() {
+	m.activeExecutions.Inc()
+}
+
+// endExecution adds the instructions counted during a contract execution
+func (m *metrics) endExecution(counts *[256]uint64) {
+	m.activeExecutions.Dec()
+	for op, count := range counts {
+		if count > 0 {
+			m.instructions.WithLabelValues(OpCode(op).String()).Add(float64(count))
+		}
+	}
+}
+
+// observeCall records the gas used by a top level call and whether a call is reverted
+func (m *metrics) observeCall(depth int, gas, leftOverGas uint64, err error) {
+	if depth == 0 {
+		m.gasUsedPerTx.Observe(float64(gas - leftOverGas))
+	}
+	if errors.Is(err, ErrExecutionReverted) {
+		m.reverts.Inc()
+	}
+}
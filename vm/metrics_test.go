@@ -0,0 +1,80 @@
+package vm
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+// gatherMetric returns the metric of the given name and labels gathered from the registry
+func gatherMetric(t *testing.T, reg *prometheus.Registry, name string, labels map[string]string) *dto.Metric {
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+			return metric
+		}
+	}
+	t.Fatalf("metric %s%v not found", name, labels)
+	return nil
+}
+
+func TestMetrics(t *testing.T) {
+	require.NoError(t, RegisterMetrics(nil))
+
+	reg := prometheus.NewRegistry()
+	require.NoError(t, RegisterMetrics(reg))
+	defer evmMetrics.Store(nil)
+
+	address := common.BytesToAddress([]byte("contract"))
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+	// revert(0, 0)
+	code := common.Hex2Bytes("60006000fd")
+
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.CreateAccount(address)
+	statedb.SetCode(address, code)
+	statedb.Finalise(true)
+
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+	evm.CloseAspectCall()
+	_, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), address, nil, 100000, new(big.Int))
+	require.Equal(t, ErrExecutionReverted, err)
+
+	require.Equal(t, float64(2), gatherMetric(t, reg, "evm_instructions_total", map[string]string{"opcode": "PUSH1"}).GetCounter().GetValue())
+	require.Equal(t, float64(1), gatherMetric(t, reg, "evm_instructions_total", map[string]string{"opcode": "REVERT"}).GetCounter().GetValue())
+	require.Equal(t, float64(1), gatherMetric(t, reg, "evm_reverts_total", nil).GetCounter().GetValue())
+	require.Equal(t, float64(0), gatherMetric(t, reg, "evm_active_executions", nil).GetGauge().GetValue())
+	require.Equal(t, uint64(1), gatherMetric(t, reg, "evm_gas_used_per_tx", nil).GetHistogram().GetSampleCount())
+
+	// the attempts of the gas estimation are not measured
+	_, err = evm.EstimateGas(context.Background(), AccountRef(common.Address{}), address, nil, new(big.Int))
+	require.Equal(t, ErrExecutionReverted, err)
+	require.Equal(t, float64(2), gatherMetric(t, reg, "evm_instructions_total", map[string]string{"opcode": "PUSH1"}).GetCounter().GetValue())
+	require.Equal(t, float64(1), gatherMetric(t, reg, "evm_reverts_total", nil).GetCounter().GetValue())
+	require.Equal(t, uint64(1), gatherMetric(t, reg, "evm_gas_used_per_tx", nil).GetHistogram().GetSampleCount())
+
+	// registering the same metrics twice fails
+	require.Error(t, RegisterMetrics(reg))
+}
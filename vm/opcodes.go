@@ -100,6 +100,7 @@ const (
 	CHAINID     OpCode = 0x46
 	SELFBALANCE OpCode = 0x47
 	BASEFEE     OpCode = 0x48
+	BLOBBASEFEE OpCode = 0x4a
 )
 
 // 0x50 range - 'storage' and execution.
@@ -207,6 +208,11 @@ const (
 	LOG4
 )
 
+// 0xb0 range - custom storage ops.
+const (
+	SLOADBATCH OpCode = 0xb0
+)
+
 // 0xe0 range - tracer related ops
 const (
 	RSVJNAL OpCode = 0xe0 + iota
@@ -227,7 +233,8 @@ const (
 	RETURN       OpCode = 0xf3
 	DELEGATECALL OpCode = 0xf4
 	CREATE2      OpCode = 0xf5
-
+	AUTH         OpCode = 0xf6
+	AUTHCALL     OpCode = 0xf7
 	STATICCALL   OpCode = 0xfa
 	REVERT       OpCode = 0xfd
 	INVALID      OpCode = 0xfe
@@ -297,6 +304,7 @@ var opCodeToString = map[OpCode]string{
 	CHAINID:     "CHAINID",
 	SELFBALANCE: "SELFBALANCE",
 	BASEFEE:     "BASEFEE",
+	BLOBBASEFEE: "BLOBBASEFEE",
 
 	// 0x50 range - 'storage' and execution.
 	POP:      "POP",
@@ -403,6 +411,9 @@ var opCodeToString = map[OpCode]string{
 	VVJNAL:   "VVJNAL",
 	VRJNAL:   "VRJNAL",
 
+	// 0xb0 range - custom storage ops.
+	SLOADBATCH: "SLOADBATCH",
+
 	// 0xf0 range - closures.
 	CREATE:       "CREATE",
 	CALL:         "CALL",
@@ -410,6 +421,8 @@ var opCodeToString = map[OpCode]string{
 	CALLCODE:     "CALLCODE",
 	DELEGATECALL: "DELEGATECALL",
 	CREATE2:      "CREATE2",
+	AUTH:         "AUTH",
+	AUTHCALL:     "AUTHCALL",
 	STATICCALL:   "STATICCALL",
 	REVERT:       "REVERT",
 	INVALID:      "INVALID",
@@ -463,6 +476,7 @@ var stringToOp = map[string]OpCode{
 	"CALLDATACOPY":   CALLDATACOPY,
 	"CHAINID":        CHAINID,
 	"BASEFEE":        BASEFEE,
+	"BLOBBASEFEE":    BLOBBASEFEE,
 	"DELEGATECALL":   DELEGATECALL,
 	"STATICCALL":     STATICCALL,
 	"CODESIZE":       CODESIZE,
@@ -573,11 +587,14 @@ var stringToOp = map[string]OpCode{
 	"IVVRJNAL":       IVVRJNAL,
 	"VVJNAL":         VVJNAL,
 	"VRJNAL":         VRJNAL,
+	"SLOADBATCH":     SLOADBATCH,
 	"CREATE":         CREATE,
 	"CREATE2":        CREATE2,
 	"CALL":           CALL,
 	"RETURN":         RETURN,
 	"CALLCODE":       CALLCODE,
+	"AUTH":           AUTH,
+	"AUTHCALL":       AUTHCALL,
 	"REVERT":         REVERT,
 	"INVALID":        INVALID,
 	"SELFDESTRUCT":   SELFDESTRUCT,
@@ -37,6 +37,7 @@ func makeGasSStoreFunc(clearingRefund uint64) gasFunc {
 			current = evm.StateDB.GetState(contract.Address(), slot)
 			cost    = uint64(0)
 		)
+		evm.tracer.SaveAccessedSlot(contract.Address(), slot)
 		// Check slot presence in the access list
 		if addrPresent, slotPresent := evm.StateDB.SlotInAccessList(contract.Address(), slot); !slotPresent {
 			cost = params.ColdSloadCostEIP2929
@@ -103,6 +104,7 @@ func makeGasSStoreFunc(clearingRefund uint64) gasFunc {
 func gasSLoadEIP2929(evm *EVM, contract *Contract, stack *Stack, mem *Memory, memorySize uint64) (uint64, error) {
 	loc := stack.peek()
 	slot := common.Hash(loc.Bytes32())
+	evm.tracer.SaveAccessedSlot(contract.Address(), slot)
 	// Check slot presence in the access list
 	if _, slotPresent := evm.StateDB.SlotInAccessList(contract.Address(), slot); !slotPresent {
 		// If the caller cannot afford the cost, this change will be rolled back
@@ -113,6 +115,37 @@ func gasSLoadEIP2929(evm *EVM, contract *Contract, stack *Stack, mem *Memory, me
 	return params.WarmStorageReadCostEIP2929, nil
 }
 
+// gasSloadBatch calculates the gas of SLOADBATCH on top of its constant cost, each slot is
+// charged as an EIP-2929 SLOAD and a slot repeated in the batch is warm after its first
+// read. The slots are only added to the access list by the execution.
+func gasSloadBatch(evm *EVM, contract *Contract, stack *Stack, mem *Memory, memorySize uint64) (uint64, error) {
+	n, ok := sloadBatchCount(stack)
+	if !ok {
+		// the execution fails with ErrStackUnderflow
+		return 0, nil
+	}
+
+	var (
+		gas  uint64
+		cold map[common.Hash]struct{} // slots charged as cold in the batch
+	)
+	for i := 1; i <= n; i++ {
+		slot := common.Hash(stack.Back(i).Bytes32())
+		if _, slotPresent := evm.StateDB.SlotInAccessList(contract.Address(), slot); slotPresent {
+			gas += params.WarmStorageReadCostEIP2929
+		} else if _, read := cold[slot]; read {
+			gas += params.WarmStorageReadCostEIP2929
+		} else {
+			if cold == nil {
+				cold = make(map[common.Hash]struct{}, n)
+			}
+			cold[slot] = struct{}{}
+			gas += params.ColdSloadCostEIP2929
+		}
+	}
+	return gas, nil
+}
+
 // gasExtCodeCopyEIP2929 implements extcodecopy according to EIP-2929
 // EIP spec:
 // > If the target is not in accessed_addresses,
@@ -125,6 +158,7 @@ func gasExtCodeCopyEIP2929(evm *EVM, contract *Contract, stack *Stack, mem *Memo
 		return 0, err
 	}
 	addr := common.Address(stack.peek().Bytes20())
+	evm.tracer.SaveAccessedAddress(addr)
 	// Check slot presence in the access list
 	if !evm.StateDB.AddressInAccessList(addr) {
 		evm.StateDB.AddAddressToAccessList(addr)
@@ -147,6 +181,7 @@ func gasExtCodeCopyEIP2929(evm *EVM, contract *Contract, stack *Stack, mem *Memo
 // - (ext) balance
 func gasEip2929AccountCheck(evm *EVM, contract *Contract, stack *Stack, mem *Memory, memorySize uint64) (uint64, error) {
 	addr := common.Address(stack.peek().Bytes20())
+	evm.tracer.SaveAccessedAddress(addr)
 	// Check slot presence in the access list
 	if !evm.StateDB.AddressInAccessList(addr) {
 		// If the caller cannot afford the cost, this change will be rolled back
@@ -160,6 +195,7 @@ func gasEip2929AccountCheck(evm *EVM, contract *Contract, stack *Stack, mem *Mem
 func makeCallVariantGasCallEIP2929(oldCalculator gasFunc) gasFunc {
 	return func(evm *EVM, contract *Contract, stack *Stack, mem *Memory, memorySize uint64) (uint64, error) {
 		addr := common.Address(stack.Back(1).Bytes20())
+		evm.tracer.SaveAccessedAddress(addr)
 		// Check slot presence in the access list
 		warmAccess := evm.StateDB.AddressInAccessList(addr)
 		// The WarmStorageReadCostEIP2929 (100) is already deducted in the form of a constant cost, so
@@ -226,6 +262,7 @@ func makeSelfdestructGasFn(refundsEnabled bool) gasFunc {
 			gas     uint64
 			address = common.Address(stack.peek().Bytes20())
 		)
+		evm.tracer.SaveAccessedAddress(address)
 		if !evm.StateDB.AddressInAccessList(address) {
 			// If the caller cannot afford the cost, this change will be rolled back
 			evm.StateDB.AddAddressToAccessList(address)
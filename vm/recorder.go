@@ -0,0 +1,492 @@
+package vm
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// RecordingVersion is the schema version of the recordings made by the EVMRecorder,
+// recordings of a newer version are rejected by the EVMReplayer
+const RecordingVersion = 1
+
+// kinds of the state writes in a recording
+const (
+	writeCreateAccount = "createAccount"
+	writeAddBalance    = "addBalance"
+	writeSubBalance    = "subBalance"
+	writeNonce         = "setNonce"
+	writeCode          = "setCode"
+	writeState         = "setState"
+	writeSuicide       = "suicide"
+)
+
+// Recording is the JSON-serializable record of the executions of an EVMRecorder. It holds
+// everything read by the executions from outside the EVM, so that they can be replayed
+// without the original state.
+type Recording struct {
+	Version     uint                                `json:"version"`
+	ChainConfig *params.ChainConfig                 `json:"chainConfig"`
+	Block       RecordedBlock                       `json:"block"`
+	Tx          RecordedTx                          `json:"tx"`
+	Prepare     *RecordedPrepare                    `json:"prepare,omitempty"`
+	Accounts    map[common.Address]*RecordedAccount `json:"accounts"`
+	Calls       []*RecordedCall                     `json:"calls"`
+	Writes      []RecordedWrite                     `json:"writes"`
+}
+
+// RecordedBlock is the block context of a recording, with the block hashes looked up
+// by the executions
+type RecordedBlock struct {
+	Coinbase    common.Address         `json:"coinbase"`
+	GasLimit    hexutil.Uint64         `json:"gasLimit"`
+	Number      *hexutil.Big           `json:"number"`
+	Time        hexutil.Uint64         `json:"time"`
+	Difficulty  *hexutil.Big           `json:"difficulty,omitempty"`
+	BaseFee     *hexutil.Big           `json:"baseFee,omitempty"`
+	BlobBaseFee *hexutil.Big           `json:"blobBaseFee,omitempty"`
+	Random      *common.Hash           `json:"random,omitempty"`
+	Hashes      map[uint64]common.Hash `json:"hashes,omitempty"`
+}
+
+// RecordedTx is the transaction context of a recording
+type RecordedTx struct {
+	Origin   common.Address `json:"origin"`
+	GasPrice *hexutil.Big   `json:"gasPrice,omitempty"`
+}
+
+// RecordedPrepare holds the arguments of the StateDB.Prepare call of a recording
+type RecordedPrepare struct {
+	Sender      common.Address   `json:"sender"`
+	Coinbase    common.Address   `json:"coinbase"`
+	Dest        *common.Address  `json:"dest,omitempty"`
+	Precompiles []common.Address `json:"precompiles,omitempty"`
+	AccessList  types.AccessList `json:"accessList,omitempty"`
+}
+
+// RecordedAccount is the state of an account when it was first accessed, with the
+// storage slots read or written by the executions
+type RecordedAccount struct {
+	Exists  bool                        `json:"exists"`
+	Balance *hexutil.Big                `json:"balance,omitempty"`
+	Nonce   hexutil.Uint64              `json:"nonce,omitempty"`
+	Code    hexutil.Bytes               `json:"code,omitempty"`
+	Storage map[common.Hash]common.Hash `json:"storage,omitempty"`
+}
+
+// RecordedCall is a top level call or create of a recording and its outcome, To is nil
+// for a create
+type RecordedCall struct {
+	Caller      common.Address  `json:"caller"`
+	To          *common.Address `json:"to,omitempty"`
+	Input       hexutil.Bytes   `json:"input"`
+	Gas         hexutil.Uint64  `json:"gas"`
+	Value       *hexutil.Big    `json:"value"`
+	Output      hexutil.Bytes   `json:"output"`
+	LeftOverGas hexutil.Uint64  `json:"leftOverGas"`
+	Err         string          `json:"error,omitempty"`
+}
+
+// RecordedWrite is a write to the StateDB, the key is only set for storage writes and
+// the value holds the big-endian amount, nonce, code or storage value written
+type RecordedWrite struct {
+	Kind    string         `json:"kind"`
+	Address common.Address `json:"address"`
+	Key     *common.Hash   `json:"key,omitempty"`
+	Value   hexutil.Bytes  `json:"value,omitempty"`
+}
+
+// equal returns whether the writes are the same, ignoring the nil and empty values
+// made indistinguishable by the JSON encoding
+func (w RecordedWrite) equal(other RecordedWrite) bool {
+	if w.Kind != other.Kind || w.Address != other.Address || !bytes.Equal(w.Value, other.Value) {
+		return false
+	}
+	if w.Key == nil || other.Key == nil {
+		return w.Key == other.Key
+	}
+	return *w.Key == *other.Key
+}
+
+// recordingStateDB is a StateDB saving the state of the accounts and storage slots to a
+// recording on their first access, and the writes made to the wrapped StateDB
+type recordingStateDB struct {
+	StateDB
+	recording *Recording
+}
+
+// touch saves the state of an account if it is accessed for the first time
+func (db *recordingStateDB) touch(addr common.Address) *RecordedAccount {
+	if account, ok := db.recording.Accounts[addr]; ok {
+		return account
+	}
+
+	account := &RecordedAccount{Storage: make(map[common.Hash]common.Hash)}
+	if db.StateDB.Exist(addr) {
+		account.Exists = true
+		account.Balance = toHexBig(db.StateDB.GetBalance(addr))
+		account.Nonce = hexutil.Uint64(db.StateDB.GetNonce(addr))
+		account.Code = common.CopyBytes(db.StateDB.GetCode(addr))
+	}
+	db.recording.Accounts[addr] = account
+	return account
+}
+
+// touchSlot saves the value of a storage slot if it is accessed for the first time
+func (db *recordingStateDB) touchSlot(addr common.Address, key common.Hash) {
+	account := db.touch(addr)
+	if _, ok := account.Storage[key]; !ok {
+		account.Storage[key] = db.StateDB.GetState(addr, key)
+	}
+}
+
+func (db *recordingStateDB) write(kind string, addr common.Address, key *common.Hash, value []byte) {
+	db.recording.Writes = append(db.recording.Writes, RecordedWrite{
+		Kind:    kind,
+		Address: addr,
+		Key:     key,
+		Value:   common.CopyBytes(value),
+	})
+}
+
+func (db *recordingStateDB) CreateAccount(addr common.Address) {
+	db.touch(addr)
+	db.write(writeCreateAccount, addr, nil, nil)
+	db.StateDB.CreateAccount(addr)
+}
+
+func (db *recordingStateDB) SubBalance(addr common.Address, amount *big.Int) {
+	db.touch(addr)
+	db.write(writeSubBalance, addr, nil, amount.Bytes())
+	db.StateDB.SubBalance(addr, amount)
+}
+
+func (db *recordingStateDB) AddBalance(addr common.Address, amount *big.Int) {
+	db.touch(addr)
+	db.write(writeAddBalance, addr, nil, amount.Bytes())
+	db.StateDB.AddBalance(addr, amount)
+}
+
+func (db *recordingStateDB) GetBalance(addr common.Address) *big.Int {
+	db.touch(addr)
+	return db.StateDB.GetBalance(addr)
+}
+
+func (db *recordingStateDB) GetNonce(addr common.Address) uint64 {
+	db.touch(addr)
+	return db.StateDB.GetNonce(addr)
+}
+
+func (db *recordingStateDB) SetNonce(addr common.Address, nonce uint64) {
+	db.touch(addr)
+	db.write(writeNonce, addr, nil, new(big.Int).SetUint64(nonce).Bytes())
+	db.StateDB.SetNonce(addr, nonce)
+}
+
+func (db *recordingStateDB) GetCodeHash(addr common.Address) common.Hash {
+	db.touch(addr)
+	return db.StateDB.GetCodeHash(addr)
+}
+
+func (db *recordingStateDB) GetCode(addr common.Address) []byte {
+	db.touch(addr)
+	return db.StateDB.GetCode(addr)
+}
+
+func (db *recordingStateDB) SetCode(addr common.Address, code []byte) {
+	db.touch(addr)
+	db.write(writeCode, addr, nil, code)
+	db.StateDB.SetCode(addr, code)
+}
+
+func (db *recordingStateDB) GetCodeSize(addr common.Address) int {
+	db.touch(addr)
+	return db.StateDB.GetCodeSize(addr)
+}
+
+func (db *recordingStateDB) GetCommittedState(addr common.Address, key common.Hash) common.Hash {
+	db.touchSlot(addr, key)
+	return db.StateDB.GetCommittedState(addr, key)
+}
+
+func (db *recordingStateDB) GetState(addr common.Address, key common.Hash) common.Hash {
+	db.touchSlot(addr, key)
+	return db.StateDB.GetState(addr, key)
+}
+
+func (db *recordingStateDB) SetState(addr common.Address, key, value common.Hash) {
+	db.touchSlot(addr, key)
+	db.write(writeState, addr, &key, value.Bytes())
+	db.StateDB.SetState(addr, key, value)
+}
+
+func (db *recordingStateDB) Suicide(addr common.Address) bool {
+	db.touch(addr)
+	db.write(writeSuicide, addr, nil, nil)
+	return db.StateDB.Suicide(addr)
+}
+
+func (db *recordingStateDB) HasSuicided(addr common.Address) bool {
+	db.touch(addr)
+	return db.StateDB.HasSuicided(addr)
+}
+
+func (db *recordingStateDB) Exist(addr common.Address) bool {
+	db.touch(addr)
+	return db.StateDB.Exist(addr)
+}
+
+func (db *recordingStateDB) Empty(addr common.Address) bool {
+	db.touch(addr)
+	return db.StateDB.Empty(addr)
+}
+
+func (db *recordingStateDB) Prepare(rules params.Rules, sender, coinbase common.Address, dest *common.Address, precompiles []common.Address, txAccesses types.AccessList) {
+	db.recording.Prepare = &RecordedPrepare{
+		Sender:      sender,
+		Coinbase:    coinbase,
+		Dest:        dest,
+		Precompiles: precompiles,
+		AccessList:  txAccesses,
+	}
+	db.StateDB.Prepare(rules, sender, coinbase, dest, precompiles, txAccesses)
+}
+
+// EVMRecorder wraps an EVM and records the state and block hashes read by its executions,
+// the writes made to the state and the inputs and outputs of the top level calls, so that
+// the executions can be reproduced by an EVMReplayer. The recording is expected to start
+// at the beginning of a transaction, the aspect join points are not recorded.
+type EVMRecorder struct {
+	evm       *EVM
+	recording *Recording
+}
+
+// NewEVMRecorder returns an EVMRecorder executing with a new EVM on the given StateDB
+func NewEVMRecorder(blockCtx BlockContext, txCtx TxContext, statedb StateDB, chainConfig *params.ChainConfig, config Config) *EVMRecorder {
+	recording := &Recording{
+		Version:     RecordingVersion,
+		ChainConfig: chainConfig,
+		Block: RecordedBlock{
+			Coinbase:    blockCtx.Coinbase,
+			GasLimit:    hexutil.Uint64(blockCtx.GasLimit),
+			Number:      toHexBig(blockCtx.BlockNumber),
+			Time:        hexutil.Uint64(blockCtx.Time),
+			Difficulty:  toHexBig(blockCtx.Difficulty),
+			BaseFee:     toHexBig(blockCtx.BaseFee),
+			BlobBaseFee: toHexBig(blockCtx.BlobBaseFee),
+			Random:      blockCtx.Random,
+			Hashes:      make(map[uint64]common.Hash),
+		},
+		Tx: RecordedTx{
+			Origin:   txCtx.Origin,
+			GasPrice: toHexBig(txCtx.GasPrice),
+		},
+		Accounts: make(map[common.Address]*RecordedAccount),
+	}
+
+	if getHash := blockCtx.GetHash; getHash != nil {
+		blockCtx.GetHash = func(n uint64) common.Hash {
+			hash := getHash(n)
+			recording.Block.Hashes[n] = hash
+			return hash
+		}
+	}
+
+	db := &recordingStateDB{StateDB: statedb, recording: recording}
+	return &EVMRecorder{
+		evm:       NewEVM(blockCtx, txCtx, db, chainConfig, config),
+		recording: recording,
+	}
+}
+
+// EVM returns the recorded EVM, calls made directly on it are not recorded as top level calls
+func (r *EVMRecorder) EVM() *EVM {
+	return r.evm
+}
+
+// Recording returns the recording of the executions so far
+func (r *EVMRecorder) Recording() *Recording {
+	return r.recording
+}
+
+// Call executes a call with the EVM and records its input and output
+func (r *EVMRecorder) Call(ctx context.Context, caller ContractRef, addr common.Address, input []byte, gas uint64, value *big.Int) ([]byte, uint64, error) {
+	ret, leftOverGas, err := r.evm.Call(ctx, caller, addr, input, gas, value)
+	r.recording.Calls = append(r.recording.Calls, newRecordedCall(caller.Address(), &addr, input, gas, value, ret, leftOverGas, err))
+	return ret, leftOverGas, err
+}
+
+// Create executes a contract creation with the EVM and records its input and output
+func (r *EVMRecorder) Create(ctx context.Context, caller ContractRef, code []byte, gas uint64, value *big.Int) ([]byte, common.Address, uint64, error) {
+	ret, contractAddr, leftOverGas, err := r.evm.Create(ctx, caller, code, gas, value)
+	r.recording.Calls = append(r.recording.Calls, newRecordedCall(caller.Address(), nil, code, gas, value, ret, leftOverGas, err))
+	return ret, contractAddr, leftOverGas, err
+}
+
+func newRecordedCall(caller common.Address, to *common.Address, input []byte, gas uint64, value *big.Int, ret []byte, leftOverGas uint64, err error) *RecordedCall {
+	call := &RecordedCall{
+		Caller:      caller,
+		To:          to,
+		Input:       common.CopyBytes(input),
+		Gas:         hexutil.Uint64(gas),
+		Value:       toHexBig(value),
+		Output:      common.CopyBytes(ret),
+		LeftOverGas: hexutil.Uint64(leftOverGas),
+	}
+	if err != nil {
+		call.Err = err.Error()
+	}
+	return call
+}
+
+// EVMReplayer re-executes the calls of a recording against an in-memory StateDB seeded
+// with the recorded state, and checks that they reproduce the recorded outcomes and writes
+type EVMReplayer struct {
+	recording *Recording
+}
+
+// NewEVMReplayer returns an EVMReplayer of the given recording, ErrInvalidRecording is
+// returned if the recording has an unsupported schema version or misses the chain config
+func NewEVMReplayer(recording *Recording) (*EVMReplayer, error) {
+	if recording.Version == 0 || recording.Version > RecordingVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidRecording, recording.Version)
+	}
+	if recording.ChainConfig == nil || recording.Block.Number == nil {
+		return nil, fmt.Errorf("%w: missing chain config or block number", ErrInvalidRecording)
+	}
+	return &EVMReplayer{recording: recording}, nil
+}
+
+// Replay executes the recorded calls with the given config and returns the EVM used, so
+// that its Tracer can be inspected. ErrReplayDiverged is returned at the first call whose
+// outcome differs from the recording, or if the writes to the state differ.
+func (r *EVMReplayer) Replay(ctx context.Context, config Config) (*EVM, error) {
+	statedb, err := r.seedState()
+	if err != nil {
+		return nil, err
+	}
+
+	replayed := &Recording{Accounts: make(map[common.Address]*RecordedAccount)}
+	db := &recordingStateDB{StateDB: statedb, recording: replayed}
+	evm := NewEVM(r.blockContext(), r.txContext(), db, r.recording.ChainConfig, config)
+	evm.CloseAspectCall()
+
+	if p := r.recording.Prepare; p != nil {
+		db.Prepare(evm.chainRules, p.Sender, p.Coinbase, p.Dest, p.Precompiles, p.AccessList)
+	}
+
+	for i, call := range r.recording.Calls {
+		var (
+			ret         []byte
+			leftOverGas uint64
+			err         error
+		)
+		value := fromHexBig(call.Value)
+		if value == nil {
+			value = new(big.Int)
+		}
+		caller := AccountRef(call.Caller)
+		if call.To != nil {
+			ret, leftOverGas, err = evm.Call(ctx, caller, *call.To, call.Input, uint64(call.Gas), value)
+		} else {
+			ret, _, leftOverGas, err = evm.Create(ctx, caller, call.Input, uint64(call.Gas), value)
+		}
+
+		got := newRecordedCall(call.Caller, call.To, call.Input, uint64(call.Gas), value, ret, leftOverGas, err)
+		if !bytes.Equal(got.Output, call.Output) || got.LeftOverGas != call.LeftOverGas || got.Err != call.Err {
+			return evm, fmt.Errorf("%w: call %d returned %s with %d gas left and error %q, recorded %s with %d gas left and error %q",
+				ErrReplayDiverged, i, got.Output, got.LeftOverGas, got.Err, call.Output, call.LeftOverGas, call.Err)
+		}
+	}
+
+	if len(replayed.Writes) != len(r.recording.Writes) {
+		return evm, fmt.Errorf("%w: %d writes, recorded %d", ErrReplayDiverged, len(replayed.Writes), len(r.recording.Writes))
+	}
+	for i, write := range replayed.Writes {
+		if !write.equal(r.recording.Writes[i]) {
+			return evm, fmt.Errorf("%w: write %d differs", ErrReplayDiverged, i)
+		}
+	}
+	return evm, nil
+}
+
+// seedState returns an in-memory StateDB holding the recorded state of the accounts
+func (r *EVMReplayer) seedState() (*state.StateDB, error) {
+	statedb, err := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for addr, account := range r.recording.Accounts {
+		if !account.Exists {
+			continue
+		}
+		statedb.CreateAccount(addr)
+		if account.Balance != nil {
+			statedb.SetBalance(addr, account.Balance.ToInt())
+		}
+		statedb.SetNonce(addr, uint64(account.Nonce))
+		statedb.SetCode(addr, account.Code)
+		for key, value := range account.Storage {
+			statedb.SetState(addr, key, value)
+		}
+	}
+	// the seeded state becomes the committed state of the replay
+	statedb.Finalise(false)
+	return statedb, nil
+}
+
+func (r *EVMReplayer) blockContext() BlockContext {
+	block := r.recording.Block
+	return BlockContext{
+		CanTransfer: func(db StateDB, addr common.Address, amount *big.Int) bool {
+			return db.GetBalance(addr).Cmp(amount) >= 0
+		},
+		Transfer: func(db StateDB, sender, recipient common.Address, amount *big.Int) {
+			db.SubBalance(sender, amount)
+			db.AddBalance(recipient, amount)
+		},
+		GetHash: func(n uint64) common.Hash {
+			return block.Hashes[n]
+		},
+		Coinbase:    block.Coinbase,
+		GasLimit:    uint64(block.GasLimit),
+		BlockNumber: fromHexBig(block.Number),
+		Time:        uint64(block.Time),
+		Difficulty:  fromHexBig(block.Difficulty),
+		BaseFee:     fromHexBig(block.BaseFee),
+		BlobBaseFee: fromHexBig(block.BlobBaseFee),
+		Random:      block.Random,
+	}
+}
+
+func (r *EVMReplayer) txContext() TxContext {
+	return TxContext{
+		Origin:   r.recording.Tx.Origin,
+		GasPrice: fromHexBig(r.recording.Tx.GasPrice),
+	}
+}
+
+// toHexBig returns a copy of a big integer for JSON encoding, nil is kept
+func toHexBig(b *big.Int) *hexutil.Big {
+	if b == nil {
+		return nil
+	}
+	return (*hexutil.Big)(new(big.Int).Set(b))
+}
+
+// fromHexBig returns a copy of a decoded big integer, nil is kept
+func fromHexBig(b *hexutil.Big) *big.Int {
+	if b == nil {
+		return nil
+	}
+	return new(big.Int).Set(b.ToInt())
+}
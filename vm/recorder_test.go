@@ -0,0 +1,90 @@
+package vm
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEVMRecorderReplay(t *testing.T) {
+	var (
+		sender  = common.Address{1}
+		address = common.BytesToAddress([]byte("counter"))
+	)
+	// sstore(0, add(sload(0), 1)) mstore(0, blockhash(4)) mstore(32, number()) return(0, 64)
+	code := []byte{
+		byte(PUSH1), 1, byte(PUSH1), 0, byte(SLOAD), byte(ADD), byte(PUSH1), 0, byte(SSTORE),
+		byte(PUSH1), 4, byte(BLOCKHASH), byte(PUSH1), 0, byte(MSTORE),
+		byte(NUMBER), byte(PUSH1), 32, byte(MSTORE),
+		byte(PUSH1), 64, byte(PUSH1), 0, byte(RETURN),
+	}
+
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.SetCode(address, code)
+	statedb.SetState(address, common.Hash{}, common.BigToHash(big.NewInt(41)))
+	statedb.AddBalance(sender, big.NewInt(1000))
+	statedb.Finalise(true)
+
+	vmctx := BlockContext{
+		CanTransfer: func(db StateDB, addr common.Address, amount *big.Int) bool {
+			return db.GetBalance(addr).Cmp(amount) >= 0
+		},
+		Transfer: func(db StateDB, sender, recipient common.Address, amount *big.Int) {
+			db.SubBalance(sender, amount)
+			db.AddBalance(recipient, amount)
+		},
+		GetHash:     func(n uint64) common.Hash { return common.BigToHash(new(big.Int).SetUint64(n + 100)) },
+		BlockNumber: big.NewInt(5),
+	}
+	recorder := NewEVMRecorder(vmctx, TxContext{Origin: sender}, statedb, params.AllEthashProtocolChanges, Config{})
+	recorder.EVM().CloseAspectCall()
+	ret, _, err := recorder.Call(context.Background(), AccountRef(sender), address, nil, 100000, big.NewInt(10))
+	require.NoError(t, err)
+	require.Equal(t, common.BigToHash(big.NewInt(104)).Bytes(), ret[:32])
+	require.Equal(t, common.BigToHash(big.NewInt(5)).Bytes(), ret[32:])
+
+	// the recording holds the state read and the block hash looked up
+	recording := recorder.Recording()
+	require.Equal(t, common.BigToHash(big.NewInt(41)), recording.Accounts[address].Storage[common.Hash{}])
+	require.Equal(t, int64(1000), recording.Accounts[sender].Balance.ToInt().Int64())
+	require.Equal(t, map[uint64]common.Hash{4: common.BigToHash(big.NewInt(104))}, recording.Block.Hashes)
+	require.Len(t, recording.Calls, 1)
+
+	data, err := json.Marshal(recording)
+	require.NoError(t, err)
+	decode := func() *Recording {
+		var decoded Recording
+		require.NoError(t, json.Unmarshal(data, &decoded))
+		return &decoded
+	}
+
+	// the decoded recording replays without the original state
+	replayer, err := NewEVMReplayer(decode())
+	require.NoError(t, err)
+	evm, err := replayer.Replay(context.Background(), Config{})
+	require.NoError(t, err)
+	require.Equal(t, common.BigToHash(big.NewInt(42)), evm.StateDB.GetState(address, common.Hash{}))
+	require.Len(t, evm.Tracer().CallTree().Flatten(), 1)
+
+	// a different pre-state diverges from the recording
+	tampered := decode()
+	tampered.Accounts[address].Storage[common.Hash{}] = common.BigToHash(big.NewInt(1))
+	replayer, err = NewEVMReplayer(tampered)
+	require.NoError(t, err)
+	_, err = replayer.Replay(context.Background(), Config{})
+	require.ErrorIs(t, err, ErrReplayDiverged)
+
+	// recordings of a newer schema are rejected
+	newer := decode()
+	newer.Version = RecordingVersion + 1
+	_, err = NewEVMReplayer(newer)
+	require.ErrorIs(t, err, ErrInvalidRecording)
+}
@@ -80,3 +80,22 @@ func (st *Stack) peek() *uint256.Int {
 func (st *Stack) Back(n int) *uint256.Int {
 	return &st.data[st.len()-n-1]
 }
+
+// intPoolSize is the number of transient integers kept in an intPool
+const intPoolSize = 8
+
+// intPool is a fixed ring buffer of transient uint256.Int values used by the
+// opcodes to build values pushed onto the stack. A value handed out is reused
+// once the ring wraps around, so it must be copied (e.g. pushed onto the stack)
+// right away and never retained.
+type intPool struct {
+	ints [intPoolSize]uint256.Int
+	next int
+}
+
+// get returns a zeroed transient integer from the pool
+func (p *intPool) get() *uint256.Int {
+	v := &p.ints[p.next]
+	p.next = (p.next + 1) % intPoolSize
+	return v.Clear()
+}
@@ -2,10 +2,19 @@ package vm
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/holiman/uint256"
+	"io"
+	"math"
 	"math/big"
+	"sort"
+	"strings"
 )
 
 type NodeType int
@@ -19,6 +28,8 @@ const (
 // StorageChanges contains the state changes of a storage slot
 type StorageChanges struct {
 	changes map[uint64][][]byte
+	// reads holds the number of changes each call had made whenever the slot is read
+	reads map[uint64][]int
 }
 
 // newStorageChange creates a new instance of storage change
@@ -26,17 +37,29 @@ func newStorageChange() *StorageChanges {
 	return &StorageChanges{changes: make(map[uint64][][]byte, 1)}
 }
 
-// append a new change to the storage change
-func (c *StorageChanges) append(callIdx uint64, newVal []byte) {
+// append a new change to the storage change, returns false if the change is ignored
+func (c *StorageChanges) append(callIdx uint64, newVal []byte) bool {
 	changes, ok := c.changes[callIdx]
 	if !ok {
 		c.changes[callIdx] = make([][]byte, 0, 1)
 	} else if len(changes) > 0 && bytes.Equal(changes[len(changes)-1], newVal) {
 		// ignore identical change
-		return
+		return false
 	}
 
 	c.changes[callIdx] = append(changes, newVal)
+	return true
+}
+
+// pop removes the last change of the given call
+func (c *StorageChanges) pop(callIdx uint64) {
+	changes := c.changes[callIdx]
+	if len(changes) <= 1 {
+		delete(c.changes, callIdx)
+		return
+	}
+
+	c.changes[callIdx] = changes[:len(changes)-1]
 }
 
 // Changes returns the changes of a storage slot
@@ -44,6 +67,115 @@ func (c *StorageChanges) Changes() map[uint64][][]byte {
 	return c.changes
 }
 
+// markRead records a read of the storage slot following the current changes of every call
+func (c *StorageChanges) markRead() {
+	if c.reads == nil {
+		c.reads = make(map[uint64][]int, len(c.changes))
+	}
+	for callIdx, changes := range c.changes {
+		reads := c.reads[callIdx]
+		if len(reads) == 0 || reads[len(reads)-1] != len(changes) {
+			c.reads[callIdx] = append(reads, len(changes))
+		}
+	}
+}
+
+// readAfter checks whether the slot is read after the n-th change of the given call
+// and before the next one
+func (c *StorageChanges) readAfter(callIdx uint64, n int) bool {
+	for _, read := range c.reads[callIdx] {
+		if read == n {
+			return true
+		}
+	}
+	return false
+}
+
+// Deltas returns the differences between the successive changes made by the given call,
+// each change is interpreted as an unsigned big-endian integer
+func (c *StorageChanges) Deltas(callIdx uint64) []*big.Int {
+	if c == nil || len(c.changes[callIdx]) < 2 {
+		return nil
+	}
+
+	changes := c.changes[callIdx]
+	deltas := make([]*big.Int, 0, len(changes)-1)
+	prev := new(big.Int).SetBytes(changes[0])
+	for _, change := range changes[1:] {
+		val := new(big.Int).SetBytes(change)
+		deltas = append(deltas, new(big.Int).Sub(val, prev))
+		prev = val
+	}
+	return deltas
+}
+
+// SignedChanges returns the changes made by the given call interpreted as two's complement
+// big-endian integers. The width of each value is its byte length, as the journaling
+// opcodes trim the values to the size of their type.
+func (c *StorageChanges) SignedChanges(callIdx uint64) []*big.Int {
+	if c == nil || len(c.changes[callIdx]) == 0 {
+		return nil
+	}
+
+	changes := c.changes[callIdx]
+	vals := make([]*big.Int, 0, len(changes))
+	for _, change := range changes {
+		val := new(big.Int).SetBytes(change)
+		if len(change) > 0 && change[0]&0x80 != 0 {
+			val.Sub(val, new(big.Int).Lsh(big1, uint(len(change))*8))
+		}
+		vals = append(vals, val)
+	}
+	return vals
+}
+
+// latest returns the last change made by the call with the largest index
+func (c *StorageChanges) latest() ([]byte, bool) {
+	return c.latestBefore(math.MaxUint64)
+}
+
+// earliest returns the first change made by the call with the smallest index
+func (c *StorageChanges) earliest() ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	var (
+		earliest []byte
+		minIdx   uint64
+		found    bool
+	)
+	for idx, changes := range c.changes {
+		if len(changes) == 0 || (found && idx > minIdx) {
+			continue
+		}
+		earliest, minIdx, found = changes[0], idx, true
+	}
+
+	return earliest, found
+}
+
+// latestBefore returns the last change made by the call with the largest index less than callIdx
+func (c *StorageChanges) latestBefore(callIdx uint64) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+
+	var (
+		latest []byte
+		maxIdx uint64
+		found  bool
+	)
+	for idx, changes := range c.changes {
+		if idx >= callIdx || len(changes) == 0 || (found && idx < maxIdx) {
+			continue
+		}
+		latest, maxIdx, found = changes[len(changes)-1], idx, true
+	}
+
+	return latest, found
+}
+
 // StorageKey contains the state meta info of a storage slot.
 type StorageKey struct {
 	slot          *uint256.Int
@@ -54,6 +186,7 @@ type StorageKey struct {
 	data          []byte
 	typeId        common.Hash
 	nodeType      NodeType
+	parent        *StorageKey // nil for root keys and keys not added to a parent yet
 }
 
 // NewBranchKey creates a new instance of branch storage key,
@@ -105,6 +238,147 @@ func (k *StorageKey) ChildrenIndices() [][]byte {
 	return res
 }
 
+// ChildByKey returns the child of the storage key stored under the given index, which is
+// the raw key of a mapping or the name of a state variable on a root key
+func (k *StorageKey) ChildByKey(index []byte) (*StorageKey, bool) {
+	child, ok := k.childrenIndex[string(index)]
+	return child, ok
+}
+
+// Path returns the storage keys from the root key down to this one, both included
+func (k *StorageKey) Path() []*StorageKey {
+	var path []*StorageKey
+	for key := k; key != nil; key = key.parent {
+		path = append(path, key)
+	}
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// PathString returns the path of the storage key in the form of variable.0x...,
+// with hex encoded indices. The root key is left out as it has no data.
+func (k *StorageKey) PathString() string {
+	var parts []string
+	for _, key := range k.Path() {
+		if key.nodeType != RootNode {
+			parts = append(parts, key.label())
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// label returns the name of a state variable or the hex encoded index of a nested key
+func (k *StorageKey) label() string {
+	if k.parent != nil && k.parent.nodeType == RootNode {
+		return string(k.data)
+	}
+	return hexutil.Encode(k.data)
+}
+
+// storageKeyJSON is the JSON form of a storage key written by StorageKey.JSONToDepth,
+// truncated is set on the keys whose children are left out
+type storageKeyJSON struct {
+	Key       string                     `json:"key,omitempty"`
+	Slot      *uint256.Int               `json:"slot,omitempty"`
+	Offset    uint8                      `json:"offset"`
+	TypeId    common.Hash                `json:"typeId"`
+	Changes   map[uint64][]hexutil.Bytes `json:"changes,omitempty"`
+	Children  []*storageKeyJSON          `json:"children,omitempty"`
+	Truncated bool                       `json:"truncated,omitempty"`
+}
+
+// JSONToDepth encodes the storage key and its descendants down to maxDepth levels below it
+// as JSON, e.g. a max depth of 0 only encodes the key itself. The keys at the cutoff having
+// children are marked as truncated.
+func (k *StorageKey) JSONToDepth(maxDepth int) ([]byte, error) {
+	if maxDepth < 0 {
+		return nil, fmt.Errorf("invalid max depth %d", maxDepth)
+	}
+
+	var encode func(key *StorageKey, depth int) *storageKeyJSON
+	encode = func(key *StorageKey, depth int) *storageKeyJSON {
+		node := &storageKeyJSON{
+			Slot:   key.slot,
+			Offset: key.offset,
+			TypeId: key.typeId,
+		}
+		if key.nodeType != RootNode {
+			node.Key = key.label()
+		}
+		if key.changes != nil && len(key.changes.changes) > 0 {
+			node.Changes = make(map[uint64][]hexutil.Bytes, len(key.changes.changes))
+			for callIdx, changes := range key.changes.changes {
+				vals := make([]hexutil.Bytes, len(changes))
+				for i, change := range changes {
+					vals[i] = change
+				}
+				node.Changes[callIdx] = vals
+			}
+		}
+
+		if len(key.childrenIndex) == 0 {
+			return node
+		}
+		if depth == maxDepth {
+			node.Truncated = true
+			return node
+		}
+		for _, index := range key.sortedIndices() {
+			node.Children = append(node.Children, encode(key.childrenIndex[index], depth+1))
+		}
+		return node
+	}
+
+	return json.Marshal(encode(k, 0))
+}
+
+// CheckInvariant checks that the children of the storage key and of its descendants are the
+// same whether looked up by slot and offset or by index. AddChild breaks it if the same index
+// is added under different slots, or different indices under the same slot and offset.
+func (k *StorageKey) CheckInvariant() error {
+	bySlot := make(map[*StorageKey]struct{})
+	for slot, offsets := range k.children {
+		for offset, child := range offsets {
+			if indexed, ok := k.childrenIndex[string(child.data)]; !ok || indexed != child {
+				return fmt.Errorf("child at slot %s offset %d is not indexed by %s", slot.Hex(), offset, hexutil.Encode(child.data))
+			}
+			bySlot[child] = struct{}{}
+		}
+	}
+	for index, child := range k.childrenIndex {
+		if _, ok := bySlot[child]; !ok {
+			return fmt.Errorf("child indexed by %s is not found at its slot and offset", hexutil.Encode([]byte(index)))
+		}
+		if err := child.CheckInvariant(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Depth returns the number of nested levels below the storage key
+func (k *StorageKey) Depth() int {
+	depth := 0
+	for _, child := range k.childrenIndex {
+		if childDepth := child.Depth() + 1; childDepth > depth {
+			depth = childDepth
+		}
+	}
+	return depth
+}
+
+// sortedIndices returns the indices of the children ordered by bytes
+func (k *StorageKey) sortedIndices() []string {
+	indices := make([]string, 0, len(k.childrenIndex))
+	for index := range k.childrenIndex {
+		indices = append(indices, index)
+	}
+	sort.Strings(indices)
+	return indices
+}
+
 // NodeType returns the node type of the storage key
 func (k *StorageKey) NodeType() NodeType {
 	return k.nodeType
@@ -122,6 +396,7 @@ func (k *StorageKey) Offset() uint8 {
 
 // AddChild adds a child storage key to current one
 func (k *StorageKey) AddChild(child *StorageKey) (*StorageKey, error) {
+	child.parent = k
 	slot, offset := child.Slot(), child.Offset()
 	if k.children[*slot] == nil {
 		k.children[*slot] = make(map[uint8]*StorageKey)
@@ -147,6 +422,26 @@ func (k *StorageKey) Changes() *StorageChanges {
 
 // JournalChanges saves the changes of current storage key
 func (k *StorageKey) JournalChanges(callIdx uint64, newVal []byte) {
+	k.journalChanges(callIdx, newVal)
+}
+
+// AddNestedChild adds a child of the storage key stored under the given index, such as the key of
+// a mapping, and returns it, or the existing child at the same slot and offset. It builds trees
+// without running the EVM, the child is not indexed by slot, see StateChanges.AddVariable.
+func (k *StorageKey) AddNestedChild(index []byte, slot *uint256.Int, offset uint8, typeId common.Hash) *StorageKey {
+	// AddChild never fails
+	child, _ := k.AddChild(NewBranchKey(slot, offset, typeId, common.CopyBytes(index)))
+	return child
+}
+
+// RecordChange records a new value of the storage key set by the call of given index,
+// it builds trees without running the EVM as AddNestedChild
+func (k *StorageKey) RecordChange(callIdx uint64, val []byte) {
+	k.journalChanges(callIdx, common.CopyBytes(val))
+}
+
+// journalChanges saves the changes of current storage key, returns false if the change is ignored
+func (k *StorageKey) journalChanges(callIdx uint64, newVal []byte) bool {
 	if k.changes == nil {
 		if k.nodeType != RootNode {
 			k.nodeType = DataNode
@@ -154,7 +449,124 @@ func (k *StorageKey) JournalChanges(callIdx uint64, newVal []byte) {
 		k.changes = newStorageChange()
 	}
 
-	k.changes.append(callIdx, newVal)
+	return k.changes.append(callIdx, newVal)
+}
+
+// revertChanges removes the last change journaled by the given call
+func (k *StorageKey) revertChanges(callIdx uint64) {
+	if k.changes == nil {
+		return
+	}
+
+	k.changes.pop(callIdx)
+	if len(k.changes.changes) == 0 {
+		k.changes = nil
+		if k.nodeType == DataNode {
+			k.nodeType = BranchNode
+		}
+	}
+}
+
+// stateJournalEntry is a modification to the state changes which can be reverted
+type stateJournalEntry interface {
+	// revert undoes the changes introduced by this entry
+	revert(s *StateChanges)
+}
+
+type (
+	// storageChange is a change journaled to a storage key
+	storageChange struct {
+		key     *StorageKey
+		callIdx uint64
+	}
+	// rawStateChange is a raw change of a storage slot
+	rawStateChange struct {
+		account common.Address
+		slot    uint256.Int
+		callIdx uint64
+		prev    *common.Hash
+	}
+	// selfDestructChange is an account being self-destructed
+	selfDestructChange struct {
+		account common.Address
+		first   bool // whether this is the first destruction of the account
+	}
+	// selfDestructMerge is a repeated self-destruct of an account which is not recreated yet
+	selfDestructMerge struct {
+		record  int
+		balance *uint256.Int
+	}
+	// creationChange is an account being created
+	creationChange struct {
+		account   common.Address
+		first     bool // whether this is the first creation of the account
+		recreated bool // whether the account was self-destructed before
+		record    int  // the latest self-destruct record of a recreated account
+	}
+	// dependencyChange is a new dependency between two storage slots of an account
+	dependencyChange struct {
+		account  common.Address
+		producer uint256.Int
+		consumer uint256.Int
+	}
+)
+
+func (ch storageChange) revert(s *StateChanges) {
+	ch.key.revertChanges(ch.callIdx)
+}
+
+func (ch rawStateChange) revert(s *StateChanges) {
+	if ch.prev != nil {
+		s.raw[ch.account][ch.slot][ch.callIdx] = *ch.prev
+		return
+	}
+
+	delete(s.raw[ch.account][ch.slot], ch.callIdx)
+	if len(s.raw[ch.account][ch.slot]) == 0 {
+		delete(s.raw[ch.account], ch.slot)
+	}
+	if len(s.raw[ch.account]) == 0 {
+		delete(s.raw, ch.account)
+	}
+}
+
+func (ch selfDestructChange) revert(s *StateChanges) {
+	s.destructRecords = s.destructRecords[:len(s.destructRecords)-1]
+	delete(s.destructed, ch.account)
+	if ch.first {
+		s.selfDestructs = s.selfDestructs[:len(s.selfDestructs)-1]
+	}
+}
+
+func (ch selfDestructMerge) revert(s *StateChanges) {
+	s.destructRecords[ch.record].Balance = ch.balance
+}
+
+func (ch creationChange) revert(s *StateChanges) {
+	if ch.first {
+		s.created = s.created[:len(s.created)-1]
+	}
+	if ch.recreated {
+		s.destructed[ch.account] = ch.record
+	}
+}
+
+func (ch dependencyChange) revert(s *StateChanges) {
+	delete(s.dependencies[ch.account][ch.consumer], ch.producer)
+	if len(s.dependencies[ch.account][ch.consumer]) == 0 {
+		delete(s.dependencies[ch.account], ch.consumer)
+	}
+	if len(s.dependencies[ch.account]) == 0 {
+		delete(s.dependencies, ch.account)
+	}
+}
+
+// SelfdestructRecord describes the teardown of a self-destructed contract
+type SelfdestructRecord struct {
+	Address     common.Address `json:"address"`
+	Beneficiary common.Address `json:"beneficiary"`
+	Balance     *uint256.Int   `json:"balance"` // balance transferred to the beneficiary
+	CallIndex   uint64         `json:"callIndex"`
 }
 
 // StateChanges saves the changes of current state
@@ -165,6 +577,24 @@ type StateChanges struct {
 	index map[common.Address]map[uint256.Int]map[uint8]map[common.Hash]*StorageKey
 	// raw holds all raw state changes, the tracer will not decode it, developers can decode it by themselves
 	raw map[common.Address]map[uint256.Int]map[uint64]common.Hash
+	// selfDestructs holds the accounts self-destructed during the transaction, in order of destruction
+	selfDestructs []common.Address
+	// destructRecords holds a record for each teardown of a contract, in order of destruction
+	destructRecords []SelfdestructRecord
+	// destructed maps the self-destructed accounts not recreated yet to their latest record
+	destructed map[common.Address]int
+	// created holds the accounts created during the transaction, in order of first creation
+	created []common.Address
+	// dependencies maps the slots written of accounts to the slots read before by the same call
+	dependencies map[common.Address]map[uint256.Int]map[uint256.Int]struct{}
+	// preimages maps the derived reference slots of accounts to the keccak pre-images they are hashed from
+	preimages map[common.Address]map[common.Hash][]byte
+	// callers maps the call indices to the senders of the calls, attributing the changes to their callers
+	callers map[uint64]common.Address
+	// readsTracked tells whether the storage reads are recorded, set by the interpreter with Config.TrackStorageReads
+	readsTracked bool
+	// journal holds the revertible changes in order, used for checkpoint and revert
+	journal []stateJournalEntry
 }
 
 // NewStateChanges create a new instance of state change cache
@@ -173,9 +603,19 @@ func NewStateChanges() *StateChanges {
 		roots: make(map[common.Address]*StorageKey),
 		index: make(map[common.Address]map[uint256.Int]map[uint8]map[common.Hash]*StorageKey),
 		raw:   make(map[common.Address]map[uint256.Int]map[uint64]common.Hash),
+
+		destructed:   make(map[common.Address]int),
+		dependencies: make(map[common.Address]map[uint256.Int]map[uint256.Int]struct{}),
+		preimages:    make(map[common.Address]map[common.Hash][]byte),
+		callers:      make(map[uint64]common.Address),
 	}
 }
 
+// saveCaller saves the sender of the call of the given index
+func (s *StateChanges) saveCaller(callIdx uint64, from common.Address) {
+	s.callers[callIdx] = from
+}
+
 // saveBalance saves the balance change of an account
 func (s *StateChanges) saveBalance(account common.Address, newBalance *uint256.Int, callIdx uint64) {
 	rootKey, ok := s.roots[account]
@@ -183,7 +623,86 @@ func (s *StateChanges) saveBalance(account common.Address, newBalance *uint256.I
 		rootKey = NewRootKey()
 		s.roots[account] = rootKey
 	}
-	rootKey.JournalChanges(callIdx, newBalance.Bytes())
+	s.journalChanges(rootKey, callIdx, newBalance.Bytes())
+}
+
+// journalChanges saves the changes of a storage key and records it in the journal
+func (s *StateChanges) journalChanges(key *StorageKey, callIdx uint64, newVal []byte) {
+	if key.journalChanges(callIdx, newVal) {
+		s.journal = append(s.journal, storageChange{key: key, callIdx: callIdx})
+	}
+}
+
+// Checkpoint returns a marker of the current changes, which can be reverted to with RevertToCheckpoint
+func (s *StateChanges) Checkpoint() int {
+	return len(s.journal)
+}
+
+// RevertToCheckpoint drops all changes recorded after the given checkpoint
+func (s *StateChanges) RevertToCheckpoint(checkpoint int) {
+	if checkpoint < 0 {
+		checkpoint = 0
+	}
+
+	for i := len(s.journal) - 1; i >= checkpoint; i-- {
+		s.journal[i].revert(s)
+	}
+
+	if checkpoint < len(s.journal) {
+		s.journal = s.journal[:checkpoint]
+	}
+}
+
+// saveSelfDestruct saves an account that has been self-destructed. Destructing an account again
+// before it is recreated adds the transferred balance to its latest record, otherwise a new
+// record is started.
+func (s *StateChanges) saveSelfDestruct(account, beneficiary common.Address, balance *uint256.Int, callIdx uint64) {
+	if idx, ok := s.destructed[account]; ok {
+		record := &s.destructRecords[idx]
+		s.journal = append(s.journal, selfDestructMerge{record: idx, balance: record.Balance})
+		record.Balance = new(uint256.Int).Add(record.Balance, balance)
+		return
+	}
+
+	first := true
+	for _, destructed := range s.selfDestructs {
+		if destructed == account {
+			first = false
+			break
+		}
+	}
+	if first {
+		s.selfDestructs = append(s.selfDestructs, account)
+	}
+	s.destructed[account] = len(s.destructRecords)
+	s.destructRecords = append(s.destructRecords, SelfdestructRecord{
+		Address:     account,
+		Beneficiary: beneficiary,
+		Balance:     new(uint256.Int).Set(balance),
+		CallIndex:   callIdx,
+	})
+	s.journal = append(s.journal, selfDestructChange{account: account, first: first})
+}
+
+// saveCreation saves an account being created, a self-destructed account created
+// again will start a new record when it is destructed later
+func (s *StateChanges) saveCreation(account common.Address) {
+	change := creationChange{account: account, first: true}
+	for _, created := range s.created {
+		if created == account {
+			change.first = false
+			break
+		}
+	}
+	if change.first {
+		s.created = append(s.created, account)
+	}
+
+	if idx, ok := s.destructed[account]; ok {
+		delete(s.destructed, account)
+		change.recreated, change.record = true, idx
+	}
+	s.journal = append(s.journal, change)
 }
 
 // saveRawStateChange saves the raw state change of a slot.
@@ -194,6 +713,12 @@ func (s *StateChanges) saveRawStateChange(account common.Address, slot uint256.I
 	if _, ok := s.raw[account][slot]; !ok {
 		s.raw[account][slot] = make(map[uint64]common.Hash)
 	}
+
+	entry := rawStateChange{account: account, slot: slot, callIdx: callIdx}
+	if prev, ok := s.raw[account][slot][callIdx]; ok {
+		entry.prev = &prev
+	}
+	s.journal = append(s.journal, entry)
 	s.raw[account][slot][callIdx] = val
 }
 
@@ -233,6 +758,20 @@ func (s *StateChanges) saveKey(account common.Address, parent, self, offset *uin
 	return
 }
 
+// AddVariable adds a top level state variable of an account and returns its storage key, or the
+// existing one at the same slot and offset. It builds trees without running the EVM, with the
+// nested keys added by StorageKey.AddNestedChild, which unlike the variable are not indexed
+// by slot and thus not found by StateChanges.Slot.
+func (s *StateChanges) AddVariable(account common.Address, varName string, slot *uint256.Int, offset uint8, typeId common.Hash) *StorageKey {
+	if s.roots[account] == nil {
+		s.roots[account] = NewRootKey()
+	}
+	// AddChild never fails
+	key, _ := s.roots[account].AddChild(NewBranchKey(slot, offset, typeId, []byte(varName)))
+	s.addKey(account, key.Slot(), key.Offset(), key)
+	return key
+}
+
 // saveChange saves a storage change to the state change tree
 func (s *StateChanges) saveChange(account common.Address, self, offset *uint256.Int, typeId common.Hash, callIdx uint64, newVal []byte) (err error) {
 	offsetU8 := uint8(0)
@@ -253,10 +792,21 @@ func (s *StateChanges) saveChange(account common.Address, self, offset *uint256.
 		return errors.New("storage key node not found")
 	}
 
-	selfNode.JournalChanges(callIdx, newVal)
+	s.journalChanges(selfNode, callIdx, newVal)
 	return
 }
 
+// saveRead marks the storage keys of a slot as read
+func (s *StateChanges) saveRead(account common.Address, slot *uint256.Int) {
+	for _, keys := range s.index[account][*slot] {
+		for _, key := range keys {
+			if key.changes != nil {
+				key.changes.markRead()
+			}
+		}
+	}
+}
+
 // addKey adds a storage key to the index table
 func (s *StateChanges) addKey(account common.Address, slot *uint256.Int, offset uint8, key *StorageKey) {
 	if _, ok := s.index[account]; !ok {
@@ -298,108 +848,801 @@ func (s *StateChanges) Balance(account common.Address) *StorageChanges {
 	return s.roots[account].changes
 }
 
-// FindKeyIndices finds a storage key from the index table by indices
-func (s *StateChanges) FindKeyIndices(account common.Address, stateVarName string, indices ...[]byte) *StorageKey {
-	rootKey, ok := s.roots[account]
-	if !ok {
-		return nil
-	}
+// BalanceConserved checks whether the net balance changes of all accounts sum to zero,
+// the coinbase is excluded as it collects the fees. The residual is returned along with
+// the result, a negative one means ether is burnt and a positive one means ether is minted.
+func (s *StateChanges) BalanceConserved(coinbase common.Address) (bool, *big.Int) {
+	residual := new(big.Int)
+	for account, rootKey := range s.roots {
+		if account == coinbase {
+			continue
+		}
+		first, ok := rootKey.changes.earliest()
+		if !ok {
+			continue
+		}
+		last, _ := rootKey.changes.latest()
 
-	cursor, ok := rootKey.childrenIndex[stateVarName]
-	if !ok {
-		return nil
+		residual.Add(residual, new(big.Int).SetBytes(last))
+		residual.Sub(residual, new(big.Int).SetBytes(first))
 	}
 
-	for _, index := range indices {
-		cursor, ok = cursor.childrenIndex[string(index)]
+	return residual.Sign() == 0, residual
+}
+
+// BalanceFlows returns the accounts whose balance increased and the ones whose balance
+// decreased, from the first balance recorded to the last, in ascending order. The accounts
+// whose balance ends as it started are in neither list.
+func (s *StateChanges) BalanceFlows() (gainers, losers []common.Address) {
+	for _, account := range sortedAccounts(s.roots) {
+		rootKey := s.roots[account]
+		first, ok := rootKey.changes.earliest()
 		if !ok {
-			return nil
+			continue
 		}
-	}
+		last, _ := rootKey.changes.latest()
 
-	return cursor
+		switch new(big.Int).SetBytes(last).Cmp(new(big.Int).SetBytes(first)) {
+		case 1:
+			gainers = append(gainers, account)
+		case -1:
+			losers = append(losers, account)
+		}
+	}
+	return gainers, losers
 }
 
-// Variable looks up state changes by variable name
-func (s *StateChanges) Variable(account common.Address, stateVarName string, indices ...[]byte) *StorageChanges {
-	key := s.FindKeyIndices(account, stateVarName, indices...)
-	if key == nil {
-		return nil
+// RecordDependency records that the consumer slot of an account is written after the producer
+// slot is read. New dependencies are journaled, reverting to an earlier checkpoint drops them.
+func (s *StateChanges) RecordDependency(account common.Address, producer, consumer uint256.Int) {
+	if _, ok := s.dependencies[account]; !ok {
+		s.dependencies[account] = make(map[uint256.Int]map[uint256.Int]struct{})
 	}
-
-	return key.changes
+	if _, ok := s.dependencies[account][consumer]; !ok {
+		s.dependencies[account][consumer] = make(map[uint256.Int]struct{})
+	}
+	if _, ok := s.dependencies[account][consumer][producer]; ok {
+		return
+	}
+	s.dependencies[account][consumer][producer] = struct{}{}
+	s.journal = append(s.journal, dependencyChange{account: account, producer: producer, consumer: consumer})
 }
 
-// Slot looks up state changes by storage slot
-func (s *StateChanges) Slot(account common.Address, slot, offset *uint256.Int, typeId common.Hash) (*StorageChanges, error) {
-	if slot == nil {
-		return nil, errors.New("slot empty")
+// DependencyGraph returns a map from each written slot of an account to the slots
+// read before it was written by the same call, the latter are in ascending order
+func (s *StateChanges) DependencyGraph(account common.Address) map[uint256.Int][]uint256.Int {
+	deps, ok := s.dependencies[account]
+	if !ok {
+		return nil
 	}
 
-	offsetU8 := uint8(0)
-	if offset != nil {
-		offsetU64, overflow := offset.Uint64WithOverflow()
-		if overflow || offsetU64 > 31 {
-			return nil, errors.New("offset overflow")
+	graph := make(map[uint256.Int][]uint256.Int, len(deps))
+	for consumer, producers := range deps {
+		slots := make([]uint256.Int, 0, len(producers))
+		for producer := range producers {
+			slots = append(slots, producer)
 		}
-		offsetU8 = uint8(offsetU64)
+		sort.Slice(slots, func(i, j int) bool { return slots[i].Lt(&slots[j]) })
+		graph[consumer] = slots
 	}
+	return graph
+}
 
-	key := s.findKey(account, slot, offsetU8, typeId)
-	if key == nil {
-		return nil, nil
+// savePreimage records the keccak pre-image a reference slot of an account is derived from
+func (s *StateChanges) savePreimage(account common.Address, slot common.Hash, preimage []byte) {
+	if _, ok := s.preimages[account]; !ok {
+		s.preimages[account] = make(map[common.Hash][]byte)
+	}
+	if _, ok := s.preimages[account][slot]; !ok {
+		s.preimages[account][slot] = common.CopyBytes(preimage)
 	}
-
-	return key.changes, nil
 }
 
-// IndicesOfChanges returns a collection of the change indices
-func (s *StateChanges) IndicesOfChanges(account common.Address, stateVarName string, indices ...[]byte) [][]byte {
-	key := s.FindKeyIndices(account, stateVarName, indices...)
-	if key == nil {
+// SlotPreimages returns the derived reference slots of an account mapped to the keccak
+// pre-images they are hashed from, so that the slots can be verified by the caller
+func (s *StateChanges) SlotPreimages(account common.Address) map[common.Hash][]byte {
+	preimages, ok := s.preimages[account]
+	if !ok {
 		return nil
 	}
 
-	res := make([][]byte, 0, len(key.childrenIndex))
-	if len(key.childrenIndex) > 0 {
-		for index := range key.childrenIndex {
-			res = append(res, []byte(index))
-		}
+	result := make(map[common.Hash][]byte, len(preimages))
+	for slot, preimage := range preimages {
+		result[slot] = common.CopyBytes(preimage)
 	}
-
-	return res
+	return result
 }
 
-// Call records the current contract call information
-type Call struct {
-	From         common.Address  `json:"from"`
-	To           *common.Address `json:"to"`
-	Data         []byte          `json:"data"`
-	Value        *uint256.Int    `json:"value"`
-	Gas          *uint256.Int    `json:"gas"`
-	Index        uint64          `json:"index"`
-	Parent       *Call           `json:"parent"`
-	Children     []*Call         `json:"children"`
-	Ret          []byte          `json:"ret"`
-	RemainingGas uint64          `json:"remainingGas"`
-	Err          error           `json:"err"`
+// SelfDestructs returns the accounts that were self-destructed during the transaction
+func (s *StateChanges) SelfDestructs() []common.Address {
+	return s.selfDestructs
 }
 
-// IsRoot checks whether current call is the original call
-func (c *Call) IsRoot() bool {
-	return c.Parent == nil
+// CreatedAccounts returns the accounts created by CREATE, CREATE2 or a value transfer to
+// a non-existent account, in order of creation. The accounts self-destructed after their
+// latest creation are only included if includeDestructed is set.
+func (s *StateChanges) CreatedAccounts(includeDestructed bool) []common.Address {
+	accounts := make([]common.Address, 0, len(s.created))
+	for _, account := range s.created {
+		if _, destructed := s.destructed[account]; destructed && !includeDestructed {
+			continue
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts
 }
 
-// ParentIndex returns the index of Parent call
-func (c *Call) ParentIndex() int64 {
-	if c.Parent == nil {
-		return -1
+// SelfdestructedContracts returns the teardown records of the self-destructed contracts
+// in order of destruction. A contract destructed, recreated and destructed again has
+// one record for each destruction.
+func (s *StateChanges) SelfdestructedContracts() []SelfdestructRecord {
+	records := make([]SelfdestructRecord, len(s.destructRecords))
+	for i, record := range s.destructRecords {
+		record.Balance = new(uint256.Int).Set(record.Balance)
+		records[i] = record
 	}
-	return int64(c.Parent.Index)
+	return records
 }
 
-// ChildrenIndices returns the indices of all children calls
-func (c *Call) ChildrenIndices() []uint64 {
+// Accounts returns the accounts with any traced balance, variable or raw storage change,
+// in ascending order
+func (s *StateChanges) Accounts() []common.Address {
+	seen := make(map[common.Address]struct{}, len(s.roots))
+	for account := range s.roots {
+		seen[account] = struct{}{}
+	}
+	for account := range s.index {
+		seen[account] = struct{}{}
+	}
+	for account := range s.raw {
+		seen[account] = struct{}{}
+	}
+
+	accounts := make([]common.Address, 0, len(seen))
+	for account := range seen {
+		accounts = append(accounts, account)
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return bytes.Compare(accounts[i][:], accounts[j][:]) < 0
+	})
+	return accounts
+}
+
+// Footprint returns the number of distinct (account, slot) pairs touched,
+// counting both the storage key tree and the raw state changes
+func (s *StateChanges) Footprint() int {
+	count := 0
+	for account, slots := range s.index {
+		count += len(slots)
+		for slot := range s.raw[account] {
+			if _, ok := slots[slot]; !ok {
+				count++
+			}
+		}
+	}
+
+	for account, slots := range s.raw {
+		if _, ok := s.index[account]; !ok {
+			count += len(slots)
+		}
+	}
+
+	return count
+}
+
+// EstimateSize returns the approximate number of bytes of the balance and variable changes written
+// by Tracer.WriteNDJSON, computed without encoding them
+func (s *StateChanges) EstimateSize() int {
+	size := 0
+	// pathSize is the size of the variable and indices fields shared by the changes of a key
+	var walk func(key *StorageKey, pathSize int)
+	walk = func(key *StorageKey, pathSize int) {
+		if key.changes != nil {
+			// byte fields are written in hex, which doubles their length
+			keySize := changeSizeOverhead + pathSize
+			if key.nodeType != RootNode {
+				keySize += 2 * key.slot.ByteLen()
+			}
+			for _, vals := range key.changes.changes {
+				for _, val := range vals {
+					size += keySize + 2*len(val)
+				}
+			}
+		}
+		for index, child := range key.childrenIndex {
+			if key.nodeType == RootNode {
+				walk(child, variableSizeOverhead+len(index))
+			} else {
+				walk(child, pathSize+indexSizeOverhead+2*len(index))
+			}
+		}
+	}
+	for _, root := range s.roots {
+		walk(root, 0)
+	}
+	return size
+}
+
+// AggregateByCallRange counts the balance and variable changes of an account in buckets of
+// bucketSize consecutive call indices, keyed by the first call index of each bucket
+func (s *StateChanges) AggregateByCallRange(account common.Address, bucketSize uint64) map[uint64]int {
+	if bucketSize == 0 {
+		return nil
+	}
+
+	buckets := make(map[uint64]int)
+	count := func(changes *StorageChanges) {
+		if changes == nil {
+			return
+		}
+		for callIdx, values := range changes.changes {
+			buckets[callIdx/bucketSize*bucketSize] += len(values)
+		}
+	}
+
+	if rootKey, ok := s.roots[account]; ok {
+		count(rootKey.changes)
+	}
+	for _, offsets := range s.index[account] {
+		for _, keys := range offsets {
+			for _, key := range keys {
+				count(key.changes)
+			}
+		}
+	}
+	return buckets
+}
+
+// FindKeyIndices finds a storage key from the index table by indices
+func (s *StateChanges) FindKeyIndices(account common.Address, stateVarName string, indices ...[]byte) *StorageKey {
+	rootKey, ok := s.roots[account]
+	if !ok {
+		return nil
+	}
+
+	cursor, ok := rootKey.ChildByKey([]byte(stateVarName))
+	if !ok {
+		return nil
+	}
+
+	for _, index := range indices {
+		cursor, ok = cursor.ChildByKey(index)
+		if !ok {
+			return nil
+		}
+	}
+
+	return cursor
+}
+
+// Variable looks up state changes by variable name
+func (s *StateChanges) Variable(account common.Address, stateVarName string, indices ...[]byte) *StorageChanges {
+	key := s.FindKeyIndices(account, stateVarName, indices...)
+	if key == nil {
+		return nil
+	}
+
+	return key.changes
+}
+
+// VariableAll returns the state changes of all indices of a mapping or array variable,
+// keyed by index. Indices without changes of their own, such as nested mappings, are skipped.
+func (s *StateChanges) VariableAll(account common.Address, stateVarName string) map[string]*StorageChanges {
+	return s.VariableMatching(account, stateVarName, nil)
+}
+
+// VariableMatching returns the state changes of the indices of a mapping or array variable
+// accepted by the predicate, keyed by index. A nil predicate accepts all indices.
+func (s *StateChanges) VariableMatching(account common.Address, stateVarName string, predicate func(index string) bool) map[string]*StorageChanges {
+	key := s.FindKeyIndices(account, stateVarName)
+	if key == nil {
+		return nil
+	}
+
+	res := make(map[string]*StorageChanges)
+	for index, child := range key.childrenIndex {
+		if child.changes == nil || (predicate != nil && !predicate(index)) {
+			continue
+		}
+		res[index] = child.changes
+	}
+	return res
+}
+
+// VariableBeforeCall returns the latest value of a state variable changed by the calls
+// with index strictly less than callIdx, nil if there is none
+func (s *StateChanges) VariableBeforeCall(account common.Address, stateVarName string, callIdx uint64, indices ...[]byte) []byte {
+	latest, _ := s.Variable(account, stateVarName, indices...).latestBefore(callIdx)
+	return latest
+}
+
+// Slot looks up state changes by storage slot
+func (s *StateChanges) Slot(account common.Address, slot, offset *uint256.Int, typeId common.Hash) (*StorageChanges, error) {
+	if slot == nil {
+		return nil, errors.New("slot empty")
+	}
+
+	offsetU8 := uint8(0)
+	if offset != nil {
+		offsetU64, overflow := offset.Uint64WithOverflow()
+		if overflow || offsetU64 > 31 {
+			return nil, errors.New("offset overflow")
+		}
+		offsetU8 = uint8(offsetU64)
+	}
+
+	key := s.findKey(account, slot, offsetU8, typeId)
+	if key == nil {
+		return nil, nil
+	}
+
+	return key.changes, nil
+}
+
+// StoragePath is the path from a top level state variable to a nested storage key
+type StoragePath struct {
+	Variable string   `json:"variable"`
+	Indices  [][]byte `json:"indices"`
+}
+
+// String returns the path in the form of variable[0x...][0x...], with hex encoded indices
+func (p StoragePath) String() string {
+	var sb strings.Builder
+	sb.WriteString(p.Variable)
+	for _, index := range p.Indices {
+		sb.WriteString("[")
+		sb.WriteString(hexutil.Encode(index))
+		sb.WriteString("]")
+	}
+	return sb.String()
+}
+
+// FinalValues returns the final value of every changed state variable of an account,
+// keyed by the variable path as formatted by StoragePath.String
+func (s *StateChanges) FinalValues(account common.Address) map[string][]byte {
+	rootKey, ok := s.roots[account]
+	if !ok {
+		return nil
+	}
+
+	var (
+		res    = make(map[string][]byte)
+		finals = s.finalValues()
+		walk   func(key *StorageKey, path StoragePath)
+	)
+	walk = func(key *StorageKey, path StoragePath) {
+		if val, ok := finalValue(finals, key); ok {
+			res[path.String()] = val
+		}
+		for index, child := range key.childrenIndex {
+			walk(child, StoragePath{
+				Variable: path.Variable,
+				Indices:  append(path.Indices[:len(path.Indices):len(path.Indices)], []byte(index)),
+			})
+		}
+	}
+	for name, child := range rootKey.childrenIndex {
+		walk(child, StoragePath{Variable: name})
+	}
+
+	return res
+}
+
+// FirstSetters returns the sender of the call which first changed each state variable of
+// an account, keyed by the variable name. A variable is changed by a call if any of its
+// nested keys is, the changes of reverted calls are not counted.
+func (s *StateChanges) FirstSetters(account common.Address) map[string]common.Address {
+	rootKey, ok := s.roots[account]
+	if !ok {
+		return nil
+	}
+
+	var (
+		first uint64
+		found bool
+		walk  func(key *StorageKey)
+	)
+	walk = func(key *StorageKey) {
+		if key.changes != nil {
+			for callIdx, changes := range key.changes.changes {
+				if len(changes) > 0 && (!found || callIdx < first) {
+					first, found = callIdx, true
+				}
+			}
+		}
+		for _, child := range key.childrenIndex {
+			walk(child)
+		}
+	}
+
+	res := make(map[string]common.Address)
+	for name, child := range rootKey.childrenIndex {
+		first, found = 0, false
+		walk(child)
+		if !found {
+			continue
+		}
+		if from, ok := s.callers[first]; ok {
+			res[name] = from
+		}
+	}
+	return res
+}
+
+// DeepNestings returns the paths of the innermost storage keys of an account
+// which are nested deeper than the threshold, e.g. a mapping of mappings has depth 2
+func (s *StateChanges) DeepNestings(account common.Address, threshold int) []StoragePath {
+	rootKey, ok := s.roots[account]
+	if !ok {
+		return nil
+	}
+
+	var (
+		res  []StoragePath
+		walk func(key *StorageKey, path StoragePath, depth int)
+	)
+	walk = func(key *StorageKey, path StoragePath, depth int) {
+		if depth+key.Depth() <= threshold {
+			return
+		}
+		if len(key.childrenIndex) == 0 {
+			res = append(res, path)
+			return
+		}
+		for _, index := range key.sortedIndices() {
+			walk(key.childrenIndex[index], StoragePath{
+				Variable: path.Variable,
+				Indices:  append(path.Indices[:len(path.Indices):len(path.Indices)], []byte(index)),
+			}, depth+1)
+		}
+	}
+	for _, name := range rootKey.sortedIndices() {
+		walk(rootKey.childrenIndex[name], StoragePath{Variable: name}, 0)
+	}
+
+	return res
+}
+
+// DeadWrite is a change of a state variable overwritten with a different value
+// by the same call before the variable is read
+type DeadWrite struct {
+	Path          StoragePath `json:"path"`
+	CallIndex     uint64      `json:"callIndex"`
+	Value         []byte      `json:"value"`
+	OverwrittenBy []byte      `json:"overwrittenBy"`
+}
+
+// DeadWrites returns the redundant writes to the state variables of an account, in order of
+// variable path and call index. A read by any call between two successive changes of a call,
+// e.g. a reentrant one, keeps the first change alive. The reads are only recorded by the
+// interpreter with Config.TrackStorageReads, without them no write can be told dead and
+// nil is returned.
+func (s *StateChanges) DeadWrites(account common.Address) []DeadWrite {
+	rootKey, ok := s.roots[account]
+	if !ok || !s.readsTracked {
+		return nil
+	}
+
+	var (
+		res  []DeadWrite
+		walk func(key *StorageKey, path StoragePath)
+	)
+	walk = func(key *StorageKey, path StoragePath) {
+		if changes := key.changes; changes != nil {
+			callIndices := make([]uint64, 0, len(changes.changes))
+			for callIdx := range changes.changes {
+				callIndices = append(callIndices, callIdx)
+			}
+			sort.Slice(callIndices, func(i, j int) bool { return callIndices[i] < callIndices[j] })
+
+			for _, callIdx := range callIndices {
+				values := changes.changes[callIdx]
+				for i := 0; i+1 < len(values); i++ {
+					if !changes.readAfter(callIdx, i+1) {
+						res = append(res, DeadWrite{Path: path, CallIndex: callIdx, Value: values[i], OverwrittenBy: values[i+1]})
+					}
+				}
+			}
+		}
+		for _, index := range key.sortedIndices() {
+			walk(key.childrenIndex[index], StoragePath{
+				Variable: path.Variable,
+				Indices:  append(path.Indices[:len(path.Indices):len(path.Indices)], []byte(index)),
+			})
+		}
+	}
+	for _, name := range rootKey.sortedIndices() {
+		walk(rootKey.childrenIndex[name], StoragePath{Variable: name})
+	}
+
+	return res
+}
+
+// IndicesOfChanges returns a collection of the change indices, ordered by bytes
+func (s *StateChanges) IndicesOfChanges(account common.Address, stateVarName string, indices ...[]byte) [][]byte {
+	key := s.FindKeyIndices(account, stateVarName, indices...)
+	if key == nil {
+		return nil
+	}
+
+	sorted := key.sortedIndices()
+	res := make([][]byte, 0, len(sorted))
+	for _, index := range sorted {
+		res = append(res, []byte(index))
+	}
+
+	return res
+}
+
+// DiffKind is the kind of difference between two state variables
+type DiffKind int
+
+const (
+	DiffModified DiffKind = iota // variable changed in both, with different final values
+	DiffAdded                    // variable only changed in the other state changes
+	DiffRemoved                  // variable only changed in current state changes
+)
+
+// VariableDiff reports a state variable whose final value differs between two StateChanges
+type VariableDiff struct {
+	Account    common.Address `json:"account"`
+	Variable   string         `json:"variable"`
+	Indices    [][]byte       `json:"indices"`
+	Kind       DiffKind       `json:"kind"`
+	Value      []byte         `json:"value"`      // final value in current state changes, nil if added
+	OtherValue []byte         `json:"otherValue"` // final value in the other state changes, nil if removed
+}
+
+// Diff compares the final values of the state variables with another StateChanges,
+// storage keys are matched by slot, offset and type id.
+func (s *StateChanges) Diff(other *StateChanges) []VariableDiff {
+	accounts := sortedAccounts(s.roots, other.roots)
+
+	d := &stateDiff{
+		finals:      s.finalValues(),
+		otherFinals: other.finalValues(),
+	}
+	for _, account := range accounts {
+		d.diffChildren(account, nil, s.roots[account], other.roots[account])
+	}
+
+	return d.diffs
+}
+
+// sortedAccounts returns the accounts of the given storage roots in ascending order
+func sortedAccounts(roots ...map[common.Address]*StorageKey) []common.Address {
+	seen := make(map[common.Address]struct{})
+	accounts := make([]common.Address, 0)
+	for _, root := range roots {
+		for account := range root {
+			if _, ok := seen[account]; !ok {
+				seen[account] = struct{}{}
+				accounts = append(accounts, account)
+			}
+		}
+	}
+	sort.Slice(accounts, func(i, j int) bool {
+		return bytes.Compare(accounts[i][:], accounts[j][:]) < 0
+	})
+
+	return accounts
+}
+
+// sortedChildren returns the children of a storage key ordered by slot and offset
+func (k *StorageKey) sortedChildren() []*StorageKey {
+	res := make([]*StorageKey, 0, len(k.children))
+	for _, offsets := range k.children {
+		for _, child := range offsets {
+			res = append(res, child)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if cmp := res[i].slot.Cmp(res[j].slot); cmp != 0 {
+			return cmp < 0
+		}
+		return res[i].offset < res[j].offset
+	})
+
+	return res
+}
+
+// finalValues returns the last journaled value of each storage key in execution order
+func (s *StateChanges) finalValues() map[*StorageKey][]byte {
+	finals := make(map[*StorageKey][]byte)
+	for i := len(s.journal) - 1; i >= 0; i-- {
+		change, ok := s.journal[i].(storageChange)
+		if !ok {
+			continue
+		}
+		if _, ok := finals[change.key]; ok {
+			continue
+		}
+
+		changes := change.key.changes.changes[change.callIdx]
+		finals[change.key] = changes[len(changes)-1]
+	}
+
+	return finals
+}
+
+// stateDiff walks two storage key trees in parallel and collects the differences
+type stateDiff struct {
+	finals      map[*StorageKey][]byte
+	otherFinals map[*StorageKey][]byte
+	diffs       []VariableDiff
+}
+
+// diffChildren compares the children of two matched storage keys, either of them can be nil
+func (d *stateDiff) diffChildren(account common.Address, path [][]byte, self, other *StorageKey) {
+	type position struct {
+		slot   uint256.Int
+		offset uint8
+	}
+
+	positions := make([]position, 0)
+	seen := make(map[position]struct{})
+	for _, key := range []*StorageKey{self, other} {
+		if key == nil {
+			continue
+		}
+		for slot, offsets := range key.children {
+			for offset := range offsets {
+				pos := position{slot: slot, offset: offset}
+				if _, ok := seen[pos]; !ok {
+					seen[pos] = struct{}{}
+					positions = append(positions, pos)
+				}
+			}
+		}
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		if cmp := positions[i].slot.Cmp(&positions[j].slot); cmp != 0 {
+			return cmp < 0
+		}
+		return positions[i].offset < positions[j].offset
+	})
+
+	child := func(key *StorageKey, pos position) *StorageKey {
+		if key == nil {
+			return nil
+		}
+		return key.children[pos.slot][pos.offset]
+	}
+
+	for _, pos := range positions {
+		selfChild, otherChild := child(self, pos), child(other, pos)
+		if selfChild != nil && otherChild != nil && selfChild.typeId != otherChild.typeId {
+			d.diffKey(account, path, selfChild, nil)
+			d.diffKey(account, path, nil, otherChild)
+			continue
+		}
+		d.diffKey(account, path, selfChild, otherChild)
+	}
+}
+
+// diffKey compares two matched storage keys and their descendants, either of them can be nil
+func (d *stateDiff) diffKey(account common.Address, path [][]byte, self, other *StorageKey) {
+	var (
+		selfVal, otherVal []byte
+		selfOk, otherOk   bool
+		index             []byte
+	)
+	if self != nil {
+		selfVal, selfOk = finalValue(d.finals, self)
+		index = self.data
+	}
+	if other != nil {
+		otherVal, otherOk = finalValue(d.otherFinals, other)
+		index = other.data
+	}
+
+	keyPath := append(path[:len(path):len(path)], index)
+	diff := VariableDiff{
+		Account:    account,
+		Variable:   string(keyPath[0]),
+		Indices:    keyPath[1:],
+		Value:      selfVal,
+		OtherValue: otherVal,
+	}
+	switch {
+	case selfOk && otherOk && !bytes.Equal(selfVal, otherVal):
+		diff.Kind = DiffModified
+		d.diffs = append(d.diffs, diff)
+	case selfOk && !otherOk:
+		diff.Kind = DiffRemoved
+		d.diffs = append(d.diffs, diff)
+	case !selfOk && otherOk:
+		diff.Kind = DiffAdded
+		d.diffs = append(d.diffs, diff)
+	}
+
+	d.diffChildren(account, keyPath, self, other)
+}
+
+// finalValue looks up the final value of a storage key, falls back to the latest
+// change by call index if the change was not journaled
+func finalValue(finals map[*StorageKey][]byte, key *StorageKey) ([]byte, bool) {
+	if val, ok := finals[key]; ok {
+		return val, true
+	}
+	return key.changes.latest()
+}
+
+// Call records the current contract call information
+type Call struct {
+	From         common.Address  `json:"from"`
+	To           *common.Address `json:"to"`
+	Data         []byte          `json:"data"`
+	Value        *uint256.Int    `json:"value"`
+	Gas          *uint256.Int    `json:"gas"`
+	Index        uint64          `json:"index"`
+	Parent       *Call           `json:"parent"`
+	Children     []*Call         `json:"children"`
+	Ret          []byte          `json:"ret"`
+	RemainingGas uint64          `json:"remainingGas"`
+	Err          error           `json:"err"`
+	SenderNonce  uint64          `json:"senderNonce"` // nonce of the sender once incremented by the transaction, only set for the root call
+
+	// InsufficientBalance is set if the call failed because the caller could not afford its value
+	InsufficientBalance bool `json:"insufficientBalance"`
+	// RevertStack is the stack left by the opcode failing the call, bottom first, only
+	// captured if Config.CaptureRevertStack is enabled. The operands popped by the
+	// failing opcode, such as the offset and size of REVERT, are not included.
+	RevertStack []uint256.Int `json:"revertStack,omitempty"`
+	// UsesOrigin is set if the call executed ORIGIN, such as to authorize its caller with
+	// tx.origin, only traced if Config.TraceOriginUse is enabled
+	UsesOrigin bool `json:"usesOrigin,omitempty"`
+	// Meta holds the annotations of consumers, it is never read by the EVM
+	Meta map[string]any `json:"-"`
+
+	checkpoint   tracerCheckpoint // checkpoint taken at call entry
+	logSummaries []LogSummary     // logs emitted by the call without their data
+	executing    bool             // whether an interpreter frame is running the call's code
+}
+
+// IsRoot checks whether current call is the original call
+func (c *Call) IsRoot() bool {
+	return c.Parent == nil
+}
+
+// Depth returns the number of calls above the call, 0 for the root call
+func (c *Call) Depth() int {
+	depth := 0
+	for parent := c.Parent; parent != nil; parent = parent.Parent {
+		depth++
+	}
+	return depth
+}
+
+// ParentIndex returns the index of Parent call
+func (c *Call) ParentIndex() int64 {
+	if c.Parent == nil {
+		return -1
+	}
+	return int64(c.Parent.Index)
+}
+
+// LogSummaries returns the logs emitted by the call without their data, in order of emission
+func (c *Call) LogSummaries() []LogSummary {
+	return c.logSummaries
+}
+
+// SetMeta annotates the call with a value under the given key
+func (c *Call) SetMeta(key string, v any) {
+	if c.Meta == nil {
+		c.Meta = make(map[string]any)
+	}
+	c.Meta[key] = v
+}
+
+// GetMeta returns the annotation of the call under the given key
+func (c *Call) GetMeta(key string) (any, bool) {
+	v, ok := c.Meta[key]
+	return v, ok
+}
+
+// ChildrenIndices returns the indices of all children calls
+func (c *Call) ChildrenIndices() []uint64 {
 	indices := make([]uint64, len(c.Children))
 	for i, call := range c.Children {
 		indices[i] = call.Index
@@ -408,12 +1651,88 @@ func (c *Call) ChildrenIndices() []uint64 {
 	return indices
 }
 
+var (
+	// errorSelector is the selector of Error(string), used by require and revert with a reason
+	errorSelector = []byte{0x08, 0xc3, 0x79, 0xa0}
+	// panicSelector is the selector of Panic(uint256), used by assert and checked arithmetic
+	panicSelector = []byte{0x4e, 0x48, 0x7b, 0x71}
+
+	// panicReasons are the meanings of the known Solidity panic codes
+	panicReasons = map[uint64]string{
+		0x00: "generic compiler panic",
+		0x01: "assert(false)",
+		0x11: "arithmetic underflow or overflow",
+		0x12: "division or modulo by zero",
+		0x21: "enum overflow",
+		0x22: "invalid encoded storage byte array accessed",
+		0x31: "out-of-bounds array access; popping on an empty array",
+		0x32: "out-of-bounds access of an array or bytesN",
+		0x41: "out of memory",
+		0x51: "uninitialized function",
+	}
+)
+
+// RevertKind is the classified revert data of a reverted call,
+// it is one of PanicRevert, StringRevert and RawRevert
+type RevertKind interface {
+	isRevertKind()
+}
+
+// PanicRevert is a revert caused by Panic(uint256), e.g. a failed assert or an arithmetic overflow
+type PanicRevert struct {
+	Code *uint256.Int
+}
+
+// StringRevert is a revert caused by Error(string), e.g. a failed require
+type StringRevert struct {
+	Msg string
+}
+
+// RawRevert is a revert with data which is neither Error(string) nor Panic(uint256), e.g. custom errors
+type RawRevert struct {
+	Data []byte
+}
+
+func (PanicRevert) isRevertKind()  {}
+func (StringRevert) isRevertKind() {}
+func (RawRevert) isRevertKind()    {}
+
+// Meaning returns the meaning of the panic code, empty if the code is unknown
+func (r PanicRevert) Meaning() string {
+	if r.Code == nil || !r.Code.IsUint64() {
+		return ""
+	}
+	return panicReasons[r.Code.Uint64()]
+}
+
+// RevertKind classifies the revert data of the call, nil is returned if the call is not reverted
+func (c *Call) RevertKind() RevertKind {
+	if !errors.Is(c.Err, ErrExecutionReverted) {
+		return nil
+	}
+
+	data := c.Ret
+	switch {
+	case len(data) == 4+32 && bytes.Equal(data[:4], panicSelector):
+		return PanicRevert{Code: new(uint256.Int).SetBytes(data[4:])}
+	case len(data) >= 4 && bytes.Equal(data[:4], errorSelector):
+		if msg, err := abi.UnpackRevert(data); err == nil {
+			return StringRevert{Msg: msg}
+		}
+	}
+	return RawRevert{Data: data}
+}
+
 // CallTree record the current smart contract call tree
 type CallTree struct {
 	root    *Call            // root is the beginning of all call, same with original transaction
 	current *Call            // current call
 	count   uint64           // call count, used for call Index
 	lookup  map[uint64]*Call // lookup table for call Index
+
+	// IntrinsicGas is the intrinsic gas of the original transaction, which is charged
+	// before the root call starts and thus not included in its Gas. It is set by the host.
+	IntrinsicGas uint64
 }
 
 func NewCallTree() *CallTree {
@@ -435,79 +1754,466 @@ func (c *CallTree) add(from common.Address, to *common.Address, data []byte, val
 		Index:  c.count,
 	}
 
-	if c.root == nil {
-		c.root = newCall
+	if c.root == nil {
+		c.root = newCall
+	}
+
+	if c.current != nil {
+		c.current.Children = append(c.current.Children, newCall)
+	}
+
+	c.lookup[c.count] = newCall
+	c.current = newCall
+
+	c.count += 1
+}
+
+// exit from a call, reset current to its Parent
+func (c *CallTree) exit(leftoverGas uint64, ret []byte, err error) {
+	if c.current == nil {
+		return
+	}
+
+	c.current.RemainingGas = leftoverGas
+	c.current.Ret = ret
+	c.current.Err = err
+	c.current.InsufficientBalance = errors.Is(err, ErrInsufficientBalance)
+
+	c.current = c.current.Parent
+}
+
+// Root returns the call that initiated by the original transaction
+func (c *CallTree) Root() *Call {
+	return c.root
+}
+
+// Current returns the current call
+func (c *CallTree) Current() *Call {
+	return c.current
+}
+
+// TotalTransactionGas returns the gas used by the original transaction,
+// the IntrinsicGas plus the gas used by the root call
+func (c *CallTree) TotalTransactionGas() uint64 {
+	if c.root == nil || c.root.Gas == nil {
+		return c.IntrinsicGas
+	}
+
+	return c.IntrinsicGas + c.root.Gas.Uint64() - c.root.RemainingGas
+}
+
+// ParentOf finds the Parent call of a given Index
+func (c *CallTree) ParentOf(index uint64) *Call {
+	node := c.lookup[index]
+	if node == nil {
+		return nil
+	}
+
+	return node.Parent
+}
+
+// FindCall finds a call by its Index
+func (c *CallTree) FindCall(index uint64) *Call {
+	return c.lookup[index]
+}
+
+// ChildrenOf finds the Children of a given Index
+func (c *CallTree) ChildrenOf(index uint64) []*Call {
+	node := c.lookup[index]
+	if node == nil {
+		return nil
+	}
+
+	return node.Children
+}
+
+// FindByAddress returns the calls from or to the given address in order of index,
+// contract creation calls are matched by their sender only
+func (c *CallTree) FindByAddress(addr common.Address) []*Call {
+	return c.filter(func(call *Call) bool {
+		return call.From == addr || (call.To != nil && *call.To == addr)
+	})
+}
+
+// FindByValue returns the calls transferring at least min value in order of index
+func (c *CallTree) FindByValue(min *uint256.Int) []*Call {
+	if min == nil {
+		min = new(uint256.Int)
+	}
+	return c.filter(func(call *Call) bool {
+		return call.Value != nil && !call.Value.Lt(min)
+	})
+}
+
+// OverProvisionedCalls returns the calls which returned a larger share of their gas than
+// the threshold unused, in order of index. Calls given no gas are skipped.
+func (c *CallTree) OverProvisionedCalls(threshold float64) []*Call {
+	return c.filter(func(call *Call) bool {
+		if call.Gas == nil || call.Gas.IsZero() {
+			return false
+		}
+		return float64(call.RemainingGas)/float64(call.Gas.Uint64()) > threshold
+	})
+}
+
+// Walk traverses the call tree depth-first from the root, calling pre on entering and post
+// on leaving each call. Either callback can be nil, the traversal stops at the first error.
+func (c *CallTree) Walk(pre, post func(*Call) error) error {
+	if c.root == nil {
+		return nil
+	}
+	return walkCall(c.root, pre, post)
+}
+
+// walkCall traverses the given call and its children depth-first
+func walkCall(call *Call, pre, post func(*Call) error) error {
+	if pre != nil {
+		if err := pre(call); err != nil {
+			return err
+		}
+	}
+	for _, child := range call.Children {
+		if err := walkCall(child, pre, post); err != nil {
+			return err
+		}
+	}
+	if post != nil {
+		return post(call)
+	}
+	return nil
+}
+
+// Flatten returns all calls in order of index, which is the order the calls are made
+func (c *CallTree) Flatten() []*Call {
+	return c.filter(func(*Call) bool { return true })
+}
+
+// FlattenDFS returns all calls in depth-first pre-order, the top level calls made after
+// the root are visited in order of index
+func (c *CallTree) FlattenDFS() []*Call {
+	calls := make([]*Call, 0, c.count)
+	collect := func(call *Call) error {
+		calls = append(calls, call)
+		return nil
+	}
+	for _, top := range c.filter(func(call *Call) bool { return call.Parent == nil }) {
+		_ = walkCall(top, collect, nil)
+	}
+	return calls
+}
+
+// Prune returns a copy of the call tree holding only the calls matching the predicate. The children
+// of a dropped call are attached to its nearest kept ancestor, or become top level calls if there is
+// none. The calls keep their indices, and the original tree is left unchanged.
+func (c *CallTree) Prune(predicate func(*Call) bool) *CallTree {
+	pruned := &CallTree{
+		count:        c.count,
+		lookup:       make(map[uint64]*Call, len(c.lookup)),
+		IntrinsicGas: c.IntrinsicGas,
+	}
+	// calls are visited in order of index, so the ancestors of a call are copied before it
+	for _, call := range c.Flatten() {
+		if !predicate(call) {
+			continue
+		}
+
+		kept := *call
+		kept.Parent, kept.Children, kept.Meta = nil, nil, nil
+		for key, v := range call.Meta {
+			kept.SetMeta(key, v)
+		}
+		for ancestor := call.Parent; ancestor != nil; ancestor = ancestor.Parent {
+			if parent := pruned.lookup[ancestor.Index]; parent != nil {
+				kept.Parent = parent
+				parent.Children = append(parent.Children, &kept)
+				break
+			}
+		}
+		if kept.Parent == nil && pruned.root == nil {
+			pruned.root = &kept
+		}
+		pruned.lookup[kept.Index] = &kept
+	}
+	if c.current != nil {
+		pruned.current = pruned.lookup[c.current.Index]
+	}
+
+	return pruned
+}
+
+// CallGas is the gas flow of a single call
+type CallGas struct {
+	Index       uint64 `json:"index"`
+	ParentIndex int64  `json:"parentIndex"`
+	Provided    uint64 `json:"provided"`
+	Remaining   uint64 `json:"remaining"`
+	UsedBySelf  uint64 `json:"usedBySelf"` // gas used by the call itself, excluding its children
+}
+
+// GasReport returns the gas flow of all calls in order of index. The gas used by a call
+// itself is its own usage minus the gas its children consumed, i.e. provided but not returned.
+func (c *CallTree) GasReport() []CallGas {
+	calls := c.Flatten()
+	report := make([]CallGas, 0, len(calls))
+	for _, call := range calls {
+		used, _ := c.GasBreakdown(call.Index)
+
+		var provided uint64
+		if call.Gas != nil {
+			provided = call.Gas.Uint64()
+		}
+		report = append(report, CallGas{
+			Index:       call.Index,
+			ParentIndex: call.ParentIndex(),
+			Provided:    provided,
+			Remaining:   call.RemainingGas,
+			UsedBySelf:  used,
+		})
+	}
+	return report
+}
+
+// GasBreakdown splits the gas used by the call of given index between the call itself and its
+// direct children, keyed by their index. A child is attributed the gas it consumed, i.e. provided
+// but not returned, the call itself the rest. Nothing is returned if the call does not exist.
+func (c *CallTree) GasBreakdown(index uint64) (self uint64, byChild map[uint64]uint64) {
+	call := c.FindCall(index)
+	if call == nil {
+		return 0, nil
+	}
+
+	self = callGasUsed(call)
+	byChild = make(map[uint64]uint64, len(call.Children))
+	for _, child := range call.Children {
+		childUsed := callGasUsed(child)
+		byChild[child.Index] = childUsed
+		// children can be given more than their parent pays for, e.g. the call stipend
+		if childUsed < self {
+			self -= childUsed
+		} else {
+			self = 0
+		}
+	}
+	return self, byChild
+}
+
+// callGasUsed returns the gas provided to a call but not returned
+func callGasUsed(call *Call) uint64 {
+	if call.Gas == nil || call.Gas.Uint64() < call.RemainingGas {
+		return 0
+	}
+	return call.Gas.Uint64() - call.RemainingGas
+}
+
+// filter returns the calls matching the predicate in order of index
+func (c *CallTree) filter(match func(call *Call) bool) []*Call {
+	var res []*Call
+	for i := uint64(0); i < c.count; i++ {
+		if call := c.lookup[i]; call != nil && match(call) {
+			res = append(res, call)
+		}
 	}
+	return res
+}
 
-	if c.current != nil {
-		c.current.Children = append(c.current.Children, newCall)
+// MaxWidth returns the largest number of direct children any single call has
+func (c *CallTree) MaxWidth() int {
+	widest := c.WidestCall()
+	if widest == nil {
+		return 0
 	}
 
-	c.lookup[c.count] = newCall
-	c.current = newCall
+	return len(widest.Children)
+}
 
-	c.count += 1
+// WidestCall returns the call with the most direct children,
+// the one with the smallest Index is returned if there are multiple
+func (c *CallTree) WidestCall() *Call {
+	var widest *Call
+	for i := uint64(0); i < c.count; i++ {
+		call := c.lookup[i]
+		if call == nil {
+			continue
+		}
+		if widest == nil || len(call.Children) > len(widest.Children) {
+			widest = call
+		}
+	}
+
+	return widest
 }
 
-// exit from a call, reset current to its Parent
-func (c *CallTree) exit(leftoverGas uint64, ret []byte, err error) {
-	if c.current == nil {
-		return
+// EstimateSize returns the approximate number of bytes of the calls written by Tracer.WriteNDJSON,
+// computed without encoding them
+func (c *CallTree) EstimateSize() int {
+	size := 0
+	for _, call := range c.lookup {
+		// byte fields are written in hex, which doubles their length
+		size += callSizeOverhead + 2*len(call.Data) + 2*len(call.Ret)
+		if call.Value != nil {
+			size += 2 * call.Value.ByteLen()
+		}
+		if call.Err != nil {
+			size += errSizeOverhead + len(call.Err.Error())
+		}
 	}
+	return size
+}
 
-	c.current.RemainingGas = leftoverGas
-	c.current.Ret = ret
-	c.current.Err = err
+// SlotAnomaly records a journaled storage slot that does not match the one derived from its key
+type SlotAnomaly struct {
+	Account   common.Address `json:"account"`
+	CallIndex uint64         `json:"callIndex"`
+	Base      *uint256.Int   `json:"base"`
+	Key       []byte         `json:"key"`
+	Expected  *uint256.Int   `json:"expected"`
+	Actual    *uint256.Int   `json:"actual"`
+}
 
-	c.current = c.current.Parent
+// AccessedSlot is a storage slot of an account accessed during the execution
+type AccessedSlot struct {
+	Addr common.Address `json:"address"`
+	Slot common.Hash    `json:"slot"`
 }
 
-// Root returns the call that initiated by the original transaction
-func (c *CallTree) Root() *Call {
-	return c.root
+// accessList records the addresses and storage slots accessed by a call, in order of first access
+type accessList struct {
+	addresses  []common.Address
+	addressSet map[common.Address]struct{}
+	slots      []AccessedSlot
+	slotSet    map[AccessedSlot]struct{}
 }
 
-// Current returns the current call
-func (c *CallTree) Current() *Call {
-	return c.current
+func newAccessList() *accessList {
+	return &accessList{
+		addressSet: make(map[common.Address]struct{}),
+		slotSet:    make(map[AccessedSlot]struct{}),
+	}
 }
 
-// ParentOf finds the Parent call of a given Index
-func (c *CallTree) ParentOf(index uint64) *Call {
-	node := c.lookup[index]
-	if node == nil {
-		return nil
+// addAddress adds an address to the access list if not present
+func (al *accessList) addAddress(addr common.Address) {
+	if _, ok := al.addressSet[addr]; ok {
+		return
 	}
+	al.addressSet[addr] = struct{}{}
+	al.addresses = append(al.addresses, addr)
+}
 
-	return node.Parent
+// addSlot adds a storage slot to the access list if not present
+func (al *accessList) addSlot(addr common.Address, slot common.Hash) {
+	key := AccessedSlot{Addr: addr, Slot: slot}
+	if _, ok := al.slotSet[key]; ok {
+		return
+	}
+	al.slotSet[key] = struct{}{}
+	al.slots = append(al.slots, key)
 }
 
-// FindCall finds a call by its Index
-func (c *CallTree) FindCall(index uint64) *Call {
-	return c.lookup[index]
+// TracedLog is a log emitted during the execution, along with the LOG opcode emitting it
+// and the call in the call tree executing it
+type TracedLog struct {
+	*types.Log `json:"log"`
+	Op         OpCode `json:"op"` // one of LOG0 - LOG4
+	PC         uint64 `json:"pc"`
+	CallIndex  uint64 `json:"callIndex"`
+	CallDepth  int    `json:"callDepth"` // 0 for the logs of the root call
 }
 
-// ChildrenOf finds the Children of a given Index
-func (c *CallTree) ChildrenOf(index uint64) []*Call {
-	node := c.lookup[index]
-	if node == nil {
-		return nil
+// tracedLogJSON is the JSON encoding of a TracedLog, which would be replaced by the one of
+// the embedded log otherwise
+type tracedLogJSON struct {
+	Log       *types.Log `json:"log"`
+	Op        OpCode     `json:"op"`
+	PC        uint64     `json:"pc"`
+	CallIndex uint64     `json:"callIndex"`
+	CallDepth int        `json:"callDepth"`
+}
+
+// MarshalJSON encodes the log along with where it is emitted
+func (l TracedLog) MarshalJSON() ([]byte, error) {
+	return json.Marshal(tracedLogJSON{Log: l.Log, Op: l.Op, PC: l.PC, CallIndex: l.CallIndex, CallDepth: l.CallDepth})
+}
+
+// UnmarshalJSON decodes the log along with where it is emitted
+func (l *TracedLog) UnmarshalJSON(input []byte) error {
+	var dec tracedLogJSON
+	if err := json.Unmarshal(input, &dec); err != nil {
+		return err
 	}
+	*l = TracedLog{Log: dec.Log, Op: dec.Op, PC: dec.PC, CallIndex: dec.CallIndex, CallDepth: dec.CallDepth}
+	return nil
+}
 
-	return node.Children
+// TopicCount returns the number of topics of the emitting opcode
+func (l *TracedLog) TopicCount() int {
+	return int(l.Op - LOG0)
+}
+
+// LogSummary describes a log emitted by a call without retaining its data
+type LogSummary struct {
+	Address common.Address `json:"address"`
+	Topics  []common.Hash  `json:"topics"`
+	DataLen int            `json:"dataLen"`
+	Op      OpCode         `json:"op"` // one of LOG0 - LOG4
+	PC      uint64         `json:"pc"`
+}
+
+// TopicCount returns the number of topics of the emitting opcode
+func (l *LogSummary) TopicCount() int {
+	return int(l.Op - LOG0)
 }
 
 // Tracer traces the state changes and call stack changes during a tx execution
 type Tracer struct {
-	states   *StateChanges
-	callTree *CallTree
+	states      *StateChanges
+	callTree    *CallTree
+	logs        map[uint64][]*TracedLog
+	eventLogs   []*TracedLog // logs of all calls in order of emission
+	logCalls    []uint64     // indices of the calls emitting the logs in order of emission, used to drop reverted logs
+	anomalies   []*SlotAnomaly
+	accessLists map[uint64]*accessList
+	deployments []Deployment
+	// storageReads holds the slots read by each call in progress, used to record the dependencies,
+	// only recorded with Config.TrackStorageReads
+	storageReads map[uint64]map[common.Address]map[uint256.Int]struct{}
+	// opCounts holds the executed instructions of each call by opcode, only counted with Config.EnableOpcodeCounting
+	opCounts map[uint64]map[OpCode]uint64
+	// preimages holds the keccak pre-images computed by KECCAK256, only recorded with Config.EnablePreimageRecording
+	preimages map[common.Hash][]byte
+	// preimageCalls maps the hashes of the pre-images to the index of the first call computing them
+	preimageCalls map[common.Hash]uint64
+
+	// SignificantWritesOnly drops the journaled writes leaving a variable at its committed
+	// value, unless the variable has already been changed during the transaction
+	SignificantWritesOnly bool
+	// LogSummariesOnly keeps the emitted logs as Call.LogSummaries only, without their data,
+	// LogsOfCall returns nothing then
+	LogSummariesOnly bool
+}
+
+// Deployment records a contract deployed by CREATE or CREATE2
+type Deployment struct {
+	Address   common.Address `json:"address"`
+	CodeHash  common.Hash    `json:"codeHash"`
+	CallIndex uint64         `json:"callIndex"` // index of the creation call
+	IsCreate2 bool           `json:"isCreate2"`
+	Salt      *uint256.Int   `json:"salt"` // only set for CREATE2
 }
 
 // NewTracer creates a new instance of tracer
 func NewTracer() *Tracer {
 	return &Tracer{
-		states:   NewStateChanges(),
-		callTree: NewCallTree(),
+		states:      NewStateChanges(),
+		callTree:    NewCallTree(),
+		logs:        make(map[uint64][]*TracedLog),
+		accessLists: make(map[uint64]*accessList),
+
+		storageReads: make(map[uint64]map[common.Address]map[uint256.Int]struct{}),
+		opCounts:     make(map[uint64]map[OpCode]uint64),
+
+		preimages:     make(map[common.Hash][]byte),
+		preimageCalls: make(map[common.Hash]uint64),
 	}
 }
 
@@ -526,6 +2232,46 @@ func (t *Tracer) SaveStateChange(account common.Address, slot, offset *uint256.I
 	return t.states.saveChange(account, slot, offset, typeId, t.CurrentCallIndex(), newVal)
 }
 
+// SaveStorageRead records a read of a storage slot, used to find the dead writes
+// and the dependencies of the slots written later by the current call. The interpreter
+// only records the reads with Config.TrackStorageReads.
+func (t *Tracer) SaveStorageRead(account common.Address, slot *uint256.Int) {
+	t.states.saveRead(account, slot)
+
+	callIdx := t.CurrentCallIndex()
+	if _, ok := t.storageReads[callIdx]; !ok {
+		t.storageReads[callIdx] = make(map[common.Address]map[uint256.Int]struct{})
+	}
+	if _, ok := t.storageReads[callIdx][account]; !ok {
+		t.storageReads[callIdx][account] = make(map[uint256.Int]struct{})
+	}
+	t.storageReads[callIdx][account][*slot] = struct{}{}
+}
+
+// SaveStorageWrite records a write of a storage slot as depending on all the slots of the
+// account read so far by the current call. The interpreter only records the writes with
+// Config.TrackStorageReads, as each write takes time linear in the slots read by the call.
+func (t *Tracer) SaveStorageWrite(account common.Address, slot *uint256.Int) {
+	for producer := range t.storageReads[t.CurrentCallIndex()][account] {
+		t.states.RecordDependency(account, producer, *slot)
+	}
+}
+
+// SaveSlotPreimage records the keccak pre-image of a derived reference slot
+func (t *Tracer) SaveSlotPreimage(account common.Address, slot common.Hash, preimage []byte) {
+	t.states.savePreimage(account, slot, preimage)
+}
+
+// dropsWrite checks whether a journaled write is dropped by SignificantWritesOnly,
+// unchanged tells whether the write leaves the variable at its committed value
+func (t *Tracer) dropsWrite(account common.Address, slot, offset *uint256.Int, typeId common.Hash, unchanged bool) bool {
+	if !t.SignificantWritesOnly || !unchanged {
+		return false
+	}
+	changes, err := t.states.Slot(account, slot, offset, typeId)
+	return err == nil && (changes == nil || len(changes.changes) == 0)
+}
+
 // SaveStateKey saves the relation between state variable to a storage slot
 func (t *Tracer) SaveStateKey(account common.Address, parent, self, offset *uint256.Int, typeId, parentTypeId common.Hash, index []byte) error {
 	return t.states.saveKey(account, parent, self, offset, typeId, parentTypeId, index)
@@ -534,18 +2280,506 @@ func (t *Tracer) SaveStateKey(account common.Address, parent, self, offset *uint
 // SaveCall saves a call to call tree
 func (t *Tracer) SaveCall(from common.Address, to *common.Address, data []byte, value *uint256.Int, gas *uint256.Int) {
 	t.callTree.add(from, to, data, value, gas)
+
+	current := t.callTree.current
+	current.checkpoint = t.checkpoint()
+	t.states.saveCaller(current.Index, from)
+}
+
+// SaveSenderNonce saves the nonce of the sender of the current call
+func (t *Tracer) SaveSenderNonce(nonce uint64) {
+	if current := t.callTree.current; current != nil {
+		current.SenderNonce = nonce
+	}
 }
 
-// ExitCall exits from current call stack
+// ExitCall exits from current call stack, the state changes, logs and deployments of a
+// failed call are dropped, as its state is reverted
 func (t *Tracer) ExitCall(leftoverGas uint64, ret []byte, err error) {
+	if current := t.callTree.current; current != nil {
+		delete(t.storageReads, current.Index)
+		if err != nil {
+			t.revertToCheckpoint(current.checkpoint)
+		}
+	}
 	t.callTree.exit(leftoverGas, ret, err)
 }
 
+// tracerCheckpoint marks the state changes, logs and deployments recorded so far
+type tracerCheckpoint struct {
+	states      int
+	logs        int
+	deployments int
+}
+
+// checkpoint returns a marker of the changes recorded so far, it is taken at the entry of
+// each call and of each interpreter frame, including the ones without a call of their own
+// such as the frames of DELEGATECALL and CALLCODE
+func (t *Tracer) checkpoint() tracerCheckpoint {
+	return tracerCheckpoint{
+		states:      t.states.Checkpoint(),
+		logs:        len(t.logCalls),
+		deployments: len(t.deployments),
+	}
+}
+
+// revertToCheckpoint drops the state changes, logs and deployments recorded after the checkpoint
+func (t *Tracer) revertToCheckpoint(checkpoint tracerCheckpoint) {
+	t.states.RevertToCheckpoint(checkpoint.states)
+	for i := len(t.logCalls) - 1; i >= checkpoint.logs; i-- {
+		callIdx := t.logCalls[i]
+		if call := t.callTree.FindCall(callIdx); call != nil && len(call.logSummaries) > 0 {
+			call.logSummaries = call.logSummaries[:len(call.logSummaries)-1]
+		}
+		if logs := t.logs[callIdx]; len(logs) > 0 {
+			t.logs[callIdx] = logs[:len(logs)-1]
+		}
+		if !t.LogSummariesOnly {
+			t.eventLogs = t.eventLogs[:len(t.eventLogs)-1]
+		}
+	}
+	if checkpoint.logs < len(t.logCalls) {
+		t.logCalls = t.logCalls[:checkpoint.logs]
+	}
+	if checkpoint.deployments < len(t.deployments) {
+		t.deployments = t.deployments[:checkpoint.deployments]
+	}
+}
+
+// SaveLog saves a log emitted by the call of given index, the emitting opcode is told by
+// the number of topics
+func (t *Tracer) SaveLog(callIdx uint64, log *types.Log) {
+	t.saveLog(callIdx, 0, LOG0+OpCode(len(log.Topics)), log)
+}
+
+// RecordLog records a log emitted by the call of given index, like SaveLog
+func (t *Tracer) RecordLog(log *types.Log, callIdx uint64) {
+	t.SaveLog(callIdx, log)
+}
+
+// saveLog saves a log emitted by the call of given index with the LOG opcode at pc, only its
+// summary is kept if LogSummariesOnly is enabled
+func (t *Tracer) saveLog(callIdx uint64, pc uint64, op OpCode, log *types.Log) {
+	if call := t.callTree.FindCall(callIdx); call != nil {
+		call.logSummaries = append(call.logSummaries, LogSummary{
+			Address: log.Address,
+			Topics:  log.Topics,
+			DataLen: len(log.Data),
+			Op:      op,
+			PC:      pc,
+		})
+	}
+	t.logCalls = append(t.logCalls, callIdx)
+	if t.LogSummariesOnly {
+		return
+	}
+
+	traced := &TracedLog{Log: log, Op: op, PC: pc, CallIndex: callIdx}
+	if call := t.callTree.FindCall(callIdx); call != nil {
+		traced.CallDepth = call.Depth()
+	}
+	t.logs[callIdx] = append(t.logs[callIdx], traced)
+	t.eventLogs = append(t.eventLogs, traced)
+}
+
+// LogsOfCall returns the logs emitted by the call of given index
+func (t *Tracer) LogsOfCall(index uint64) []*types.Log {
+	traced := t.logs[index]
+	if len(traced) == 0 {
+		return nil
+	}
+	logs := make([]*types.Log, len(traced))
+	for i, log := range traced {
+		logs[i] = log.Log
+	}
+	return logs
+}
+
+// TracedLogsOfCall returns the logs emitted by the call of given index along with the LOG
+// opcodes emitting them
+func (t *Tracer) TracedLogsOfCall(index uint64) []TracedLog {
+	traced := t.logs[index]
+	if len(traced) == 0 {
+		return nil
+	}
+	logs := make([]TracedLog, len(traced))
+	for i, log := range traced {
+		logs[i] = *log
+	}
+	return logs
+}
+
+// EventLogs returns the logs emitted by all calls in order of emission, the logs of failed
+// calls are dropped along with their state. It returns nothing if LogSummariesOnly is enabled.
+func (t *Tracer) EventLogs() []TracedLog {
+	logs := make([]TracedLog, len(t.eventLogs))
+	for i, log := range t.eventLogs {
+		logs[i] = *log
+	}
+	return logs
+}
+
+// enterFrame marks the current call as run by an interpreter frame, it returns false if the
+// call is run by a frame already, i.e. the new frame has no call of its own such as the
+// frames of DELEGATECALL, CALLCODE and STATICCALL
+func (t *Tracer) enterFrame() bool {
+	current := t.callTree.current
+	if current == nil || current.executing {
+		return false
+	}
+	current.executing = true
+	return true
+}
+
+// SaveRevertStack saves a copy of the stack of the current call failed by an opcode,
+// the interpreter only saves the stacks of the frames having a call of their own
+func (t *Tracer) SaveRevertStack(stack []uint256.Int) {
+	if current := t.callTree.current; current != nil {
+		current.RevertStack = append(make([]uint256.Int, 0, len(stack)), stack...)
+	}
+}
+
+// SavePreimage saves the keccak pre-image of a hash computed by the call of given index,
+// only the first call computing a hash is kept
+func (t *Tracer) SavePreimage(callIdx uint64, hash common.Hash, data []byte) {
+	if _, ok := t.preimages[hash]; ok {
+		return
+	}
+	t.preimages[hash] = common.CopyBytes(data)
+	t.preimageCalls[hash] = callIdx
+}
+
+// Preimages returns the keccak pre-images computed during the transaction by their hashes
+func (t *Tracer) Preimages() map[common.Hash][]byte {
+	preimages := make(map[common.Hash][]byte, len(t.preimages))
+	for hash, data := range t.preimages {
+		preimages[hash] = common.CopyBytes(data)
+	}
+	return preimages
+}
+
+// PreimageCall returns the index of the first call computing the pre-image of the given hash
+func (t *Tracer) PreimageCall(hash common.Hash) (uint64, bool) {
+	callIdx, ok := t.preimageCalls[hash]
+	return callIdx, ok
+}
+
+// SaveOriginUse flags the current call as executing ORIGIN
+func (t *Tracer) SaveOriginUse() {
+	if current := t.callTree.current; current != nil {
+		current.UsesOrigin = true
+	}
+}
+
+// SaveDeployment saves a contract deployed by the creation call of given index,
+// salt is nil for contracts deployed by CREATE
+func (t *Tracer) SaveDeployment(callIdx uint64, addr common.Address, codeHash common.Hash, salt *uint256.Int) {
+	deployment := Deployment{
+		Address:   addr,
+		CodeHash:  codeHash,
+		CallIndex: callIdx,
+		IsCreate2: salt != nil,
+	}
+	if salt != nil {
+		deployment.Salt = new(uint256.Int).Set(salt)
+	}
+	t.deployments = append(t.deployments, deployment)
+}
+
+// Deployments returns the contracts deployed in order of deployment
+func (t *Tracer) Deployments() []Deployment {
+	return t.deployments
+}
+
+// lastChildCallIndex returns the index of the latest call made by the current call
+func (t *Tracer) lastChildCallIndex() (uint64, bool) {
+	current := t.callTree.current
+	if current == nil || len(current.Children) == 0 {
+		return 0, false
+	}
+	return current.Children[len(current.Children)-1].Index, true
+}
+
+// RevertReason decodes the revert reason of the call of given index,
+// the hex encoded revert data is returned if it is not an Error(string) or Panic(uint256)
+func (t *Tracer) RevertReason(callIdx uint64) (string, error) {
+	call := t.callTree.FindCall(callIdx)
+	if call == nil {
+		return "", errors.New("call not found")
+	}
+	if !errors.Is(call.Err, ErrExecutionReverted) {
+		return "", errors.New("call not reverted")
+	}
+
+	reason, err := abi.UnpackRevert(call.Ret)
+	if err != nil {
+		return hexutil.Encode(call.Ret), nil
+	}
+	return reason, nil
+}
+
+// SaveSlotAnomaly saves a storage slot which does not match the expected keccak derived one
+func (t *Tracer) SaveSlotAnomaly(account common.Address, base, expected, actual *uint256.Int, key []byte) {
+	t.anomalies = append(t.anomalies, &SlotAnomaly{
+		Account:   account,
+		CallIndex: t.CurrentCallIndex(),
+		Base:      base,
+		Key:       key,
+		Expected:  expected,
+		Actual:    actual,
+	})
+}
+
+// SlotAnomalies returns the storage slot mismatches found during the execution
+func (t *Tracer) SlotAnomalies() []*SlotAnomaly {
+	return t.anomalies
+}
+
+// currentAccessList returns the access list of the current call
+func (t *Tracer) currentAccessList() *accessList {
+	callIdx := t.CurrentCallIndex()
+	al, ok := t.accessLists[callIdx]
+	if !ok {
+		al = newAccessList()
+		t.accessLists[callIdx] = al
+	}
+	return al
+}
+
+// SaveAccessedAddress saves an address accessed by the current call
+func (t *Tracer) SaveAccessedAddress(addr common.Address) {
+	t.currentAccessList().addAddress(addr)
+}
+
+// SaveAccessedSlot saves a storage slot accessed by the current call
+func (t *Tracer) SaveAccessedSlot(addr common.Address, slot common.Hash) {
+	t.currentAccessList().addSlot(addr, slot)
+}
+
+// AccessedAddresses returns the addresses accessed by the call of given index, in order of first access
+func (t *Tracer) AccessedAddresses(callIdx uint64) []common.Address {
+	if al, ok := t.accessLists[callIdx]; ok {
+		return al.addresses
+	}
+	return nil
+}
+
+// AccessedSlots returns the storage slots accessed by the call of given index, in order of first access
+func (t *Tracer) AccessedSlots(callIdx uint64) []AccessedSlot {
+	if al, ok := t.accessLists[callIdx]; ok {
+		return al.slots
+	}
+	return nil
+}
+
 // CallTree returns the current call tree
 func (t *Tracer) CallTree() *CallTree {
 	return t.callTree
 }
 
+// Sizes in bytes of the fixed parts of the NDJSON records, used to estimate the size of the output
+const (
+	callSizeOverhead     = 216 // call record, excluding the byte fields and the error
+	errSizeOverhead      = 9   // error field of a call record, excluding the message
+	changeSizeOverhead   = 112 // balance change record, excluding the value
+	variableSizeOverhead = 28  // variable and slot fields of a variable change, excluding their values
+	indexSizeOverhead    = 6   // index of a variable change, excluding its value
+)
+
+// ndjsonCall is the NDJSON record of a call
+type ndjsonCall struct {
+	Type         string          `json:"type"`
+	Index        uint64          `json:"index"`
+	Parent       int64           `json:"parent"`
+	From         common.Address  `json:"from"`
+	To           *common.Address `json:"to"`
+	Data         hexutil.Bytes   `json:"data"`
+	Value        *uint256.Int    `json:"value"`
+	Gas          *uint256.Int    `json:"gas"`
+	Ret          hexutil.Bytes   `json:"ret"`
+	RemainingGas uint64          `json:"remainingGas"`
+	Err          string          `json:"err,omitempty"`
+}
+
+// ndjsonChange is the NDJSON record of a state change,
+// balance changes have no variable, indices, slot or offset
+type ndjsonChange struct {
+	Type      string          `json:"type"`
+	CallIndex uint64          `json:"callIndex"`
+	Account   common.Address  `json:"account"`
+	Variable  string          `json:"variable,omitempty"`
+	Indices   []hexutil.Bytes `json:"indices,omitempty"`
+	Slot      *uint256.Int    `json:"slot,omitempty"`
+	Offset    uint8           `json:"offset"`
+	Value     hexutil.Bytes   `json:"value"`
+}
+
+// changedKey refers to a storage key changed by a call, along with its variable path
+type changedKey struct {
+	account common.Address
+	path    [][]byte
+	key     *StorageKey
+}
+
+// WriteNDJSON writes the calls and state changes to w as newline-delimited JSON,
+// one object per line. Calls are written in order of index, each followed by the
+// balance and variable changes it made.
+func (t *Tracer) WriteNDJSON(w io.Writer) error {
+	// only references to the changed keys are collected, the records are built on write
+	changed := make(map[uint64][]changedKey)
+	var walk func(account common.Address, path [][]byte, key *StorageKey)
+	walk = func(account common.Address, path [][]byte, key *StorageKey) {
+		if key.changes != nil {
+			for callIdx := range key.changes.changes {
+				changed[callIdx] = append(changed[callIdx], changedKey{account: account, path: path, key: key})
+			}
+		}
+		for _, child := range key.sortedChildren() {
+			walk(account, append(path[:len(path):len(path)], child.data), child)
+		}
+	}
+	for _, account := range sortedAccounts(t.states.roots) {
+		walk(account, nil, t.states.roots[account])
+	}
+
+	indices := make([]uint64, 0, t.callTree.count+uint64(len(changed)))
+	for i := uint64(0); i < t.callTree.count; i++ {
+		indices = append(indices, i)
+	}
+	for callIdx := range changed {
+		if callIdx >= t.callTree.count {
+			indices = append(indices, callIdx)
+		}
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+
+	enc := json.NewEncoder(w)
+	for _, callIdx := range indices {
+		if call := t.callTree.FindCall(callIdx); call != nil {
+			record := &ndjsonCall{
+				Type:         "call",
+				Index:        call.Index,
+				Parent:       call.ParentIndex(),
+				From:         call.From,
+				To:           call.To,
+				Data:         call.Data,
+				Value:        call.Value,
+				Gas:          call.Gas,
+				Ret:          call.Ret,
+				RemainingGas: call.RemainingGas,
+			}
+			if call.Err != nil {
+				record.Err = call.Err.Error()
+			}
+			if err := enc.Encode(record); err != nil {
+				return err
+			}
+		}
+
+		for _, ref := range changed[callIdx] {
+			record := &ndjsonChange{
+				Type:      "balance",
+				CallIndex: callIdx,
+				Account:   ref.account,
+			}
+			if len(ref.path) > 0 {
+				record.Type = "variable"
+				record.Variable = string(ref.path[0])
+				for _, index := range ref.path[1:] {
+					record.Indices = append(record.Indices, index)
+				}
+				record.Slot = ref.key.slot
+				record.Offset = ref.key.offset
+			}
+			for _, val := range ref.key.changes.changes[callIdx] {
+				record.Value = val
+				if err := enc.Encode(record); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// TextDump returns a canonical text representation of the traced state changes and calls, meant
+// for golden-file tests. Accounts are in ascending order, each followed by its balance changes and
+// the changes of its variables ordered by path, as hex values by call index. The calls follow as
+// an outline indented by depth. Identical executions give byte-identical dumps.
+func (t *Tracer) TextDump() string {
+	var sb strings.Builder
+	writeChanges := func(name string, changes *StorageChanges) {
+		fmt.Fprintf(&sb, "  %s\n", name)
+		indices := make([]uint64, 0, len(changes.changes))
+		for callIdx := range changes.changes {
+			indices = append(indices, callIdx)
+		}
+		sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+		for _, callIdx := range indices {
+			vals := make([]string, 0, len(changes.changes[callIdx]))
+			for _, val := range changes.changes[callIdx] {
+				vals = append(vals, hexutil.Encode(val))
+			}
+			fmt.Fprintf(&sb, "    call %d: %s\n", callIdx, strings.Join(vals, " "))
+		}
+	}
+	var walk func(key *StorageKey, path StoragePath)
+	walk = func(key *StorageKey, path StoragePath) {
+		if key.changes != nil {
+			writeChanges(path.String(), key.changes)
+		}
+		for _, index := range key.sortedIndices() {
+			walk(key.childrenIndex[index], StoragePath{
+				Variable: path.Variable,
+				Indices:  append(path.Indices[:len(path.Indices):len(path.Indices)], []byte(index)),
+			})
+		}
+	}
+
+	sb.WriteString("accounts:\n")
+	for _, account := range sortedAccounts(t.states.roots) {
+		root := t.states.roots[account]
+		fmt.Fprintf(&sb, "%s\n", account.Hex())
+		if root.changes != nil {
+			writeChanges("balance", root.changes)
+		}
+		for _, name := range root.sortedIndices() {
+			walk(root.childrenIndex[name], StoragePath{Variable: name})
+		}
+	}
+
+	uintHex := func(v *uint256.Int) string {
+		if v == nil {
+			return "0x0"
+		}
+		return v.Hex()
+	}
+	var writeCall func(call *Call, depth int)
+	writeCall = func(call *Call, depth int) {
+		to := "create"
+		if call.To != nil {
+			to = call.To.Hex()
+		}
+		fmt.Fprintf(&sb, "%s%d %s -> %s value %s gas %s remaining %d data %s ret %s",
+			strings.Repeat("  ", depth), call.Index, call.From.Hex(), to, uintHex(call.Value), uintHex(call.Gas),
+			call.RemainingGas, hexutil.Encode(call.Data), hexutil.Encode(call.Ret))
+		if call.Err != nil {
+			fmt.Fprintf(&sb, " err %q", call.Err.Error())
+		}
+		sb.WriteString("\n")
+		for _, child := range call.Children {
+			writeCall(child, depth+1)
+		}
+	}
+
+	sb.WriteString("calls:\n")
+	for _, call := range t.callTree.filter((*Call).IsRoot) {
+		writeCall(call, 0)
+	}
+	return sb.String()
+}
+
 // TransferWithRecord is a wrapper for transfer func with balance change tracer
 func (t *Tracer) TransferWithRecord(db StateDB, from, to common.Address, amount *big.Int, transfer TransferFunc) {
 	// When deploying a contract with EoA, innerTx could be nil
@@ -557,6 +2791,91 @@ func (t *Tracer) TransferWithRecord(db StateDB, from, to common.Address, amount
 	t.states.saveBalance(to, uint256.MustFromBig(db.GetBalance(to)), callIdx)
 }
 
+// BalanceDeltaInSubtree returns the net balance change of an account caused by the given call and
+// its descendants, from the first balance recorded by them to the last. It is zero if the account
+// is not touched by the calls.
+func (t *Tracer) BalanceDeltaInSubtree(account common.Address, callIndex uint64) *big.Int {
+	delta := new(big.Int)
+	balance := t.states.Balance(account)
+	if balance == nil || t.callTree.FindCall(callIndex) == nil {
+		return delta
+	}
+
+	var (
+		first, last    []byte
+		minIdx, maxIdx uint64
+		found          bool
+		visit          func(callIdx uint64)
+	)
+	visit = func(callIdx uint64) {
+		if changes := balance.changes[callIdx]; len(changes) > 0 {
+			if !found || callIdx < minIdx {
+				first, minIdx = changes[0], callIdx
+			}
+			if !found || callIdx > maxIdx {
+				last, maxIdx = changes[len(changes)-1], callIdx
+			}
+			found = true
+		}
+		for _, child := range t.callTree.ChildrenOf(callIdx) {
+			visit(child.Index)
+		}
+	}
+	visit(callIndex)
+
+	if !found {
+		return delta
+	}
+	return delta.Sub(new(big.Int).SetBytes(last), new(big.Int).SetBytes(first))
+}
+
+// SaveSelfDestruct saves the balance changes of a self-destructed contract and its beneficiary,
+// balance is the amount transferred to the beneficiary
+func (t *Tracer) SaveSelfDestruct(db StateDB, contract, beneficiary common.Address, balance *big.Int) {
+	callIdx := t.CurrentCallIndex()
+	t.states.saveBalance(contract, new(uint256.Int), callIdx)
+	t.states.saveBalance(beneficiary, uint256.MustFromBig(db.GetBalance(beneficiary)), callIdx)
+	t.states.saveSelfDestruct(contract, beneficiary, uint256.MustFromBig(balance), callIdx)
+}
+
+// SaveCreation saves an account being created
+func (t *Tracer) SaveCreation(account common.Address) {
+	t.states.saveCreation(account)
+}
+
+// currentOpCounts returns the instruction counts of the current call, which the interpreter increments
+func (t *Tracer) currentOpCounts() map[OpCode]uint64 {
+	callIdx := t.CurrentCallIndex()
+	counts, ok := t.opCounts[callIdx]
+	if !ok {
+		counts = make(map[OpCode]uint64)
+		t.opCounts[callIdx] = counts
+	}
+	return counts
+}
+
+// OpCounts returns the number of instructions executed by the given call by opcode,
+// nil unless Config.EnableOpcodeCounting is set
+func (t *Tracer) OpCounts(callIdx uint64) map[OpCode]uint64 {
+	return t.opCounts[callIdx]
+}
+
+// GlobalOpCounts returns the number of instructions executed by all calls by opcode,
+// nil unless Config.EnableOpcodeCounting is set
+func (t *Tracer) GlobalOpCounts() map[OpCode]uint64 {
+	if len(t.opCounts) == 0 {
+		return nil
+	}
+
+	global := make(map[OpCode]uint64)
+	for _, counts := range t.opCounts {
+		for op, count := range counts {
+			global[op] += count
+		}
+	}
+	return global
+}
+
 func (t *Tracer) CurrentCallIndex() uint64 {
 	callIdx := uint64(0)
 	if t.callTree.current != nil {
@@ -0,0 +1,105 @@
+package vm
+
+import (
+	"math/bits"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+)
+
+// SlotBitmap is a sparse bitmap over the low 64 bits of storage slots, it is
+// organized as 64-bit words indexed by the high bits of the slot
+type SlotBitmap struct {
+	words map[uint64]uint64
+}
+
+// NewSlotBitmap creates an empty slot bitmap
+func NewSlotBitmap() *SlotBitmap {
+	return &SlotBitmap{words: make(map[uint64]uint64)}
+}
+
+// Add sets the bit of the given slot
+func (b *SlotBitmap) Add(slot uint64) {
+	b.words[slot>>6] |= 1 << (slot & 63)
+}
+
+// Contains checks whether the bit of the given slot is set
+func (b *SlotBitmap) Contains(slot uint64) bool {
+	return b.words[slot>>6]&(1<<(slot&63)) != 0
+}
+
+// Len returns the number of bits set
+func (b *SlotBitmap) Len() int {
+	count := 0
+	for _, word := range b.words {
+		count += bits.OnesCount64(word)
+	}
+	return count
+}
+
+// And returns the intersection of two bitmaps
+func (b *SlotBitmap) And(other *SlotBitmap) *SlotBitmap {
+	small, large := b, other
+	if len(small.words) > len(large.words) {
+		small, large = large, small
+	}
+
+	res := NewSlotBitmap()
+	for idx, word := range small.words {
+		if common := word & large.words[idx]; common != 0 {
+			res.words[idx] = common
+		}
+	}
+	return res
+}
+
+// Intersects checks whether two bitmaps have any bit in common
+func (b *SlotBitmap) Intersects(other *SlotBitmap) bool {
+	small, large := b, other
+	if len(small.words) > len(large.words) {
+		small, large = large, small
+	}
+
+	for idx, word := range small.words {
+		if word&large.words[idx] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Slots returns the slots set in the bitmap in ascending order
+func (b *SlotBitmap) Slots() []uint64 {
+	indices := make([]uint64, 0, len(b.words))
+	for idx := range b.words {
+		indices = append(indices, idx)
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+
+	var slots []uint64
+	for _, idx := range indices {
+		for word := b.words[idx]; word != 0; word &= word - 1 {
+			slots = append(slots, idx<<6|uint64(bits.TrailingZeros64(word)))
+		}
+	}
+	return slots
+}
+
+// TouchedSlotsBitmap returns a bitmap over the low 64 bits of the slots of the account
+// touched in the storage key tree or by raw state changes. Slots sharing the low bits
+// are folded into the same bit, so an intersection of two bitmaps may report a conflict
+// that does not exist but never misses one.
+func (s *StateChanges) TouchedSlotsBitmap(account common.Address) *SlotBitmap {
+	bitmap := NewSlotBitmap()
+	add := func(slot uint256.Int) {
+		bitmap.Add(slot[0])
+	}
+	for slot := range s.index[account] {
+		add(slot)
+	}
+	for slot := range s.raw[account] {
+		add(slot)
+	}
+	return bitmap
+}
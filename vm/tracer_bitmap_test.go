@@ -0,0 +1,44 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSlotBitmap(t *testing.T) {
+	bitmap := NewSlotBitmap()
+	for _, slot := range []uint64{1, 63, 64, 1 << 40, 1} {
+		bitmap.Add(slot)
+	}
+	require.Equal(t, 4, bitmap.Len())
+	require.True(t, bitmap.Contains(64))
+	require.False(t, bitmap.Contains(65))
+	require.Equal(t, []uint64{1, 63, 64, 1 << 40}, bitmap.Slots())
+}
+
+func TestTouchedSlotsBitmapIntersection(t *testing.T) {
+	var (
+		account = common.Address{1}
+		typeId  = common.Hash{1}
+		first   = NewStateChanges()
+		second  = NewStateChanges()
+	)
+	for _, slot := range []uint64{0, 3, 70} {
+		require.NoError(t, first.saveKey(account, nil, uint256.NewInt(slot), nil, typeId, common.Hash{}, nil))
+	}
+	first.saveRawStateChange(account, *uint256.NewInt(1000), 0, common.Hash{1})
+	for _, slot := range []uint64{3, 1000, 5000} {
+		second.saveRawStateChange(account, *uint256.NewInt(slot), 0, common.Hash{1})
+	}
+
+	firstBitmap, secondBitmap := first.TouchedSlotsBitmap(account), second.TouchedSlotsBitmap(account)
+	require.Equal(t, []uint64{0, 3, 70, 1000}, firstBitmap.Slots())
+	require.True(t, firstBitmap.Intersects(secondBitmap))
+	require.Equal(t, []uint64{3, 1000}, firstBitmap.And(secondBitmap).Slots())
+
+	require.Zero(t, first.TouchedSlotsBitmap(common.Address{2}).Len())
+	require.False(t, firstBitmap.Intersects(first.TouchedSlotsBitmap(common.Address{2})))
+}
@@ -0,0 +1,343 @@
+package vm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+)
+
+const (
+	// keyEntry marks an encoded entry holding the storage key tree of an account
+	keyEntry byte = iota
+	// rawEntry marks an encoded entry holding a raw change of a storage slot
+	rawEntry
+)
+
+// the flags of an encoded storage key
+const (
+	keyHasSlot    byte = 1 << iota // the key has a slot, which all but the root keys have
+	keyHasData                     // the key has a name or an index
+	keyHasChanges                  // the key has changes
+	keyIndexed                     // the key is found by slot, offset and type id
+	keyInChildren                  // the key is a child of its parent by slot and offset
+	keyInIndex                     // the key is a child of its parent by name or index
+)
+
+var errInvalidEncoding = errors.New("invalid state changes encoding")
+
+// MarshalBinary encodes the storage changes as a sequence of
+// call index (uint64 big-endian), value length (uint32 big-endian) and value bytes,
+// ordered by call index and then by the order of changes.
+func (c *StorageChanges) MarshalBinary() ([]byte, error) {
+	indices := make([]uint64, 0, len(c.changes))
+	for callIdx := range c.changes {
+		indices = append(indices, callIdx)
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+
+	var buf []byte
+	for _, callIdx := range indices {
+		for _, val := range c.changes[callIdx] {
+			buf = binary.BigEndian.AppendUint64(buf, callIdx)
+			buf = binary.BigEndian.AppendUint32(buf, uint32(len(val)))
+			buf = append(buf, val...)
+		}
+	}
+	return buf, nil
+}
+
+// UnmarshalBinary decodes the storage changes encoded by MarshalBinary
+func (c *StorageChanges) UnmarshalBinary(data []byte) error {
+	changes := make(map[uint64][][]byte)
+	for len(data) > 0 {
+		if len(data) < 12 {
+			return errInvalidEncoding
+		}
+		callIdx := binary.BigEndian.Uint64(data)
+		size := uint64(binary.BigEndian.Uint32(data[8:]))
+		data = data[12:]
+		if uint64(len(data)) < size {
+			return errInvalidEncoding
+		}
+		changes[callIdx] = append(changes[callIdx], common.CopyBytes(data[:size]))
+		data = data[size:]
+	}
+
+	c.changes = changes
+	return nil
+}
+
+// MarshalBinary encodes the storage key trees and the raw storage changes of all accounts.
+// Each entry is the account address and an entry kind followed by, for key entries, the
+// root key of the account, or for raw entries, the slot (32 bytes), call index (uint64
+// big-endian) and value (32 bytes). A key is encoded as its flags, node type, slot
+// (32 bytes, unless root), offset, type id (32 bytes), the length (uint32 big-endian)
+// and bytes of its name or index, the length and encoding of its StorageChanges if any,
+// then the number of its children (uint32 big-endian) and the children themselves.
+// The self-destructs, creations, reads and callers recorded along are not encoded.
+func (s *StateChanges) MarshalBinary() ([]byte, error) {
+	var (
+		buf       []byte
+		appendKey func(account common.Address, key *StorageKey, flags byte) error
+	)
+	appendKey = func(account common.Address, key *StorageKey, flags byte) error {
+		if key.slot != nil {
+			flags |= keyHasSlot
+			if s.findKey(account, key.slot, key.offset, key.typeId) == key {
+				flags |= keyIndexed
+			}
+		}
+		if key.data != nil {
+			flags |= keyHasData
+		}
+		if key.changes != nil {
+			flags |= keyHasChanges
+		}
+
+		buf = append(buf, flags, byte(key.nodeType))
+		if key.slot != nil {
+			slot := key.slot.Bytes32()
+			buf = append(buf, slot[:]...)
+		}
+		buf = append(buf, key.offset)
+		buf = append(buf, key.typeId.Bytes()...)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(key.data)))
+		buf = append(buf, key.data...)
+		if key.changes != nil {
+			enc, err := key.changes.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			buf = binary.BigEndian.AppendUint32(buf, uint32(len(enc)))
+			buf = append(buf, enc...)
+		}
+
+		children, childFlags := key.encodedChildren()
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(children)))
+		for i, child := range children {
+			if err := appendKey(account, child, childFlags[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, account := range s.Accounts() {
+		if root := s.roots[account]; root != nil {
+			buf = append(buf, account.Bytes()...)
+			buf = append(buf, keyEntry)
+			if err := appendKey(account, root, 0); err != nil {
+				return nil, err
+			}
+		}
+
+		slots := make([]uint256.Int, 0, len(s.raw[account]))
+		for slot := range s.raw[account] {
+			slots = append(slots, slot)
+		}
+		sort.Slice(slots, func(i, j int) bool { return slots[i].Lt(&slots[j]) })
+
+		for _, slot := range slots {
+			indices := make([]uint64, 0, len(s.raw[account][slot]))
+			for callIdx := range s.raw[account][slot] {
+				indices = append(indices, callIdx)
+			}
+			sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+
+			slotBytes := slot.Bytes32()
+			for _, callIdx := range indices {
+				buf = append(buf, account.Bytes()...)
+				buf = append(buf, rawEntry)
+				buf = append(buf, slotBytes[:]...)
+				buf = binary.BigEndian.AppendUint64(buf, callIdx)
+				buf = append(buf, s.raw[account][slot][callIdx].Bytes()...)
+			}
+		}
+	}
+	return buf, nil
+}
+
+// encodedChildren returns the children of a storage key, found either by slot and offset or
+// by name or index, ordered by name or index, slot, offset and type id, along with the
+// keyInChildren and keyInIndex flags telling how each child is found
+func (k *StorageKey) encodedChildren() ([]*StorageKey, []byte) {
+	flags := make(map[*StorageKey]byte, len(k.childrenIndex))
+	for _, offsets := range k.children {
+		for _, child := range offsets {
+			flags[child] |= keyInChildren
+		}
+	}
+	for _, child := range k.childrenIndex {
+		flags[child] |= keyInIndex
+	}
+
+	children := make([]*StorageKey, 0, len(flags))
+	for child := range flags {
+		children = append(children, child)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		a, b := children[i], children[j]
+		if cmp := bytes.Compare(a.data, b.data); cmp != 0 {
+			return cmp < 0
+		}
+		if cmp := a.slot.Cmp(b.slot); cmp != 0 {
+			return cmp < 0
+		}
+		if a.offset != b.offset {
+			return a.offset < b.offset
+		}
+		return a.typeId.Less(b.typeId)
+	})
+
+	childFlags := make([]byte, len(children))
+	for i, child := range children {
+		childFlags[i] = flags[child]
+	}
+	return children, childFlags
+}
+
+// binaryReader reads the fields of an encoding, recording errInvalidEncoding
+// once a field runs past the end of the input
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binaryReader) read(n uint64) []byte {
+	if r.err != nil || uint64(len(r.data)) < n {
+		r.err = errInvalidEncoding
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *binaryReader) readByte() byte {
+	if b := r.read(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *binaryReader) readUint32() uint32 {
+	if b := r.read(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *binaryReader) readUint64() uint64 {
+	if b := r.read(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+// UnmarshalBinary decodes the state changes encoded by MarshalBinary,
+// the existing changes are discarded.
+func (s *StateChanges) UnmarshalBinary(data []byte) error {
+	var (
+		decoded = NewStateChanges()
+		r       = &binaryReader{data: data}
+		readKey func(account common.Address) (*StorageKey, byte)
+	)
+	readKey = func(account common.Address) (*StorageKey, byte) {
+		flags, nodeType := r.readByte(), NodeType(r.readByte())
+		key := &StorageKey{
+			children:      make(map[uint256.Int]map[uint8]*StorageKey),
+			childrenIndex: make(map[string]*StorageKey),
+			nodeType:      nodeType,
+		}
+		if flags&keyHasSlot != 0 {
+			key.slot = new(uint256.Int).SetBytes(r.read(common.HashLength))
+		}
+		key.offset = r.readByte()
+		key.typeId = common.BytesToHash(r.read(common.HashLength))
+		name := r.read(uint64(r.readUint32()))
+		if flags&keyHasData != 0 {
+			key.data = append([]byte{}, name...)
+		}
+		if flags&keyHasChanges != 0 {
+			enc := r.read(uint64(r.readUint32()))
+			if r.err != nil {
+				return nil, 0
+			}
+			key.changes = newStorageChange()
+			if err := key.changes.UnmarshalBinary(enc); err != nil {
+				r.err = err
+				return nil, 0
+			}
+		}
+
+		for n := r.readUint32(); n > 0 && r.err == nil; n-- {
+			child, childFlags := readKey(account)
+			if r.err != nil {
+				return nil, 0
+			}
+			if child.slot == nil {
+				r.err = errInvalidEncoding
+				return nil, 0
+			}
+			child.parent = key
+			if childFlags&keyInChildren != 0 {
+				if key.children[*child.slot] == nil {
+					key.children[*child.slot] = make(map[uint8]*StorageKey)
+				}
+				key.children[*child.slot][child.offset] = child
+			}
+			if childFlags&keyInIndex != 0 {
+				key.childrenIndex[string(child.data)] = child
+			}
+		}
+		if r.err == nil && flags&keyIndexed != 0 {
+			if key.slot == nil {
+				r.err = errInvalidEncoding
+				return nil, 0
+			}
+			decoded.addKey(account, key.slot, key.offset, key)
+		}
+		return key, flags
+	}
+
+	for len(r.data) > 0 {
+		account := common.BytesToAddress(r.read(common.AddressLength))
+		switch r.readByte() {
+		case keyEntry:
+			root, _ := readKey(account)
+			if r.err != nil {
+				return r.err
+			}
+			if root.slot != nil || decoded.roots[account] != nil {
+				return errInvalidEncoding
+			}
+			decoded.roots[account] = root
+		case rawEntry:
+			slot := new(uint256.Int).SetBytes(r.read(common.HashLength))
+			callIdx := r.readUint64()
+			val := common.BytesToHash(r.read(common.HashLength))
+			if r.err != nil {
+				return r.err
+			}
+			if decoded.raw[account] == nil {
+				decoded.raw[account] = make(map[uint256.Int]map[uint64]common.Hash)
+			}
+			if decoded.raw[account][*slot] == nil {
+				decoded.raw[account][*slot] = make(map[uint64]common.Hash)
+			}
+			decoded.raw[account][*slot][callIdx] = val
+		default:
+			return errInvalidEncoding
+		}
+		if r.err != nil {
+			return r.err
+		}
+	}
+
+	*s = *decoded
+	return nil
+}
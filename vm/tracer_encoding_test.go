@@ -0,0 +1,158 @@
+package vm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
+)
+
+// storageChangesEqual compares the changes of two StorageChanges, nil and empty values are equal
+func storageChangesEqual(a, b *StorageChanges) bool {
+	if len(a.changes) != len(b.changes) {
+		return false
+	}
+	for callIdx, vals := range a.changes {
+		other, ok := b.changes[callIdx]
+		if !ok || len(vals) != len(other) {
+			return false
+		}
+		for i := range vals {
+			if !bytes.Equal(vals[i], other[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func FuzzStorageChangesBinary(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0, 1, 2, 3, 4, 5, 6})
+	f.Add([]byte{1, 0, 1, 0, 2, 32, 255})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// each change takes a call index and a value length from the input, followed by the value
+		changes := newStorageChange()
+		for len(data) >= 2 {
+			callIdx, size := uint64(data[0]%4), int(data[1])%8
+			data = data[2:]
+			if size > len(data) {
+				size = len(data)
+			}
+			changes.changes[callIdx] = append(changes.changes[callIdx], common.CopyBytes(data[:size]))
+			data = data[size:]
+		}
+
+		enc, err := changes.MarshalBinary()
+		require.NoError(t, err)
+
+		decoded := newStorageChange()
+		require.NoError(t, decoded.UnmarshalBinary(enc))
+		require.True(t, storageChangesEqual(changes, decoded), "have %v, want %v", decoded.changes, changes.changes)
+	})
+}
+
+func TestStorageChangesUnmarshalInvalid(t *testing.T) {
+	changes := newStorageChange()
+	changes.append(1, []byte{1, 2, 3})
+	enc, err := changes.MarshalBinary()
+	require.NoError(t, err)
+
+	require.Error(t, newStorageChange().UnmarshalBinary(enc[:len(enc)-1]))
+	require.Error(t, newStorageChange().UnmarshalBinary(enc[:5]))
+}
+
+// requireStateChangesRoundTrip checks that the state changes decode to themselves,
+// apart from the journal which is not encoded
+func requireStateChangesRoundTrip(t *testing.T, states *StateChanges) []byte {
+	enc, err := states.MarshalBinary()
+	require.NoError(t, err)
+
+	decoded := NewStateChanges()
+	require.NoError(t, decoded.UnmarshalBinary(enc))
+	want := *states
+	want.journal = nil
+	require.Equal(t, &want, decoded)
+
+	// encoding is deterministic
+	reencoded, err := decoded.MarshalBinary()
+	require.NoError(t, err)
+	require.Equal(t, enc, reencoded)
+	return enc
+}
+
+func TestStateChangesBinary(t *testing.T) {
+	var (
+		states  = NewStateChanges()
+		account = common.Address{1}
+		other   = common.Address{2}
+		typeId  = common.Hash{1}
+	)
+	states.saveBalance(account, uint256.NewInt(100), 0)
+	states.saveBalance(account, uint256.NewInt(50), 1)
+	require.NoError(t, states.saveKey(account, nil, uint256.NewInt(0), nil, typeId, common.Hash{}, []byte("a")))
+	require.NoError(t, states.saveKey(account, nil, uint256.NewInt(0), uint256.NewInt(16), typeId, common.Hash{}, []byte("b")))
+	require.NoError(t, states.saveKey(account, uint256.NewInt(0), uint256.NewInt(7), nil, common.Hash{2}, typeId, []byte{1}))
+	require.NoError(t, states.saveKey(other, nil, uint256.NewInt(3), nil, typeId, common.Hash{}, []byte("c")))
+	// keys without changes are encoded as well
+	require.NoError(t, states.saveKey(other, nil, uint256.NewInt(4), nil, typeId, common.Hash{}, []byte("d")))
+	require.NoError(t, states.saveChange(account, uint256.NewInt(0), nil, typeId, 0, []byte{1}))
+	require.NoError(t, states.saveChange(account, uint256.NewInt(0), uint256.NewInt(16), typeId, 1, []byte{2}))
+	require.NoError(t, states.saveChange(account, uint256.NewInt(7), nil, common.Hash{2}, 1, []byte{4}))
+	require.NoError(t, states.saveChange(other, uint256.NewInt(3), nil, typeId, 1, []byte{3}))
+	states.saveRawStateChange(account, *uint256.NewInt(7), 1, common.Hash{4})
+	states.saveRawStateChange(common.Address{3}, *uint256.NewInt(1), 2, common.Hash{5})
+	// nested keys built without the EVM are not indexed
+	states.AddVariable(other, "e", uint256.NewInt(5), 0, typeId).AddNestedChild([]byte{2}, uint256.NewInt(9), 0, typeId).RecordChange(2, []byte{6})
+
+	enc := requireStateChangesRoundTrip(t, states)
+
+	decoded := NewStateChanges()
+	require.NoError(t, decoded.UnmarshalBinary(enc))
+	have, err := decoded.Slot(account, uint256.NewInt(7), nil, common.Hash{2})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{4}}, have.changes[1])
+	require.Equal(t, "a", string(decoded.roots[account].childrenIndex["a"].data))
+	require.Same(t, decoded.roots[account].childrenIndex["a"], decoded.roots[account].childrenIndex["a"].childrenIndex[string([]byte{1})].parent)
+
+	require.Error(t, NewStateChanges().UnmarshalBinary(enc[:len(enc)-1]))
+}
+
+func FuzzStateChangesBinary(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11})
+	f.Add([]byte{1, 0, 1, 2, 2, 0, 3, 3, 3, 1, 0, 2, 4, 1, 3, 1})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		// each operation takes an opcode, an account, a slot and a value from the input
+		var (
+			states = NewStateChanges()
+			keys   []*StorageKey
+		)
+		for len(data) >= 4 {
+			op, account, slot, val := data[0]%5, common.Address{data[1] % 2}, uint256.NewInt(uint64(data[2]%4)), data[3:4]
+			data = data[4:]
+			switch op {
+			case 0:
+				states.saveBalance(account, new(uint256.Int).SetBytes(val), slot.Uint64())
+			case 1:
+				keys = append(keys, states.AddVariable(account, string(val), slot, 0, common.Hash{}))
+			case 2:
+				if len(keys) > 0 {
+					keys = append(keys, keys[len(keys)-1].AddNestedChild(val, slot, val[0]%2, common.Hash{}))
+				}
+			case 3:
+				if len(keys) > 0 {
+					keys[int(val[0])%len(keys)].RecordChange(slot.Uint64(), val)
+				}
+			case 4:
+				states.saveRawStateChange(account, *slot, uint64(val[0]%2), common.BytesToHash(val))
+			}
+		}
+
+		requireStateChangesRoundTrip(t, states)
+	})
+}
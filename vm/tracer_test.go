@@ -1,8 +1,15 @@
 package vm
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"math/big"
+	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -10,7 +17,11 @@ import (
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/holiman/uint256"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewCommands(t *testing.T) {
@@ -78,3 +89,1828 @@ func TestNewCommands(t *testing.T) {
 	// assert.True(t, bytes.Compare(stateChange2[0].Account.Bytes(), common.Address{}.Bytes()) == 0, "state 0 account not eq")
 	// assert.True(t, bytes.Compare(stateChange2[1].Account.Bytes(), sender.Bytes()) == 0, "state 1 account not eq")
 }
+
+func TestCallTreeMaxWidth(t *testing.T) {
+	tree := NewCallTree()
+	require.Equal(t, 0, tree.MaxWidth())
+	require.Nil(t, tree.WidestCall())
+
+	to := common.Address{}
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	for i := 0; i < 3; i++ {
+		tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+		if i == 0 {
+			// give the first child a single grandchild
+			tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+			tree.exit(0, nil, nil)
+		}
+		tree.exit(0, nil, nil)
+	}
+	tree.exit(0, nil, nil)
+
+	require.Equal(t, 3, tree.MaxWidth())
+	require.Equal(t, tree.Root(), tree.WidestCall())
+}
+
+func TestCallTreeFind(t *testing.T) {
+	var (
+		tree    = NewCallTree()
+		account = common.Address{1}
+		other   = common.Address{2}
+	)
+	require.Nil(t, tree.FindByAddress(account))
+	require.Nil(t, tree.FindByValue(uint256.NewInt(0)))
+
+	tree.add(common.Address{}, &account, nil, uint256.NewInt(10), uint256.NewInt(0))
+	// contract creation without a callee
+	tree.add(account, nil, nil, uint256.NewInt(5), uint256.NewInt(0))
+	tree.exit(0, nil, nil)
+	tree.add(account, &other, nil, uint256.NewInt(20), uint256.NewInt(0))
+	tree.add(other, &other, nil, nil, uint256.NewInt(0))
+	tree.exit(0, nil, nil)
+	tree.exit(0, nil, nil)
+	tree.exit(0, nil, nil)
+
+	indices := func(calls []*Call) []uint64 {
+		res := make([]uint64, 0, len(calls))
+		for _, call := range calls {
+			res = append(res, call.Index)
+		}
+		return res
+	}
+	require.Equal(t, []uint64{0, 1, 2}, indices(tree.FindByAddress(account)))
+	require.Equal(t, []uint64{2, 3}, indices(tree.FindByAddress(other)))
+	require.Nil(t, tree.FindByAddress(common.Address{3}))
+
+	require.Equal(t, []uint64{0, 2}, indices(tree.FindByValue(uint256.NewInt(10))))
+	require.Equal(t, []uint64{2}, indices(tree.FindByValue(uint256.NewInt(11))))
+	require.Equal(t, []uint64{0, 1, 2}, indices(tree.FindByValue(nil)))
+}
+
+func TestCallMeta(t *testing.T) {
+	tree := NewCallTree()
+	to := common.Address{}
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tree.exit(0, nil, nil)
+
+	call := tree.FindCall(0)
+	_, ok := call.GetMeta("selector")
+	require.False(t, ok)
+	require.Nil(t, call.Meta)
+
+	call.SetMeta("selector", "transfer")
+	v, ok := tree.Root().GetMeta("selector")
+	require.True(t, ok)
+	require.Equal(t, "transfer", v)
+}
+
+func TestCallTreeWalk(t *testing.T) {
+	tree := NewCallTree()
+	require.NoError(t, tree.Walk(nil, nil))
+
+	to := common.Address{}
+	// 0 -> (1 -> 2), 3
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tree.exit(0, nil, nil)
+	tree.exit(0, nil, nil)
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tree.exit(0, nil, nil)
+	tree.exit(0, nil, nil)
+
+	var order []string
+	visit := func(prefix string) func(*Call) error {
+		return func(call *Call) error {
+			order = append(order, fmt.Sprintf("%s%d", prefix, call.Index))
+			return nil
+		}
+	}
+	require.NoError(t, tree.Walk(visit("pre"), visit("post")))
+	require.Equal(t, []string{"pre0", "pre1", "pre2", "post2", "post1", "pre3", "post3", "post0"}, order)
+
+	order = nil
+	require.NoError(t, tree.Walk(nil, visit("post")))
+	require.Equal(t, []string{"post2", "post1", "post3", "post0"}, order)
+
+	// the traversal stops at the first error
+	order = nil
+	stop := errors.New("stop")
+	err := tree.Walk(func(call *Call) error {
+		order = append(order, fmt.Sprintf("pre%d", call.Index))
+		if call.Index == 2 {
+			return stop
+		}
+		return nil
+	}, visit("post"))
+	require.Equal(t, stop, err)
+	require.Equal(t, []string{"pre0", "pre1", "pre2"}, order)
+}
+
+func TestCallTreeFlatten(t *testing.T) {
+	tree := NewCallTree()
+	require.Empty(t, tree.Flatten())
+	require.Empty(t, tree.FlattenDFS())
+
+	to := common.Address{}
+	// 0 -> (1 -> (2 -> 3)), 4 -> 5
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tree.exit(0, nil, ErrExecutionReverted)
+	tree.exit(0, nil, nil)
+	tree.exit(0, nil, ErrOutOfGas)
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tree.exit(0, nil, nil)
+	tree.exit(0, nil, nil)
+	tree.exit(0, nil, nil)
+
+	indices := func(calls []*Call) []uint64 {
+		res := make([]uint64, 0, len(calls))
+		for _, call := range calls {
+			res = append(res, call.Index)
+		}
+		return res
+	}
+	require.Equal(t, []uint64{0, 1, 2, 3, 4, 5}, indices(tree.Flatten()))
+	require.Equal(t, []uint64{0, 1, 2, 3, 4, 5}, indices(tree.FlattenDFS()))
+
+	// top level calls made after the root exits are included
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tree.exit(0, nil, nil)
+	tree.exit(0, nil, nil)
+	require.Equal(t, []uint64{0, 1, 2, 3, 4, 5, 6, 7}, indices(tree.Flatten()))
+	require.Equal(t, []uint64{0, 1, 2, 3, 4, 5, 6, 7}, indices(tree.FlattenDFS()))
+	require.Equal(t, tree.FindCall(6), tree.FindCall(7).Parent)
+}
+
+func TestTracerSelfDestruct(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	vmctx := BlockContext{
+		CanTransfer: func(db StateDB, address common.Address, amount *big.Int) bool {
+			return db.GetBalance(address).Cmp(amount) >= 0
+		},
+		Transfer: func(db StateDB, sender, recipient common.Address, amount *big.Int) {
+			db.SubBalance(sender, amount)
+			db.AddBalance(recipient, amount)
+		},
+		BlockNumber: big0,
+	}
+
+	var (
+		sender      = common.Address{1}
+		contract    = common.Address{2}
+		beneficiary = common.Address{3}
+	)
+	// PUSH20 beneficiary SELFDESTRUCT
+	code := append([]byte{byte(PUSH20)}, beneficiary.Bytes()...)
+	statedb.SetCode(contract, append(code, byte(SELFDESTRUCT)))
+	statedb.AddBalance(contract, big.NewInt(100))
+
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+	evm.CloseAspectCall()
+	_, _, err := evm.Call(context.Background(), AccountRef(sender), contract, nil, 100000, new(big.Int))
+	require.NoError(t, err)
+
+	stateChanges := evm.Tracer().StateChanges()
+	require.Equal(t, []common.Address{contract}, stateChanges.SelfDestructs())
+
+	beneficiaryChanges := stateChanges.Balance(beneficiary).Changes()[0]
+	require.Equal(t, uint64(100), new(uint256.Int).SetBytes(beneficiaryChanges[len(beneficiaryChanges)-1]).Uint64())
+
+	contractChanges := stateChanges.Balance(contract).Changes()[0]
+	require.True(t, new(uint256.Int).SetBytes(contractChanges[len(contractChanges)-1]).IsZero())
+
+	require.Equal(t, []SelfdestructRecord{
+		{Address: contract, Beneficiary: beneficiary, Balance: uint256.NewInt(100), CallIndex: 0},
+	}, stateChanges.SelfdestructedContracts())
+}
+
+func TestCallTreePrune(t *testing.T) {
+	tree := NewCallTree()
+	to := common.Address{}
+	// 0 -> (1 -> (2, 3), 4)
+	for _, gas := range []uint64{0, 1, 2} {
+		tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(gas))
+	}
+	tree.exit(0, nil, nil)
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(3))
+	tree.exit(0, nil, nil)
+	tree.exit(0, nil, nil)
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(4))
+	tree.exit(0, nil, nil)
+	tree.exit(0, nil, nil)
+	tree.Root().SetMeta("label", "root")
+
+	parents := func(tree *CallTree) map[uint64]int64 {
+		res := make(map[uint64]int64)
+		for _, call := range tree.Flatten() {
+			res[call.Index] = call.ParentIndex()
+		}
+		return res
+	}
+	without := func(indices ...uint64) func(*Call) bool {
+		return func(call *Call) bool {
+			for _, index := range indices {
+				if call.Index == index {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	// leaves
+	leaves := tree.Prune(without(2, 4))
+	require.Equal(t, map[uint64]int64{0: -1, 1: 0, 3: 1}, parents(leaves))
+	require.Equal(t, []uint64{1}, leaves.Root().ChildrenIndices())
+
+	// interior, the children are attached to the root
+	interior := tree.Prune(without(1))
+	require.Equal(t, map[uint64]int64{0: -1, 2: 0, 3: 0, 4: 0}, parents(interior))
+	require.Equal(t, []uint64{2, 3, 4}, interior.Root().ChildrenIndices())
+	require.Equal(t, uint64(3), interior.FindCall(3).Gas.Uint64())
+
+	// root, the children become top level calls
+	root := tree.Prune(without(0))
+	require.Equal(t, map[uint64]int64{1: -1, 2: 1, 3: 1, 4: -1}, parents(root))
+	require.Equal(t, uint64(1), root.Root().Index)
+	require.Len(t, root.FlattenDFS(), 4)
+	require.Equal(t, uint64(4), root.FlattenDFS()[3].Index)
+
+	// the original tree is left unchanged
+	interior.Root().SetMeta("label", "pruned")
+	label, _ := tree.Root().GetMeta("label")
+	require.Equal(t, "root", label)
+	require.Equal(t, map[uint64]int64{0: -1, 1: 0, 2: 1, 3: 1, 4: 0}, parents(tree))
+	require.Equal(t, []uint64{1, 4}, tree.Root().ChildrenIndices())
+}
+
+func TestCallTreeOverProvisionedCalls(t *testing.T) {
+	tree := NewCallTree()
+	to := common.Address{}
+	// 0 -> (1, 2, 3), the calls use 60%, 10%, 50% and none of their gas
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(10000))
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(1000))
+	tree.exit(900, nil, nil)
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(1000))
+	tree.exit(500, nil, nil)
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tree.exit(0, nil, nil)
+	tree.exit(4000, nil, nil)
+
+	calls := tree.OverProvisionedCalls(0.5)
+	require.Len(t, calls, 1)
+	require.Equal(t, uint64(1), calls[0].Index)
+	require.Len(t, tree.OverProvisionedCalls(0.3), 3)
+	require.Empty(t, tree.OverProvisionedCalls(0.9))
+}
+
+func TestCallTreeGasReport(t *testing.T) {
+	tree := NewCallTree()
+	require.Empty(t, tree.GasReport())
+
+	to := common.Address{}
+	// 0 -> (1 -> 2, 3)
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(10000))
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(5000))
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(2000))
+	tree.exit(500, nil, nil)
+	tree.exit(2000, nil, nil)
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(1000))
+	tree.exit(0, nil, ErrOutOfGas)
+	tree.exit(1000, nil, nil)
+
+	require.Equal(t, []CallGas{
+		{Index: 0, ParentIndex: -1, Provided: 10000, Remaining: 1000, UsedBySelf: 9000 - 3000 - 1000},
+		{Index: 1, ParentIndex: 0, Provided: 5000, Remaining: 2000, UsedBySelf: 3000 - 1500},
+		{Index: 2, ParentIndex: 1, Provided: 2000, Remaining: 500, UsedBySelf: 1500},
+		{Index: 3, ParentIndex: 0, Provided: 1000, Remaining: 0, UsedBySelf: 1000},
+	}, tree.GasReport())
+}
+
+func TestCallTreeGasBreakdown(t *testing.T) {
+	tree := NewCallTree()
+	self, byChild := tree.GasBreakdown(0)
+	require.Zero(t, self)
+	require.Nil(t, byChild)
+
+	to := common.Address{}
+	// 0 -> (1, 2)
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(100000))
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(30000))
+	tree.exit(10000, nil, nil)
+	tree.add(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(20000))
+	tree.exit(5000, nil, nil)
+	tree.exit(10000, nil, nil)
+
+	self, byChild = tree.GasBreakdown(0)
+	require.Equal(t, map[uint64]uint64{1: 20000, 2: 15000}, byChild)
+	require.Equal(t, uint64(90000-20000-15000), self)
+	require.Equal(t, callGasUsed(tree.Root()), self+byChild[1]+byChild[2])
+
+	// a call without children uses all its gas itself
+	self, byChild = tree.GasBreakdown(2)
+	require.Equal(t, uint64(15000), self)
+	require.Empty(t, byChild)
+}
+
+func TestStateChangesSelfdestructRecreate(t *testing.T) {
+	var (
+		states      = NewStateChanges()
+		contract    = common.Address{1}
+		beneficiary = common.Address{2}
+		other       = common.Address{3}
+	)
+	states.saveSelfDestruct(contract, beneficiary, uint256.NewInt(100), 0)
+	// destructing again before recreation adds to the same record
+	states.saveSelfDestruct(contract, other, uint256.NewInt(5), 1)
+	require.Equal(t, []SelfdestructRecord{
+		{Address: contract, Beneficiary: beneficiary, Balance: uint256.NewInt(105), CallIndex: 0},
+	}, states.SelfdestructedContracts())
+
+	// the contract is recreated and destructed again later in the block
+	states.saveCreation(contract)
+	checkpoint := states.Checkpoint()
+	states.saveSelfDestruct(contract, other, uint256.NewInt(7), 2)
+	require.Equal(t, []common.Address{contract}, states.SelfDestructs())
+	require.Equal(t, []SelfdestructRecord{
+		{Address: contract, Beneficiary: beneficiary, Balance: uint256.NewInt(105), CallIndex: 0},
+		{Address: contract, Beneficiary: other, Balance: uint256.NewInt(7), CallIndex: 2},
+	}, states.SelfdestructedContracts())
+
+	states.RevertToCheckpoint(checkpoint)
+	require.Len(t, states.SelfdestructedContracts(), 1)
+
+	// reverting the recreation merges further destructions into the first record again
+	states.RevertToCheckpoint(checkpoint - 1)
+	states.saveSelfDestruct(contract, other, uint256.NewInt(1), 3)
+	require.Equal(t, []SelfdestructRecord{
+		{Address: contract, Beneficiary: beneficiary, Balance: uint256.NewInt(106), CallIndex: 0},
+	}, states.SelfdestructedContracts())
+}
+
+func TestStorageChangesDeltas(t *testing.T) {
+	changes := newStorageChange()
+	require.Nil(t, changes.Deltas(0))
+
+	for _, val := range []uint64{10, 15, 3, 300} {
+		changes.append(0, uint256.NewInt(val).Bytes())
+	}
+	changes.append(1, uint256.NewInt(1).Bytes())
+
+	require.Equal(t, []*big.Int{big.NewInt(5), big.NewInt(-12), big.NewInt(297)}, changes.Deltas(0))
+	require.Nil(t, changes.Deltas(1))
+	require.Nil(t, changes.Deltas(2))
+}
+
+func TestStorageChangesSignedChanges(t *testing.T) {
+	changes := newStorageChange()
+	require.Nil(t, changes.SignedChanges(0))
+
+	// int256(-5), int256(5), int128(-1), int8(-128), int8(127)
+	minus5 := uint256.NewInt(0).Sub(uint256.NewInt(0), uint256.NewInt(5)).Bytes32()
+	plus5 := uint256.NewInt(5).Bytes32()
+	for _, val := range [][]byte{minus5[:], plus5[:], bytes.Repeat([]byte{0xff}, 16), {0x80}, {0x7f}} {
+		changes.append(0, val)
+	}
+	changes.append(1, nil)
+
+	require.Equal(t, []*big.Int{big.NewInt(-5), big.NewInt(5), big.NewInt(-1), big.NewInt(-128), big.NewInt(127)}, changes.SignedChanges(0))
+	require.Equal(t, []*big.Int{big.NewInt(0)}, changes.SignedChanges(1))
+	require.Nil(t, changes.SignedChanges(2))
+}
+
+func TestStateChangesFirstSetters(t *testing.T) {
+	var (
+		tracer  = NewTracer()
+		account = common.Address{1}
+		alice   = common.Address{0xa}
+		bob     = common.Address{0xb}
+		typeId  = common.Hash{1}
+	)
+	require.Nil(t, tracer.StateChanges().FirstSetters(account))
+
+	require.NoError(t, tracer.SaveStateKey(account, nil, uint256.NewInt(0), nil, typeId, common.Hash{}, []byte("a")))
+	require.NoError(t, tracer.SaveStateKey(account, nil, uint256.NewInt(1), nil, typeId, common.Hash{}, []byte("b")))
+	require.NoError(t, tracer.SaveStateKey(account, nil, uint256.NewInt(2), nil, typeId, common.Hash{}, []byte("c")))
+	require.NoError(t, tracer.SaveStateKey(account, uint256.NewInt(1), uint256.NewInt(3), nil, typeId, typeId, []byte{1}))
+
+	tracer.SaveCall(alice, &account, nil, uint256.NewInt(0), uint256.NewInt(100))
+	require.NoError(t, tracer.SaveStateChange(account, uint256.NewInt(0), nil, typeId, []byte{1}))
+
+	tracer.SaveCall(bob, &account, nil, uint256.NewInt(0), uint256.NewInt(50))
+	// b is first set through its nested key
+	require.NoError(t, tracer.SaveStateChange(account, uint256.NewInt(3), nil, typeId, []byte{2}))
+	require.NoError(t, tracer.SaveStateChange(account, uint256.NewInt(0), nil, typeId, []byte{3}))
+	tracer.ExitCall(10, nil, nil)
+
+	// the change of c is reverted
+	tracer.SaveCall(bob, &account, nil, uint256.NewInt(0), uint256.NewInt(50))
+	require.NoError(t, tracer.SaveStateChange(account, uint256.NewInt(2), nil, typeId, []byte{4}))
+	tracer.ExitCall(10, nil, ErrExecutionReverted)
+	tracer.ExitCall(20, nil, nil)
+
+	require.Equal(t, map[string]common.Address{"a": alice, "b": bob}, tracer.StateChanges().FirstSetters(account))
+}
+
+func TestStateChangesAccounts(t *testing.T) {
+	states := NewStateChanges()
+	require.Empty(t, states.Accounts())
+
+	var (
+		balance = common.Address{3}
+		storage = common.Address{1}
+		raw     = common.Address{2}
+	)
+	states.saveBalance(balance, uint256.NewInt(1), 0)
+	require.NoError(t, states.saveKey(storage, nil, uint256.NewInt(0), nil, common.Hash{1}, common.Hash{}, []byte("a")))
+	states.saveRawStateChange(raw, *uint256.NewInt(0), 0, common.Hash{})
+	// an account in several maps is listed once
+	states.saveRawStateChange(storage, *uint256.NewInt(0), 0, common.Hash{})
+
+	require.Equal(t, []common.Address{storage, raw, balance}, states.Accounts())
+}
+
+func TestStorageKeyJSONToDepth(t *testing.T) {
+	var (
+		states  = NewStateChanges()
+		account = common.Address{1}
+		typeId  = common.Hash{1}
+	)
+	// root -> m -> 0x01 -> 0x02 -> 0x03
+	key := states.AddVariable(account, "m", uint256.NewInt(0), 0, typeId)
+	for i := byte(1); i <= 3; i++ {
+		key = key.AddNestedChild([]byte{i}, uint256.NewInt(uint64(i)), 0, typeId)
+	}
+	key.RecordChange(0, []byte{1})
+	root := states.roots[account]
+	require.Equal(t, 4, root.Depth())
+
+	type node struct {
+		Key       string           `json:"key"`
+		Changes   map[uint64][]any `json:"changes"`
+		Children  []*node          `json:"children"`
+		Truncated bool             `json:"truncated"`
+	}
+	decode := func(maxDepth int) *node {
+		data, err := root.JSONToDepth(maxDepth)
+		require.NoError(t, err)
+		var res node
+		require.NoError(t, json.Unmarshal(data, &res))
+		return &res
+	}
+
+	res := decode(2)
+	require.False(t, res.Truncated)
+	require.Len(t, res.Children, 1)
+	require.Equal(t, "m", res.Children[0].Key)
+	require.False(t, res.Children[0].Truncated)
+	require.Len(t, res.Children[0].Children, 1)
+	cutoff := res.Children[0].Children[0]
+	require.Equal(t, "0x01", cutoff.Key)
+	require.True(t, cutoff.Truncated)
+	require.Empty(t, cutoff.Children)
+
+	// the whole tree fits, nothing is truncated
+	res = decode(4)
+	for depth := 0; depth < 4; depth++ {
+		require.False(t, res.Truncated)
+		require.Len(t, res.Children, 1)
+		res = res.Children[0]
+	}
+	require.Equal(t, "0x03", res.Key)
+	require.False(t, res.Truncated)
+	require.Equal(t, map[uint64][]any{0: {"0x01"}}, res.Changes)
+
+	_, err := root.JSONToDepth(-1)
+	require.Error(t, err)
+}
+
+func TestStateChangesBalanceFlows(t *testing.T) {
+	var (
+		tracer = NewTracer()
+		a      = common.Address{1}
+		b      = common.Address{2}
+		c      = common.Address{3}
+	)
+	gainers, losers := tracer.StateChanges().BalanceFlows()
+	require.Empty(t, gainers)
+	require.Empty(t, losers)
+
+	statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.AddBalance(a, big.NewInt(100))
+	statedb.AddBalance(c, big.NewInt(5))
+	transfer := func(db StateDB, sender, recipient common.Address, amount *big.Int) {
+		db.SubBalance(sender, amount)
+		db.AddBalance(recipient, amount)
+	}
+
+	tracer.SaveCall(a, &b, nil, uint256.NewInt(30), uint256.NewInt(100))
+	tracer.TransferWithRecord(statedb, a, b, big.NewInt(30), transfer)
+	// c ends with the balance it started with
+	tracer.TransferWithRecord(statedb, c, b, big.NewInt(5), transfer)
+	tracer.TransferWithRecord(statedb, b, c, big.NewInt(5), transfer)
+	tracer.ExitCall(10, nil, nil)
+
+	gainers, losers = tracer.StateChanges().BalanceFlows()
+	require.Equal(t, []common.Address{b}, gainers)
+	require.Equal(t, []common.Address{a}, losers)
+}
+
+func TestStateChangesFootprint(t *testing.T) {
+	states := NewStateChanges()
+	require.Equal(t, 0, states.Footprint())
+
+	var (
+		account = common.Address{1}
+		other   = common.Address{2}
+	)
+	require.NoError(t, states.saveKey(account, nil, uint256.NewInt(0), nil, common.Hash{1}, common.Hash{}, []byte("a")))
+	require.NoError(t, states.saveKey(account, nil, uint256.NewInt(1), nil, common.Hash{1}, common.Hash{}, []byte("b")))
+	// same slot with a different offset counts once
+	require.NoError(t, states.saveKey(account, nil, uint256.NewInt(1), uint256.NewInt(16), common.Hash{1}, common.Hash{}, []byte("c")))
+
+	// overlaps with the tree
+	states.saveRawStateChange(account, *uint256.NewInt(1), 0, common.Hash{})
+	states.saveRawStateChange(account, *uint256.NewInt(1), 1, common.Hash{1})
+	// raw only
+	states.saveRawStateChange(account, *uint256.NewInt(2), 0, common.Hash{})
+	states.saveRawStateChange(other, *uint256.NewInt(0), 0, common.Hash{})
+
+	require.Equal(t, 4, states.Footprint())
+}
+
+func TestTracerRevertedCall(t *testing.T) {
+	var (
+		tracer  = NewTracer()
+		account = common.Address{1}
+		other   = common.Address{2}
+		slot    = uint256.NewInt(0)
+		typeId  = common.Hash{1}
+	)
+
+	tracer.SaveCall(common.Address{}, &account, nil, uint256.NewInt(0), uint256.NewInt(0))
+	require.NoError(t, tracer.SaveStateKey(account, nil, slot, nil, typeId, common.Hash{}, []byte("counter")))
+	require.NoError(t, tracer.SaveStateChange(account, slot, nil, typeId, []byte{1}))
+	tracer.SaveRawStateChange(account, *slot, common.Hash{1})
+
+	// the inner call reverts, none of its changes should be kept
+	tracer.SaveCall(account, &other, nil, uint256.NewInt(0), uint256.NewInt(0))
+	require.NoError(t, tracer.SaveStateChange(account, slot, nil, typeId, []byte{2}))
+	tracer.SaveRawStateChange(account, *slot, common.Hash{2})
+	tracer.SaveRawStateChange(other, *slot, common.Hash{2})
+	tracer.states.saveBalance(other, uint256.NewInt(10), tracer.CurrentCallIndex())
+	tracer.states.saveSelfDestruct(other, account, uint256.NewInt(10), tracer.CurrentCallIndex())
+	tracer.ExitCall(0, nil, ErrExecutionReverted)
+
+	// a call failed with another error is dropped as well
+	tracer.SaveCall(account, &other, nil, uint256.NewInt(0), uint256.NewInt(0))
+	require.NoError(t, tracer.SaveStateChange(account, slot, nil, typeId, []byte{3}))
+	tracer.SaveLog(tracer.CurrentCallIndex(), &types.Log{Address: other})
+	tracer.ExitCall(0, nil, ErrOutOfGas)
+	tracer.ExitCall(0, nil, nil)
+
+	states := tracer.StateChanges()
+	changes := states.Variable(account, "counter").Changes()
+	require.Equal(t, map[uint64][][]byte{0: {{1}}}, changes)
+	require.Equal(t, map[uint64]common.Hash{0: {1}}, states.raw[account][*slot])
+	require.NotContains(t, states.raw, other)
+	require.Nil(t, states.Balance(other))
+	require.Empty(t, states.SelfDestructs())
+	require.Empty(t, states.SelfdestructedContracts())
+	require.Empty(t, tracer.LogsOfCall(2))
+	require.Empty(t, tracer.EventLogs())
+}
+
+func TestTracerFailedFrames(t *testing.T) {
+	vmctx := BlockContext{
+		CanTransfer: func(db StateDB, addr common.Address, amount *big.Int) bool {
+			return db.GetBalance(addr).Cmp(amount) >= 0
+		},
+		Transfer: func(db StateDB, sender, recipient common.Address, amount *big.Int) {
+			db.SubBalance(sender, amount)
+			db.AddBalance(recipient, amount)
+		},
+		BlockNumber: big0,
+	}
+	run := func(t *testing.T, codes map[common.Address][]byte, to common.Address) *Tracer {
+		statedb, _ := state.New(types.EmptyRootHash, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		for addr, code := range codes {
+			statedb.SetCode(addr, code)
+			statedb.AddBalance(addr, big.NewInt(10))
+		}
+		statedb.Finalise(true)
+
+		evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+		evm.CloseAspectCall()
+		_, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), to, nil, 100000, new(big.Int))
+		require.NoError(t, err)
+		return evm.Tracer()
+	}
+	var (
+		caller    = common.BytesToAddress([]byte("caller"))
+		callee    = common.BytesToAddress([]byte("callee"))
+		recipient = common.BytesToAddress([]byte("recipient"))
+	)
+
+	t.Run("out of gas", func(t *testing.T) {
+		tracer := run(t, map[common.Address][]byte{
+			// pop(call(gas, callee, 1, 0, 0, 0, 0)) stop
+			caller: common.Hex2Bytes("60006000600060006001" + "73" + common.Bytes2Hex(callee.Bytes()) + "5af150" + "00"),
+			// log0(0, 0) and loop until out of gas
+			callee: common.Hex2Bytes("60006000a0" + "5b600556"),
+		}, caller)
+
+		require.ErrorIs(t, tracer.CallTree().FindCall(1).Err, ErrOutOfGas)
+		require.Nil(t, tracer.StateChanges().Balance(callee))
+		require.Empty(t, tracer.LogsOfCall(1))
+		require.Empty(t, tracer.EventLogs())
+		require.Empty(t, tracer.CallTree().FindCall(1).LogSummaries())
+	})
+
+	t.Run("reverted delegatecall", func(t *testing.T) {
+		tracer := run(t, map[common.Address][]byte{
+			// delegatecall(gas, callee, 0, 0, 0, 0) stop
+			caller: common.Hex2Bytes("6000600060006000" + "73" + common.Bytes2Hex(callee.Bytes()) + "5af4" + "00"),
+			// pop(call(gas, recipient, 1, 0, 0, 0, 0)) log0(0, 0) revert(0, 0)
+			callee: common.Hex2Bytes("60006000600060006001" + "73" + common.Bytes2Hex(recipient.Bytes()) + "5af150" +
+				"60006000a0" + "60006000fd"),
+		}, caller)
+
+		// the call made by the reverted frame succeeded, but its transfer is reverted with the frame
+		require.NoError(t, tracer.CallTree().FindCall(1).Err)
+		require.Nil(t, tracer.StateChanges().Balance(recipient))
+		require.Empty(t, tracer.LogsOfCall(0))
+		require.Empty(t, tracer.EventLogs())
+		require.Empty(t, tracer.CallTree().Root().LogSummaries())
+	})
+}
+
+func TestTracerLogsOfNestedCall(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+
+	parent, child := common.Address{1}, common.Address{2}
+	// log1(0, 0, 1) pop(call(gas, child, 0, 0, 0, 0, 0)) log1(0, 0, 3) stop
+	statedb.SetCode(parent, common.Hex2Bytes("600160006000a1"+
+		"60006000600060006000"+"73"+common.Bytes2Hex(child.Bytes())+"5af150"+
+		"600360006000a1"+"00"))
+	// log1(0, 0, 2) stop
+	statedb.SetCode(child, common.Hex2Bytes("600260006000a1"+"00"))
+
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+	evm.CloseAspectCall()
+	_, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), parent, nil, 100000, new(big.Int))
+	require.NoError(t, err)
+
+	// the logs of the parent before and after the nested call are grouped together
+	parentLogs := evm.Tracer().LogsOfCall(0)
+	require.Len(t, parentLogs, 2)
+	for i, topic := range []int64{1, 3} {
+		require.Equal(t, parent, parentLogs[i].Address)
+		require.Equal(t, []common.Hash{common.BigToHash(big.NewInt(topic))}, parentLogs[i].Topics)
+	}
+
+	childLogs := evm.Tracer().LogsOfCall(1)
+	require.Len(t, childLogs, 1)
+	require.Equal(t, child, childLogs[0].Address)
+	require.Equal(t, []common.Hash{common.BigToHash(big.NewInt(2))}, childLogs[0].Topics)
+
+	require.Empty(t, evm.Tracer().LogsOfCall(2))
+}
+
+func TestStateChangesDiff(t *testing.T) {
+	var (
+		account  = common.Address{1}
+		valType  = common.Hash{1}
+		mapType  = common.Hash{2}
+		mapSlot  = uint256.NewInt(1)
+		slotA    = uint256.NewInt(100)
+		slotB    = uint256.NewInt(200)
+		keyA     = []byte("alice")
+		keyB     = []byte("bob")
+		counter  = uint256.NewInt(0)
+		unchange = uint256.NewInt(2)
+	)
+
+	build := func(counterVal byte, withAlice, withBob bool) *StateChanges {
+		states := NewStateChanges()
+		require.NoError(t, states.saveKey(account, nil, counter, nil, valType, common.Hash{}, []byte("counter")))
+		require.NoError(t, states.saveKey(account, nil, unchange, nil, valType, common.Hash{}, []byte("owner")))
+		require.NoError(t, states.saveKey(account, nil, mapSlot, nil, mapType, common.Hash{}, []byte("balances")))
+		require.NoError(t, states.saveChange(account, counter, nil, valType, 0, []byte{counterVal}))
+		require.NoError(t, states.saveChange(account, unchange, nil, valType, 0, []byte{7}))
+		if withAlice {
+			require.NoError(t, states.saveKey(account, mapSlot, slotA, nil, valType, mapType, keyA))
+			require.NoError(t, states.saveChange(account, slotA, nil, valType, 0, []byte{1}))
+		}
+		if withBob {
+			require.NoError(t, states.saveKey(account, mapSlot, slotB, nil, valType, mapType, keyB))
+			require.NoError(t, states.saveChange(account, slotB, nil, valType, 0, []byte{1}))
+		}
+		return states
+	}
+
+	require.Empty(t, build(1, true, true).Diff(build(1, true, true)))
+
+	diffs := build(1, true, false).Diff(build(2, false, true))
+	require.Equal(t, []VariableDiff{
+		{Account: account, Variable: "counter", Indices: [][]byte{}, Kind: DiffModified, Value: []byte{1}, OtherValue: []byte{2}},
+		{Account: account, Variable: "balances", Indices: [][]byte{keyA}, Kind: DiffRemoved, Value: []byte{1}},
+		{Account: account, Variable: "balances", Indices: [][]byte{keyB}, Kind: DiffAdded, OtherValue: []byte{1}},
+	}, diffs)
+}
+
+func TestTracerWriteNDJSON(t *testing.T) {
+	var (
+		tracer  = NewTracer()
+		account = common.Address{1}
+		other   = common.Address{2}
+		slot    = uint256.NewInt(0)
+		typeId  = common.Hash{1}
+	)
+
+	tracer.SaveCall(common.Address{}, &account, nil, uint256.NewInt(0), uint256.NewInt(100))
+	tracer.states.saveBalance(account, uint256.NewInt(10), tracer.CurrentCallIndex())
+	require.NoError(t, tracer.SaveStateKey(account, nil, slot, nil, typeId, common.Hash{}, []byte("counter")))
+	require.NoError(t, tracer.SaveStateChange(account, slot, nil, typeId, []byte{1}))
+	require.NoError(t, tracer.SaveStateChange(account, slot, nil, typeId, []byte{2}))
+
+	tracer.SaveCall(account, &other, nil, uint256.NewInt(0), uint256.NewInt(50))
+	require.NoError(t, tracer.SaveStateChange(account, slot, nil, typeId, []byte{3}))
+	tracer.ExitCall(10, nil, ErrOutOfGas)
+	tracer.ExitCall(20, nil, nil)
+
+	var buf bytes.Buffer
+	require.NoError(t, tracer.WriteNDJSON(&buf))
+
+	var (
+		scanner = bufio.NewScanner(&buf)
+		kinds   []string
+	)
+	for scanner.Scan() {
+		var record map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		kinds = append(kinds, record["type"].(string))
+	}
+	require.NoError(t, scanner.Err())
+
+	// 2 calls, 1 balance change and 2 variable changes, the change of the failed call is dropped
+	require.Equal(t, []string{"call", "balance", "variable", "variable", "call"}, kinds)
+}
+
+func TestTracerEstimateSize(t *testing.T) {
+	var (
+		tracer  = NewTracer()
+		token   = common.Address{1}
+		other   = common.Address{2}
+		owner   = common.Address{3}
+		slot    = uint256.NewInt(0)
+		typeId  = common.Hash{1}
+		balance = new(uint256.Int).SetBytes(crypto.Keccak256(owner.Bytes(), slot.Bytes()))
+	)
+
+	tracer.SaveCall(common.Address{}, &token, make([]byte, 68), uint256.NewInt(0), uint256.NewInt(100000))
+	tracer.states.saveBalance(token, uint256.NewInt(10), tracer.CurrentCallIndex())
+	require.NoError(t, tracer.SaveStateKey(token, nil, slot, nil, typeId, common.Hash{}, []byte("balances")))
+	require.NoError(t, tracer.SaveStateKey(token, slot, balance, nil, typeId, typeId, owner.Bytes()))
+	require.NoError(t, tracer.SaveStateChange(token, balance, nil, typeId, common.Hash{1}.Bytes()))
+	require.NoError(t, tracer.SaveStateChange(token, balance, nil, typeId, common.Hash{2}.Bytes()))
+
+	tracer.SaveCall(token, &other, make([]byte, 36), uint256.NewInt(5), uint256.NewInt(50000))
+	require.NoError(t, tracer.SaveStateChange(token, balance, nil, typeId, common.Hash{3}.Bytes()))
+	tracer.states.saveBalance(other, uint256.NewInt(5), tracer.CurrentCallIndex())
+	tracer.ExitCall(10, nil, ErrOutOfGas)
+	tracer.ExitCall(20, make([]byte, 32), nil)
+
+	var buf bytes.Buffer
+	require.NoError(t, tracer.WriteNDJSON(&buf))
+	estimate := tracer.CallTree().EstimateSize() + tracer.StateChanges().EstimateSize()
+	require.InEpsilon(t, buf.Len(), estimate, 0.1)
+
+	require.Zero(t, NewCallTree().EstimateSize())
+	require.Zero(t, NewStateChanges().EstimateSize())
+}
+
+func TestTracerTextDump(t *testing.T) {
+	var (
+		account = common.Address{1}
+		other   = common.Address{2}
+		typeId  = common.Hash{1}
+	)
+	trace := func() *Tracer {
+		tracer := NewTracer()
+		tracer.SaveCall(common.Address{}, &account, []byte{1}, uint256.NewInt(0), uint256.NewInt(100))
+		tracer.states.saveBalance(account, uint256.NewInt(10), tracer.CurrentCallIndex())
+		require.NoError(t, tracer.SaveStateKey(account, nil, uint256.NewInt(0), nil, typeId, common.Hash{}, []byte("counter")))
+		require.NoError(t, tracer.SaveStateChange(account, uint256.NewInt(0), nil, typeId, []byte{1}))
+		require.NoError(t, tracer.SaveStateChange(account, uint256.NewInt(0), nil, typeId, []byte{2}))
+		require.NoError(t, tracer.SaveStateKey(account, nil, uint256.NewInt(1), nil, typeId, common.Hash{}, []byte("balances")))
+		for i, index := range []byte{0xbb, 0xaa} {
+			slot := uint256.NewInt(uint64(i) + 2)
+			require.NoError(t, tracer.SaveStateKey(account, uint256.NewInt(1), slot, nil, typeId, typeId, []byte{index}))
+			require.NoError(t, tracer.SaveStateChange(account, slot, nil, typeId, []byte{byte(i) + 4}))
+		}
+
+		tracer.SaveCall(account, &other, nil, uint256.NewInt(5), uint256.NewInt(50))
+		require.NoError(t, tracer.SaveStateChange(account, uint256.NewInt(0), nil, typeId, []byte{3}))
+		tracer.ExitCall(10, nil, ErrOutOfGas)
+		tracer.ExitCall(20, []byte{0xff}, nil)
+		return tracer
+	}
+
+	dump := trace().TextDump()
+	require.Equal(t, `accounts:
+0x0100000000000000000000000000000000000000
+  balance
+    call 0: 0x0a
+  balances[0xaa]
+    call 0: 0x05
+  balances[0xbb]
+    call 0: 0x04
+  counter
+    call 0: 0x01 0x02
+calls:
+0 0x0000000000000000000000000000000000000000 -> 0x0100000000000000000000000000000000000000 value 0x0 gas 0x64 remaining 20 data 0x01 ret 0xff
+  1 0x0100000000000000000000000000000000000000 -> 0x0200000000000000000000000000000000000000 value 0x5 gas 0x32 remaining 10 data 0x ret 0x err "out of gas"
+`, dump)
+
+	// the dump does not depend on the iteration order of maps
+	for i := 0; i < 50; i++ {
+		require.Equal(t, dump, trace().TextDump())
+	}
+}
+
+func TestStateChangesDeepNestings(t *testing.T) {
+	var (
+		states  = NewStateChanges()
+		account = common.Address{1}
+		typeId  = common.Hash{1}
+	)
+
+	// nest builds a chain of mappings under a top level variable stored at slot base
+	nest := func(name string, base uint64, depth int) [][]byte {
+		require.NoError(t, states.saveKey(account, nil, uint256.NewInt(base), nil, typeId, common.Hash{}, []byte(name)))
+		indices := make([][]byte, 0, depth)
+		parent := uint256.NewInt(base)
+		for i := 0; i < depth; i++ {
+			slot := uint256.NewInt(base*100 + uint64(i) + 1)
+			index := []byte{byte(i)}
+			require.NoError(t, states.saveKey(account, parent, slot, nil, typeId, typeId, index))
+			indices = append(indices, index)
+			parent = slot
+		}
+		return indices
+	}
+	deepIndices := nest("deep", 1, 4)
+	nest("shallow", 2, 2)
+
+	require.Equal(t, 4, states.FindKeyIndices(account, "deep").Depth())
+	require.Equal(t, []StoragePath{{Variable: "deep", Indices: deepIndices}}, states.DeepNestings(account, 3))
+	require.Len(t, states.DeepNestings(account, 1), 2)
+	require.Empty(t, states.DeepNestings(account, 4))
+	require.Empty(t, states.DeepNestings(common.Address{2}, 0))
+}
+
+func TestStorageKeyChildByKey(t *testing.T) {
+	var (
+		states  = NewStateChanges()
+		account = common.Address{1}
+		typeId  = common.Hash{1}
+		owner   = common.Address{2}.Bytes()
+		spender = common.Address{3}.Bytes()
+	)
+
+	// allowances[owner][spender]
+	require.NoError(t, states.saveKey(account, nil, uint256.NewInt(1), nil, typeId, common.Hash{}, []byte("allowances")))
+	require.NoError(t, states.saveKey(account, uint256.NewInt(1), uint256.NewInt(2), nil, typeId, typeId, owner))
+	require.NoError(t, states.saveKey(account, uint256.NewInt(2), uint256.NewInt(3), nil, typeId, typeId, spender))
+
+	allowances := states.FindKeyIndices(account, "allowances")
+	require.NotNil(t, allowances)
+	ownerKey, ok := allowances.ChildByKey(owner)
+	require.True(t, ok)
+	require.Equal(t, uint256.NewInt(2), ownerKey.Slot())
+	spenderKey, ok := ownerKey.ChildByKey(spender)
+	require.True(t, ok)
+	require.Same(t, states.FindKeyIndices(account, "allowances", owner, spender), spenderKey)
+
+	missing, ok := allowances.ChildByKey(spender)
+	require.False(t, ok)
+	require.Nil(t, missing)
+}
+
+func TestStorageKeyPath(t *testing.T) {
+	var (
+		states  = NewStateChanges()
+		account = common.Address{1}
+		typeId  = common.Hash{1}
+		owner   = []byte{0x12, 0x34}
+	)
+
+	// balances[0x1234]
+	require.NoError(t, states.saveKey(account, nil, uint256.NewInt(1), nil, typeId, common.Hash{}, []byte("balances")))
+	require.NoError(t, states.saveKey(account, uint256.NewInt(1), uint256.NewInt(2), nil, typeId, typeId, owner))
+
+	balances := states.FindKeyIndices(account, "balances")
+	balance := states.FindKeyIndices(account, "balances", owner)
+	require.Equal(t, []*StorageKey{states.roots[account], balances, balance}, balance.Path())
+	require.Equal(t, "balances.0x1234", balance.PathString())
+	require.Equal(t, "balances", balances.PathString())
+
+	root := states.roots[account]
+	require.Equal(t, []*StorageKey{root}, root.Path())
+	require.Empty(t, root.PathString())
+}
+
+func TestStorageKeyCheckInvariant(t *testing.T) {
+	var (
+		states  = NewStateChanges()
+		account = common.Address{1}
+		typeId  = common.Hash{1}
+	)
+	require.NoError(t, states.saveKey(account, nil, uint256.NewInt(1), nil, typeId, common.Hash{}, []byte("balances")))
+	require.NoError(t, states.saveKey(account, uint256.NewInt(1), uint256.NewInt(2), nil, typeId, typeId, []byte{1}))
+	require.NoError(t, states.roots[account].CheckInvariant())
+
+	// the same index under another slot is only reachable by slot
+	sameIndex := NewBranchKey(uint256.NewInt(0), 0, typeId, nil)
+	_, err := sameIndex.AddChild(NewBranchKey(uint256.NewInt(1), 0, typeId, []byte{1}))
+	require.NoError(t, err)
+	_, err = sameIndex.AddChild(NewBranchKey(uint256.NewInt(2), 0, typeId, []byte{1}))
+	require.NoError(t, err)
+	require.Error(t, sameIndex.CheckInvariant())
+
+	// another index under the same slot is only reachable by index
+	sameSlot := NewBranchKey(uint256.NewInt(0), 0, typeId, nil)
+	_, err = sameSlot.AddChild(NewBranchKey(uint256.NewInt(1), 0, typeId, []byte{1}))
+	require.NoError(t, err)
+	_, err = sameSlot.AddChild(NewBranchKey(uint256.NewInt(1), 0, typeId, []byte{2}))
+	require.NoError(t, err)
+	require.Error(t, sameSlot.CheckInvariant())
+
+	// inconsistencies are found in nested keys as well
+	balances := states.FindKeyIndices(account, "balances")
+	_, err = balances.AddChild(NewBranchKey(uint256.NewInt(3), 0, typeId, []byte{1}))
+	require.NoError(t, err)
+	require.Error(t, states.roots[account].CheckInvariant())
+}
+
+func TestStateChangesBuilder(t *testing.T) {
+	var (
+		states  = NewStateChanges()
+		account = common.Address{1}
+		typeId  = common.Hash{1}
+		owner   = common.Address{2}.Bytes()
+		spender = common.Address{3}.Bytes()
+	)
+
+	counter := states.AddVariable(account, "counter", uint256.NewInt(0), 0, typeId)
+	counter.RecordChange(0, []byte{1})
+	counter.RecordChange(1, []byte{2})
+	require.Same(t, counter, states.AddVariable(account, "counter", uint256.NewInt(0), 0, typeId))
+
+	allowances := states.AddVariable(account, "allowances", uint256.NewInt(1), 0, typeId)
+	allowance := allowances.
+		AddNestedChild(owner, uint256.NewInt(2), 0, typeId).
+		AddNestedChild(spender, uint256.NewInt(3), 0, typeId)
+	allowance.RecordChange(1, []byte{100})
+
+	require.Equal(t, [][]byte{{1}}, states.Variable(account, "counter").Changes()[0])
+	require.Same(t, allowance, states.FindKeyIndices(account, "allowances", owner, spender))
+	require.Equal(t, "allowances.0x0200000000000000000000000000000000000000.0x0300000000000000000000000000000000000000", allowance.PathString())
+	require.Equal(t, map[string][]byte{
+		"counter": {2},
+		"allowances[0x0200000000000000000000000000000000000000][0x0300000000000000000000000000000000000000]": {100},
+	}, states.FinalValues(account))
+
+	changes, err := states.Slot(account, uint256.NewInt(0), nil, typeId)
+	require.NoError(t, err)
+	require.Same(t, counter.Changes(), changes)
+	require.NoError(t, states.roots[account].CheckInvariant())
+}
+
+func TestTracerAccessList(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+
+	var (
+		contract = common.Address{1}
+		target   = common.Address{2}
+		slot     = common.BigToHash(big.NewInt(1))
+	)
+	// PUSH1 1 SLOAD POP PUSH1 1 SLOAD POP PUSH20 target BALANCE POP STOP
+	code := common.Hex2Bytes("600154506001545073")
+	code = append(code, target.Bytes()...)
+	code = append(code, byte(BALANCE), byte(POP), byte(STOP))
+	statedb.SetCode(contract, code)
+
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+	evm.CloseAspectCall()
+	_, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), contract, nil, 100000, new(big.Int))
+	require.NoError(t, err)
+
+	tracer := evm.Tracer()
+	require.Equal(t, []AccessedSlot{{Addr: contract, Slot: slot}}, tracer.AccessedSlots(0))
+	require.Equal(t, []common.Address{target}, tracer.AccessedAddresses(0))
+	require.Nil(t, tracer.AccessedSlots(1))
+}
+
+func TestTracerPreimages(t *testing.T) {
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+
+	var (
+		caller = common.Address{1}
+		callee = common.Address{2}
+		data   = common.BigToHash(big.NewInt(42)).Bytes()
+	)
+	// mstore(0, 42) pop(keccak256(0, 32))
+	hashCode := common.Hex2Bytes("602a600052" + "6020600020" + "50")
+	// pop(call(gas, callee, 0, 0, 0, 0, 0)), then hashes the same data
+	callerCode := append(common.Hex2Bytes("6000600060006000600073"), callee.Bytes()...)
+	callerCode = append(callerCode, byte(GAS), byte(CALL), byte(POP))
+	callerCode = append(callerCode, hashCode...)
+
+	for _, enabled := range []bool{false, true} {
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.SetCode(caller, callerCode)
+		statedb.SetCode(callee, hashCode)
+
+		evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{EnablePreimageRecording: enabled})
+		evm.CloseAspectCall()
+		_, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), caller, nil, 100000, new(big.Int))
+		require.NoError(t, err)
+
+		tracer := evm.Tracer()
+		hash := crypto.Keccak256Hash(data)
+		if !enabled {
+			require.Empty(t, tracer.Preimages())
+			continue
+		}
+		require.Equal(t, map[common.Hash][]byte{hash: data}, tracer.Preimages())
+		// the first call computing the hash is kept
+		callIdx, ok := tracer.PreimageCall(hash)
+		require.True(t, ok)
+		require.Equal(t, uint64(1), callIdx)
+		_, ok = tracer.PreimageCall(common.Hash{})
+		require.False(t, ok)
+	}
+}
+
+func TestTracerInsufficientBalance(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	vmctx := BlockContext{
+		CanTransfer: func(db StateDB, address common.Address, amount *big.Int) bool {
+			return db.GetBalance(address).Cmp(amount) >= 0
+		},
+		Transfer: func(db StateDB, sender, recipient common.Address, amount *big.Int) {
+			db.SubBalance(sender, amount)
+			db.AddBalance(recipient, amount)
+		},
+		BlockNumber: big0,
+	}
+
+	var (
+		sender   = common.Address{1}
+		contract = common.Address{2}
+		target   = common.Address{3}
+	)
+	// call(0xffff, target, 1, 0, 0, 0, 0) stop, the contract has no balance
+	code := []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 1, byte(PUSH20)}
+	code = append(code, target.Bytes()...)
+	code = append(code, byte(PUSH2), 0xff, 0xff, byte(CALL), byte(STOP))
+	statedb.SetCode(contract, code)
+
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+	evm.CloseAspectCall()
+	_, _, err := evm.Call(context.Background(), AccountRef(sender), contract, nil, 100000, new(big.Int))
+	require.NoError(t, err)
+
+	callTree := evm.Tracer().CallTree()
+	require.False(t, callTree.Root().InsufficientBalance)
+	inner := callTree.FindCall(1)
+	require.NotNil(t, inner)
+	require.Equal(t, ErrInsufficientBalance, inner.Err)
+	require.True(t, inner.InsufficientBalance)
+}
+
+func TestCallTreeTotalTransactionGas(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	vmctx := BlockContext{
+		CanTransfer: func(StateDB, common.Address, *big.Int) bool { return true },
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+
+	contract := common.Address{2}
+	// return(0, 0)
+	statedb.SetCode(contract, []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(RETURN)})
+
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+	evm.CloseAspectCall()
+	callTree := evm.Tracer().CallTree()
+	require.Equal(t, uint64(0), callTree.TotalTransactionGas())
+
+	// 21000 for the transaction, 16 for the non-zero and 4 for the zero calldata byte
+	data := []byte{1, 0}
+	callTree.IntrinsicGas = 21020
+	_, leftOverGas, err := evm.Call(context.Background(), AccountRef(common.Address{1}), contract, data, 100000, new(big.Int))
+	require.NoError(t, err)
+	require.Equal(t, uint64(100000-6), leftOverGas)
+	require.Equal(t, uint64(21026), callTree.TotalTransactionGas())
+}
+
+func TestTracerGlobalOpCounts(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	vmctx := BlockContext{
+		CanTransfer: func(StateDB, common.Address, *big.Int) bool { return true },
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+
+	var (
+		contract = common.Address{2}
+		target   = common.Address{3}
+	)
+	// call(0xffff, target, 0, 0, 0, 0, 0) pop, twice, then stop
+	call := []byte{byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH1), 0, byte(PUSH20)}
+	call = append(call, target.Bytes()...)
+	call = append(call, byte(PUSH2), 0xff, 0xff, byte(CALL), byte(POP))
+	code := append(append(append([]byte{}, call...), call...), byte(STOP))
+	statedb.SetCode(contract, code)
+	// add(1, 2) stop
+	statedb.SetCode(target, []byte{byte(PUSH1), 1, byte(PUSH1), 2, byte(ADD), byte(STOP)})
+
+	for _, enabled := range []bool{false, true} {
+		evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{EnableOpcodeCounting: enabled})
+		evm.CloseAspectCall()
+		_, _, err := evm.Call(context.Background(), AccountRef(common.Address{1}), contract, nil, 100000, new(big.Int))
+		require.NoError(t, err)
+
+		tracer := evm.Tracer()
+		if !enabled {
+			require.Nil(t, tracer.GlobalOpCounts())
+			require.Nil(t, tracer.OpCounts(0))
+			continue
+		}
+
+		sum := make(map[OpCode]uint64)
+		for _, call := range tracer.CallTree().Flatten() {
+			for op, count := range tracer.OpCounts(call.Index) {
+				sum[op] += count
+			}
+		}
+		require.Equal(t, sum, tracer.GlobalOpCounts())
+		require.Equal(t, evm.Interpreter().OpcodeCounts(), tracer.GlobalOpCounts())
+		require.Equal(t, uint64(2), tracer.OpCounts(0)[CALL])
+		require.Equal(t, uint64(1), tracer.OpCounts(1)[ADD])
+		require.Equal(t, uint64(2), tracer.GlobalOpCounts()[ADD])
+		require.Equal(t, uint64(3), tracer.GlobalOpCounts()[STOP])
+	}
+}
+
+func TestTracerDeployments(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	vmctx := BlockContext{
+		CanTransfer: func(StateDB, common.Address, *big.Int) bool { return true },
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+
+	factory := common.Address{1}
+	// init code deploying a single STOP: mstore8(0, 0) return(0, 1)
+	initCode := common.Hex2Bytes("60006000536001" + "6000f3")
+	// mstore(0, initCode) create(0, 22, 10) create2(0, 22, 10, 7) stop
+	code := append([]byte{byte(PUSH10)}, initCode...)
+	code = append(code, common.Hex2Bytes("600052"+"600a60166000f0"+"6007600a60166000f5"+"00")...)
+	statedb.SetCode(factory, code)
+
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+	evm.CloseAspectCall()
+	_, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), factory, nil, 1000000, new(big.Int))
+	require.NoError(t, err)
+
+	deployments := evm.Tracer().Deployments()
+	require.Len(t, deployments, 2)
+	codeHash := crypto.Keccak256Hash([]byte{byte(STOP)})
+	require.Equal(t, Deployment{
+		Address:   crypto.CreateAddress(factory, 0),
+		CodeHash:  codeHash,
+		CallIndex: 1,
+	}, deployments[0])
+	require.Equal(t, Deployment{
+		Address:   crypto.CreateAddress2(factory, common.Hash{31: 7}, crypto.Keccak256(initCode)),
+		CodeHash:  codeHash,
+		CallIndex: 2,
+		IsCreate2: true,
+		Salt:      uint256.NewInt(7),
+	}, deployments[1])
+	require.Nil(t, evm.Tracer().CallTree().FindCall(1).To)
+
+	// deployments under a reverted call are dropped
+	tracer := NewTracer()
+	tracer.SaveCall(common.Address{}, &factory, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tracer.SaveDeployment(0, common.Address{2}, codeHash, nil)
+	tracer.SaveCall(factory, &factory, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tracer.SaveDeployment(1, common.Address{3}, codeHash, nil)
+	tracer.ExitCall(0, nil, ErrExecutionReverted)
+	tracer.ExitCall(0, nil, nil)
+	require.Len(t, tracer.Deployments(), 1)
+	require.Equal(t, common.Address{2}, tracer.Deployments()[0].Address)
+}
+
+func TestStateChangesCreatedAccounts(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	vmctx := BlockContext{
+		CanTransfer: func(StateDB, common.Address, *big.Int) bool { return true },
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+
+	factory, payee := common.Address{1}, common.Address{2}
+	// init code deploying a single STOP: mstore8(0, 0) return(0, 1)
+	initCode := common.Hex2Bytes("60006000536001" + "6000f3")
+	// mstore(0, initCode) create(0, 22, 10) create2(0, 22, 10, 7) call(0, payee, 1, 0, 0, 0, 0) stop
+	code := append([]byte{byte(PUSH10)}, initCode...)
+	code = append(code, common.Hex2Bytes("600052"+"600a60166000f0"+"6007600a60166000f5"+"6000600060006000600173")...)
+	code = append(code, payee.Bytes()...)
+	code = append(code, common.Hex2Bytes("5af1"+"00")...)
+	statedb.SetCode(factory, code)
+	statedb.AddBalance(factory, big.NewInt(1))
+	statedb.Finalise(true)
+
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+	evm.CloseAspectCall()
+	_, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), factory, nil, 1000000, new(big.Int))
+	require.NoError(t, err)
+
+	created := []common.Address{
+		crypto.CreateAddress(factory, 0),
+		crypto.CreateAddress2(factory, common.Hash{31: 7}, crypto.Keccak256(initCode)),
+		payee,
+	}
+	states := evm.Tracer().StateChanges()
+	require.Equal(t, created, states.CreatedAccounts(false))
+
+	// accounts self-destructed after creation are excluded unless asked for
+	states.saveSelfDestruct(created[0], factory, new(uint256.Int), 0)
+	require.Equal(t, created[1:], states.CreatedAccounts(false))
+	require.Equal(t, created, states.CreatedAccounts(true))
+
+	// a reverted creation is dropped
+	checkpoint := states.Checkpoint()
+	states.saveCreation(common.Address{3})
+	require.Len(t, states.CreatedAccounts(true), 4)
+	states.RevertToCheckpoint(checkpoint)
+	require.Equal(t, created, states.CreatedAccounts(true))
+}
+
+func TestTracerSenderNonce(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	vmctx := BlockContext{
+		CanTransfer: func(StateDB, common.Address, *big.Int) bool { return true },
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+
+	var (
+		sender   = common.Address{1}
+		contract = common.Address{2}
+		callee   = common.Address{3}
+	)
+	statedb.SetNonce(sender, 5)
+	statedb.SetNonce(contract, 9)
+	// PUSH1 0 x5 PUSH20 callee GAS CALL STOP
+	code := common.Hex2Bytes("60006000600060006000")
+	code = append(code, byte(PUSH20))
+	code = append(code, callee.Bytes()...)
+	code = append(code, byte(GAS), byte(CALL), byte(STOP))
+	statedb.SetCode(contract, code)
+	statedb.SetCode(callee, []byte{byte(STOP)})
+
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+	evm.CloseAspectCall()
+	_, _, err := evm.Call(context.Background(), AccountRef(sender), contract, nil, 100000, new(big.Int))
+	require.NoError(t, err)
+
+	callTree := evm.Tracer().CallTree()
+	require.Equal(t, uint64(5), callTree.Root().SenderNonce)
+	// only the root call records the sender nonce
+	require.Len(t, callTree.Root().Children, 1)
+	require.Equal(t, uint64(0), callTree.Root().Children[0].SenderNonce)
+
+	// a root creation records the nonce incremented by itself, as a call records the
+	// nonce incremented by the state transition
+	evm = NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+	evm.CloseAspectCall()
+	_, _, _, err = evm.Create(context.Background(), AccountRef(sender), []byte{byte(STOP)}, 100000, new(big.Int))
+	require.NoError(t, err)
+	require.Equal(t, uint64(6), evm.Tracer().CallTree().Root().SenderNonce)
+}
+
+func TestStateChangesVariableBeforeCall(t *testing.T) {
+	var (
+		states  = NewStateChanges()
+		account = common.Address{1}
+		slot    = uint256.NewInt(0)
+		typeId  = common.Hash{1}
+	)
+	require.NoError(t, states.saveKey(account, nil, slot, nil, typeId, common.Hash{}, []byte("counter")))
+	require.NoError(t, states.saveChange(account, slot, nil, typeId, 1, []byte{1}))
+	require.NoError(t, states.saveChange(account, slot, nil, typeId, 1, []byte{2}))
+	require.NoError(t, states.saveChange(account, slot, nil, typeId, 5, []byte{5}))
+
+	require.Equal(t, []byte{2}, states.VariableBeforeCall(account, "counter", 4))
+	require.Equal(t, []byte{2}, states.VariableBeforeCall(account, "counter", 5))
+	require.Equal(t, []byte{5}, states.VariableBeforeCall(account, "counter", 6))
+	require.Nil(t, states.VariableBeforeCall(account, "counter", 1))
+	require.Nil(t, states.VariableBeforeCall(account, "unknown", 6))
+}
+
+func TestStateChangesIndicesOfChanges(t *testing.T) {
+	var (
+		states      = NewStateChanges()
+		account     = common.Address{1}
+		mappingType = common.Hash{1}
+		valueType   = common.Hash{2}
+	)
+	// allowances[owner][spender], the keys are saved in an unsorted order
+	require.NoError(t, states.saveKey(account, nil, uint256.NewInt(0), nil, mappingType, common.Hash{}, []byte("allowances")))
+	owners := [][]byte{{3}, {1}, {2}}
+	for i, owner := range owners {
+		ownerSlot := uint256.NewInt(uint64(10 * (i + 1)))
+		require.NoError(t, states.saveKey(account, uint256.NewInt(0), ownerSlot, nil, mappingType, mappingType, owner))
+		for j, spender := range [][]byte{{0xb}, {0xa, 1}, {0xa}} {
+			spenderSlot := uint256.NewInt(uint64(10*(i+1) + j + 1))
+			require.NoError(t, states.saveKey(account, ownerSlot, spenderSlot, nil, valueType, mappingType, spender))
+		}
+	}
+
+	for i := 0; i < 10; i++ {
+		require.Equal(t, [][]byte{{1}, {2}, {3}}, states.IndicesOfChanges(account, "allowances"))
+		require.Equal(t, [][]byte{{0xa}, {0xa, 1}, {0xb}}, states.IndicesOfChanges(account, "allowances", []byte{2}))
+	}
+	require.Nil(t, states.IndicesOfChanges(account, "unknown"))
+}
+
+func TestStateChangesDeadWrites(t *testing.T) {
+	var (
+		states  = NewStateChanges()
+		account = common.Address{1}
+		slot    = uint256.NewInt(0)
+		typeId  = common.Hash{1}
+	)
+	require.Nil(t, states.DeadWrites(account))
+
+	require.NoError(t, states.saveKey(account, nil, slot, nil, typeId, common.Hash{}, []byte("counter")))
+	// call 1 writes 1 and 2 without reading in between, then reads 2 before writing 3
+	require.NoError(t, states.saveChange(account, slot, nil, typeId, 1, []byte{1}))
+	require.NoError(t, states.saveChange(account, slot, nil, typeId, 1, []byte{2}))
+	// the writes are not told dead unless the reads are tracked
+	require.Nil(t, states.DeadWrites(account))
+	states.readsTracked = true
+	states.saveRead(account, slot)
+	require.NoError(t, states.saveChange(account, slot, nil, typeId, 1, []byte{3}))
+	// call 2 writes 4 and 5, a read of another slot does not keep 4 alive
+	require.NoError(t, states.saveChange(account, slot, nil, typeId, 2, []byte{4}))
+	states.saveRead(account, uint256.NewInt(1))
+	require.NoError(t, states.saveChange(account, slot, nil, typeId, 2, []byte{5}))
+	states.saveRead(account, slot)
+
+	path := StoragePath{Variable: "counter"}
+	require.Equal(t, []DeadWrite{
+		{Path: path, CallIndex: 1, Value: []byte{1}, OverwrittenBy: []byte{2}},
+		{Path: path, CallIndex: 2, Value: []byte{4}, OverwrittenBy: []byte{5}},
+	}, states.DeadWrites(account))
+}
+
+func TestStateChangesDependencyGraph(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	vmctx := BlockContext{
+		CanTransfer: func(StateDB, common.Address, *big.Int) bool { return true },
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+
+	contract := common.Address{2}
+	// sstore(4, 1) sstore(3, add(sload(2), sload(1))) stop
+	code := []byte{byte(PUSH1), 1, byte(PUSH1), 4, byte(SSTORE)}
+	code = append(code, byte(PUSH1), 1, byte(SLOAD), byte(PUSH1), 2, byte(SLOAD), byte(ADD), byte(PUSH1), 3, byte(SSTORE), byte(STOP))
+	statedb.SetCode(contract, code)
+
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{TrackStorageReads: true})
+	evm.CloseAspectCall()
+	_, _, err := evm.Call(context.Background(), AccountRef(common.Address{1}), contract, nil, 100000, new(big.Int))
+	require.NoError(t, err)
+
+	states := evm.Tracer().StateChanges()
+	require.True(t, states.readsTracked)
+	require.Equal(t, map[uint256.Int][]uint256.Int{
+		*uint256.NewInt(3): {*uint256.NewInt(1), *uint256.NewInt(2)},
+	}, states.DependencyGraph(contract))
+	require.Nil(t, states.DependencyGraph(common.Address{1}))
+
+	// the dependencies recorded after a checkpoint are dropped by reverting to it
+	checkpoint := states.Checkpoint()
+	states.RecordDependency(contract, *uint256.NewInt(3), *uint256.NewInt(3))
+	states.RecordDependency(contract, *uint256.NewInt(1), *uint256.NewInt(3))
+	states.RecordDependency(contract, *uint256.NewInt(1), *uint256.NewInt(5))
+	require.Equal(t, []uint256.Int{*uint256.NewInt(1), *uint256.NewInt(2), *uint256.NewInt(3)}, states.DependencyGraph(contract)[*uint256.NewInt(3)])
+	require.Len(t, states.DependencyGraph(contract), 2)
+	states.RevertToCheckpoint(checkpoint)
+	require.Equal(t, map[uint256.Int][]uint256.Int{
+		*uint256.NewInt(3): {*uint256.NewInt(1), *uint256.NewInt(2)},
+	}, states.DependencyGraph(contract))
+
+	// the reads are not tracked by default
+	evm = NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+	evm.CloseAspectCall()
+	_, _, err = evm.Call(context.Background(), AccountRef(common.Address{1}), contract, nil, 100000, new(big.Int))
+	require.NoError(t, err)
+	require.Nil(t, evm.Tracer().StateChanges().DependencyGraph(contract))
+	require.False(t, evm.Tracer().StateChanges().readsTracked)
+}
+
+func TestStateChangesAggregateByCallRange(t *testing.T) {
+	var (
+		states  = NewStateChanges()
+		account = common.Address{1}
+		slot    = uint256.NewInt(0)
+		typeId  = common.Hash{1}
+	)
+	require.NoError(t, states.saveKey(account, nil, slot, nil, typeId, common.Hash{}, []byte("counter")))
+	for callIdx := uint64(0); callIdx < 10; callIdx++ {
+		require.NoError(t, states.saveChange(account, slot, nil, typeId, callIdx, []byte{byte(callIdx)}))
+		if callIdx >= 7 {
+			states.saveBalance(account, uint256.NewInt(callIdx), callIdx)
+		}
+	}
+
+	require.Equal(t, map[uint64]int{0: 5, 5: 8}, states.AggregateByCallRange(account, 5))
+	require.Len(t, states.AggregateByCallRange(account, 1), 10)
+	require.Nil(t, states.AggregateByCallRange(account, 0))
+	require.Empty(t, states.AggregateByCallRange(common.Address{2}, 5))
+}
+
+func TestStateChangesVariableAll(t *testing.T) {
+	var (
+		states  = NewStateChanges()
+		account = common.Address{1}
+		typeId  = common.Hash{1}
+	)
+	require.NoError(t, states.saveKey(account, nil, uint256.NewInt(0), nil, typeId, common.Hash{}, []byte("balances")))
+	for i, holder := range []string{"alice", "bob", "carol"} {
+		slot := uint256.NewInt(uint64(i) + 1)
+		require.NoError(t, states.saveKey(account, uint256.NewInt(0), slot, nil, typeId, typeId, []byte(holder)))
+		if holder != "carol" {
+			require.NoError(t, states.saveChange(account, slot, nil, typeId, 0, []byte{byte(i + 1)}))
+		}
+	}
+
+	all := states.VariableAll(account, "balances")
+	require.Len(t, all, 2)
+	require.Equal(t, map[uint64][][]byte{0: {{1}}}, all["alice"].Changes())
+	require.Equal(t, map[uint64][][]byte{0: {{2}}}, all["bob"].Changes())
+
+	matching := states.VariableMatching(account, "balances", func(index string) bool {
+		return strings.HasPrefix(index, "b")
+	})
+	require.Len(t, matching, 1)
+	require.Contains(t, matching, "bob")
+
+	require.Nil(t, states.VariableAll(account, "unknown"))
+	require.Nil(t, states.VariableAll(common.Address{2}, "balances"))
+}
+
+func TestTracerRevertReason(t *testing.T) {
+	var (
+		tracer = NewTracer()
+		to     = common.Address{1}
+		// Error("boom")
+		reason = common.Hex2Bytes("08c379a0" +
+			"0000000000000000000000000000000000000000000000000000000000000020" +
+			"0000000000000000000000000000000000000000000000000000000000000004" +
+			"626f6f6d00000000000000000000000000000000000000000000000000000000")
+		// a custom error without arguments
+		custom = common.Hex2Bytes("deadbeef")
+	)
+
+	tracer.SaveCall(common.Address{}, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tracer.SaveCall(to, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tracer.ExitCall(0, reason, ErrExecutionReverted)
+	tracer.SaveCall(to, &to, nil, uint256.NewInt(0), uint256.NewInt(0))
+	tracer.ExitCall(0, custom, ErrExecutionReverted)
+	tracer.ExitCall(0, nil, nil)
+
+	decoded, err := tracer.RevertReason(1)
+	require.NoError(t, err)
+	require.Equal(t, "boom", decoded)
+
+	decoded, err = tracer.RevertReason(2)
+	require.NoError(t, err)
+	require.Equal(t, "0xdeadbeef", decoded)
+
+	_, err = tracer.RevertReason(0)
+	require.Error(t, err)
+	_, err = tracer.RevertReason(3)
+	require.Error(t, err)
+}
+
+func TestCallRevertKind(t *testing.T) {
+	var (
+		// Panic(0x11)
+		overflow = common.Hex2Bytes("4e487b71" +
+			"0000000000000000000000000000000000000000000000000000000000000011")
+		// Error("too low")
+		requireFailure = common.Hex2Bytes("08c379a0" +
+			"0000000000000000000000000000000000000000000000000000000000000020" +
+			"0000000000000000000000000000000000000000000000000000000000000007" +
+			"746f6f206c6f7700000000000000000000000000000000000000000000000000")
+		custom = common.Hex2Bytes("deadbeef")
+	)
+
+	kind := (&Call{Ret: overflow, Err: ErrExecutionReverted}).RevertKind()
+	panicRevert, ok := kind.(PanicRevert)
+	require.True(t, ok, "unexpected kind %T", kind)
+	require.Equal(t, uint64(0x11), panicRevert.Code.Uint64())
+	require.Equal(t, "arithmetic underflow or overflow", panicRevert.Meaning())
+
+	kind = (&Call{Ret: requireFailure, Err: ErrExecutionReverted}).RevertKind()
+	require.Equal(t, StringRevert{Msg: "too low"}, kind)
+
+	kind = (&Call{Ret: custom, Err: ErrExecutionReverted}).RevertKind()
+	require.Equal(t, RawRevert{Data: custom}, kind)
+
+	require.Nil(t, (&Call{Ret: custom}).RevertKind())
+	require.Nil(t, (&Call{Err: ErrOutOfGas}).RevertKind())
+}
+
+func TestStateChangesBalanceConserved(t *testing.T) {
+	var (
+		sender    = common.Address{1}
+		recipient = common.Address{2}
+		coinbase  = common.Address{3}
+	)
+
+	states := NewStateChanges()
+	states.saveBalance(sender, uint256.NewInt(100), 0)
+	states.saveBalance(recipient, uint256.NewInt(0), 0)
+	states.saveBalance(sender, uint256.NewInt(70), 0)
+	states.saveBalance(recipient, uint256.NewInt(30), 0)
+	// the fee collected by the coinbase is not taken into account
+	states.saveBalance(coinbase, uint256.NewInt(0), 1)
+	states.saveBalance(coinbase, uint256.NewInt(5), 1)
+
+	conserved, residual := states.BalanceConserved(coinbase)
+	require.True(t, conserved)
+	require.Zero(t, residual.Sign())
+
+	states = NewStateChanges()
+	states.saveBalance(sender, uint256.NewInt(100), 0)
+	states.saveBalance(recipient, uint256.NewInt(0), 0)
+	states.saveBalance(sender, uint256.NewInt(70), 0)
+	states.saveBalance(recipient, uint256.NewInt(20), 1)
+
+	conserved, residual = states.BalanceConserved(coinbase)
+	require.False(t, conserved)
+	require.Equal(t, int64(-10), residual.Int64())
+}
+
+func TestTracerBalanceDeltaInSubtree(t *testing.T) {
+	var (
+		a, b, c = common.Address{1}, common.Address{2}, common.Address{3}
+		tracer  = NewTracer()
+	)
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	statedb.AddBalance(a, big.NewInt(100))
+	transfer := func(from, to common.Address, amount int64) {
+		tracer.TransferWithRecord(statedb, from, to, big.NewInt(amount), func(db StateDB, sender, recipient common.Address, amount *big.Int) {
+			db.SubBalance(sender, amount)
+			db.AddBalance(recipient, amount)
+		})
+	}
+	enter := func() {
+		tracer.SaveCall(common.Address{}, &common.Address{}, nil, uint256.NewInt(0), uint256.NewInt(0))
+	}
+
+	// 0: a -> b 10, 1: b -> c 5, 2: c -> b 3, 3: b -> a 1, with 0 -> (1 -> 2, 3)
+	enter()
+	transfer(a, b, 10)
+	enter()
+	transfer(b, c, 5)
+	enter()
+	transfer(c, b, 3)
+	tracer.ExitCall(0, nil, nil)
+	tracer.ExitCall(0, nil, nil)
+	enter()
+	transfer(b, a, 1)
+	tracer.ExitCall(0, nil, nil)
+	tracer.ExitCall(0, nil, nil)
+
+	require.Equal(t, int64(7), tracer.BalanceDeltaInSubtree(b, 0).Int64())
+	require.Equal(t, int64(-2), tracer.BalanceDeltaInSubtree(b, 1).Int64())
+	require.Equal(t, int64(3), tracer.BalanceDeltaInSubtree(b, 2).Int64())
+	require.Equal(t, int64(2), tracer.BalanceDeltaInSubtree(c, 1).Int64())
+	require.Equal(t, int64(-9), tracer.BalanceDeltaInSubtree(a, 0).Int64())
+	// untouched accounts and unknown calls
+	require.Zero(t, tracer.BalanceDeltaInSubtree(a, 1).Sign())
+	require.Zero(t, tracer.BalanceDeltaInSubtree(common.Address{4}, 0).Sign())
+	require.Zero(t, tracer.BalanceDeltaInSubtree(b, 4).Sign())
+}
+
+func TestStateChangesFinalValues(t *testing.T) {
+	var (
+		states  = NewStateChanges()
+		account = common.Address{1}
+		valType = common.Hash{1}
+		mapType = common.Hash{2}
+	)
+	require.NoError(t, states.saveKey(account, nil, uint256.NewInt(0), nil, valType, common.Hash{}, []byte("counter")))
+	require.NoError(t, states.saveKey(account, nil, uint256.NewInt(1), nil, mapType, common.Hash{}, []byte("balances")))
+	require.NoError(t, states.saveKey(account, uint256.NewInt(1), uint256.NewInt(100), nil, valType, mapType, []byte{0xaa}))
+	require.NoError(t, states.saveKey(account, nil, uint256.NewInt(2), nil, valType, common.Hash{}, []byte("untouched")))
+
+	require.NoError(t, states.saveChange(account, uint256.NewInt(0), nil, valType, 0, []byte{1}))
+	require.NoError(t, states.saveChange(account, uint256.NewInt(0), nil, valType, 1, []byte{2}))
+	require.NoError(t, states.saveChange(account, uint256.NewInt(100), nil, valType, 1, []byte{3}))
+	require.NoError(t, states.saveChange(account, uint256.NewInt(100), nil, valType, 1, []byte{4}))
+
+	require.Equal(t, map[string][]byte{
+		"counter":        {2},
+		"balances[0xaa]": {4},
+	}, states.FinalValues(account))
+	require.Nil(t, states.FinalValues(common.Address{2}))
+}
+
+func TestTracerLogOpcodes(t *testing.T) {
+	statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+
+	contract := common.Address{1}
+	// log2(0, 0, 1, 0) log0(0, 0) stop
+	statedb.SetCode(contract, common.Hex2Bytes("6000600160006000a260006000a000"))
+
+	evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+	evm.CloseAspectCall()
+	_, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), contract, nil, 100000, new(big.Int))
+	require.NoError(t, err)
+
+	logs := evm.Tracer().TracedLogsOfCall(0)
+	require.Len(t, logs, 2)
+
+	require.Equal(t, LOG2, logs[0].Op)
+	require.Equal(t, 2, logs[0].TopicCount())
+	require.Equal(t, uint64(8), logs[0].PC)
+	require.Len(t, logs[0].Topics, 2)
+
+	require.Equal(t, LOG0, logs[1].Op)
+	require.Equal(t, 0, logs[1].TopicCount())
+	require.Equal(t, uint64(13), logs[1].PC)
+}
+
+func TestTracerEventLogs(t *testing.T) {
+	var (
+		tracer = NewTracer()
+		parent = common.Address{1}
+		child  = common.Address{2}
+	)
+	require.Empty(t, tracer.EventLogs())
+
+	tracer.SaveCall(common.Address{}, &parent, nil, uint256.NewInt(0), uint256.NewInt(100))
+	tracer.saveLog(0, 1, LOG0, &types.Log{Address: parent})
+	tracer.SaveCall(parent, &child, nil, uint256.NewInt(0), uint256.NewInt(50))
+	tracer.saveLog(1, 2, LOG1, &types.Log{Address: child, Topics: []common.Hash{{1}}})
+	tracer.ExitCall(10, nil, nil)
+	tracer.saveLog(0, 3, LOG0, &types.Log{Address: parent})
+	tracer.ExitCall(20, nil, nil)
+
+	logs := tracer.EventLogs()
+	require.Len(t, logs, 3)
+	for i, expected := range []struct {
+		address   common.Address
+		pc        uint64
+		callIndex uint64
+		callDepth int
+	}{{parent, 1, 0, 0}, {child, 2, 1, 1}, {parent, 3, 0, 0}} {
+		require.Equal(t, expected.address, logs[i].Address)
+		require.Equal(t, expected.pc, logs[i].PC)
+		require.Equal(t, expected.callIndex, logs[i].CallIndex)
+		require.Equal(t, expected.callDepth, logs[i].CallDepth)
+	}
+	require.Equal(t, 1, tracer.CallTree().FindCall(1).Depth())
+
+	// the logs are copies
+	logs[0].PC = 100
+	require.Equal(t, uint64(1), tracer.EventLogs()[0].PC)
+
+	// the metadata is encoded along with the log
+	data, err := json.Marshal(tracer.EventLogs()[1])
+	require.NoError(t, err)
+	var decoded TracedLog
+	require.NoError(t, json.Unmarshal(data, &decoded))
+	require.Equal(t, child, decoded.Address)
+	require.Equal(t, []common.Hash{{1}}, decoded.Topics)
+	require.Equal(t, LOG1, decoded.Op)
+	require.Equal(t, uint64(1), decoded.CallIndex)
+	require.Equal(t, 1, decoded.CallDepth)
+
+	// the opcode of a recorded log is told by its topics
+	recorded := &types.Log{Address: parent, Topics: []common.Hash{{1}, {2}}}
+	tracer.RecordLog(recorded, 0)
+	require.Equal(t, LOG2, tracer.TracedLogsOfCall(0)[2].Op)
+	require.Same(t, recorded, tracer.LogsOfCall(0)[2])
+}
+
+// logDataCode emits a log of 4KB of data with one topic: log1(0, 0x1000, 1) stop
+var logDataCode = common.Hex2Bytes("6001" + "611000" + "6000" + "a1" + "00")
+
+func TestTracerLogSummaries(t *testing.T) {
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+	contract := common.Address{1}
+
+	for _, summariesOnly := range []bool{false, true} {
+		statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		statedb.SetCode(contract, logDataCode)
+
+		evm := NewEVM(vmctx, TxContext{}, statedb, params.AllEthashProtocolChanges, Config{})
+		evm.CloseAspectCall()
+		evm.Tracer().LogSummariesOnly = summariesOnly
+		_, _, err := evm.Call(context.Background(), AccountRef(common.Address{}), contract, nil, 100000, new(big.Int))
+		require.NoError(t, err)
+
+		summaries := evm.Tracer().CallTree().Root().LogSummaries()
+		require.Equal(t, []LogSummary{{
+			Address: contract,
+			Topics:  []common.Hash{common.BigToHash(big.NewInt(1))},
+			DataLen: 0x1000,
+			Op:      LOG1,
+			PC:      7,
+		}}, summaries)
+		require.Equal(t, 1, summaries[0].TopicCount())
+
+		if summariesOnly {
+			require.Empty(t, evm.Tracer().LogsOfCall(0))
+		} else {
+			require.Len(t, evm.Tracer().LogsOfCall(0), 1)
+		}
+	}
+}
+
+// discardLogsStateDB drops the logs added, so that only the tracer retains them
+type discardLogsStateDB struct {
+	*state.StateDB
+}
+
+func (db *discardLogsStateDB) AddLog(*types.Log) {}
+
+func BenchmarkTracerLogRetention(b *testing.B) {
+	vmctx := BlockContext{
+		Transfer:    func(StateDB, common.Address, common.Address, *big.Int) {},
+		BlockNumber: big0,
+	}
+	contract := common.Address{1}
+
+	for _, summariesOnly := range []bool{false, true} {
+		b.Run(fmt.Sprintf("summariesOnly=%v", summariesOnly), func(b *testing.B) {
+			statedb, _ := state.New(common.Hash{}, state.NewDatabase(rawdb.NewMemoryDatabase()), nil)
+			statedb.SetCode(contract, logDataCode)
+
+			evm := NewEVM(vmctx, TxContext{}, &discardLogsStateDB{statedb}, params.AllEthashProtocolChanges, Config{})
+			evm.CloseAspectCall()
+			evm.Tracer().LogSummariesOnly = summariesOnly
+
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// nolint
+				evm.Call(context.Background(), AccountRef(common.Address{}), contract, nil, 100000, new(big.Int))
+			}
+			b.StopTimer()
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(b.N), "retained-B/op")
+			runtime.KeepAlive(evm)
+		})
+	}
+}